@@ -62,7 +62,10 @@ func main() {
 	// fmt.Println("{{672e9bff6a0bc59669954be7b2c2726a74163455ca18664cc350030bc7eca71e, 7}, {31f28d5a995dcdb7c5358fcfa8b9c93f2b8e421fb4a268ca5dc01ca4619dfe5f,2}, {172baa036a7e9f8321cb23a1144787ba1a0727b40cb6283dbb5cba20b84efe50,1}, {745378a914d7bcdc26d3229f98fc2c6887e7d882f42d8491530dfaf4effef827,5}, {912b9d7afecb114fdaefecfa24572d052dde4e1ad2360920ebfe55ebf2e1818e,0}}")
 
 	hash_ring := surfstore.NewConsistentHashRing(numServers, downServersList)
-	blockHashes := surfstore.ComputeHashList(inpFilename, blockSize)
+	blockHashes, err := surfstore.ComputeHashList(inpFilename, blockSize)
+	if err != nil {
+		log.Fatal(err)
+	}
 
 	ret := hash_ring.OutputMap(blockHashes)
 
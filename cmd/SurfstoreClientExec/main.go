@@ -1,81 +1,860 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"cse224/proj4/pkg/surfstore"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strconv"
-)
+	"strings"
+	"syscall"
+	"time"
 
-// Arguments
-const ARG_COUNT int = 3
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
 
 // Usage strings
-const USAGE_STRING = "./run-client.sh -d host:port baseDir blockSize"
+const USAGE_STRING = "./run-client.sh [flags] <command> host:port [args]"
 
 const DEBUG_NAME = "d"
-const DEBUG_USAGE = "Output log statements"
+const DEBUG_USAGE = "Output debug log statements (same as -logLevel debug)"
+
+const LOG_LEVEL_NAME = "logLevel"
+const LOG_LEVEL_USAGE = "Lowest level logged: debug, info, warn or error"
+const DEFAULT_LOG_LEVEL = "warn"
+
+const LOG_FORMAT_NAME = "logFormat"
+const LOG_FORMAT_USAGE = "Log format: text or json"
+
+const LOG_FILE_NAME = "logFile"
+const LOG_FILE_USAGE = "Append logs to this file instead of stderr"
+
+const REQUEST_ID_NAME = "requestId"
+const REQUEST_ID_USAGE = "Request ID sent with every RPC and logged by the servers (default random for each command, or each sync of daemon)"
+
+const TOKEN_NAME = "t"
+const TOKEN_USAGE = "Auth token sent to the servers over TLS (default $SURFSTORE_TOKEN)"
+const TOKEN_ENV = "SURFSTORE_TOKEN"
+
+const TLS_NAME = "tls"
+const TLS_USAGE = "Connect over TLS (implied by -tlsCA and -tlsCert)"
+
+const TLS_CA_NAME = "tlsCA"
+const TLS_CA_USAGE = "PEM CA bundle used to verify the servers (default system roots)"
+
+const TLS_CERT_NAME = "tlsCert"
+const TLS_CERT_USAGE = "PEM client certificate for servers that require mTLS"
+
+const TLS_KEY_NAME = "tlsKey"
+const TLS_KEY_USAGE = "PEM private key for -tlsCert"
+
+const ENCRYPT_NAME = "encrypt"
+const ENCRYPT_USAGE = "Encrypt blocks on the client with a key derived from $SURFSTORE_PASSPHRASE"
+const PASSPHRASE_ENV = "SURFSTORE_PASSPHRASE"
+
+const PASSPHRASE_FILE_NAME = "passphraseFile"
+const PASSPHRASE_FILE_USAGE = "Read the encryption passphrase from this file instead of $SURFSTORE_PASSPHRASE"
+
+const ENCRYPT_NAMES_NAME = "encryptNames"
+const ENCRYPT_NAMES_USAGE = "Also encrypt filenames (implies -encrypt)"
+
+const COMPRESS_NAME = "compress"
+const COMPRESS_USAGE = "Compress uploaded blocks with zstd or snappy, not with encryption (default none)"
+
+const PARANOID_NAME = "paranoid"
+const PARANOID_USAGE = "Rehash every file instead of trusting size, mtime and inode cached in the index"
+
+const SYMLINKS_NAME = "symlinks"
+const SYMLINKS_USAGE = "How to sync symlinks in the base directory: follow, preserve or skip"
+
+const IGNORE_FILE_NAME = "ignoreFile"
+const IGNORE_FILE_USAGE = "Global ignore rules applied before every .surfignore, empty for none"
+
+const DRY_RUN_NAME = "dry-run"
+const DRY_RUN_USAGE = "Print the sync plan without uploading, updating or writing anything (same as status)"
+
+const JSON_NAME = "json"
+const JSON_USAGE = "Print the output of sync, status, ls and log as JSON"
+
+const REPORT_NAME = "report"
+const REPORT_USAGE = "Print a report of every file sync and daemon changed, as text or json (-json implies json)"
+
+// Report formats
+const REPORT_TEXT = "text"
+const REPORT_JSON = "json"
+
+const RPC_TIMEOUT_NAME = "rpcTimeout"
+const RPC_TIMEOUT_USAGE = "Deadline of each RPC, 0 for none"
 
-const ADDR_NAME = "host:port"
-const ADDR_USAGE = "IP address and port of the MetaStore the client is syncing to"
+const TIMEOUT_NAME = "timeout"
+const TIMEOUT_USAGE = "Deadline of the whole command, 0 for none (default 0)"
 
-const BASEDIR_NAME = "baseDir"
-const BASEDIR_USAGE = "Base directory of the client"
+const UPLOAD_LIMIT_NAME = "uploadLimit"
+const UPLOAD_LIMIT_USAGE = "Upload rate limit in bytes per second, with an optional k, M or G suffix (default off)"
 
-const BLOCK_NAME = "blockSize"
-const BLOCK_USAGE = "Size of the blocks used to fragment files"
+const DOWNLOAD_LIMIT_NAME = "downloadLimit"
+const DOWNLOAD_LIMIT_USAGE = "Download rate limit in bytes per second, with an optional k, M or G suffix (default off)"
 
-// Exit codes
+const INTERVAL_NAME = "interval"
+const INTERVAL_USAGE = "Time between two syncs of daemon"
+
+const SCHEDULE_NAME = "schedule"
+const SCHEDULE_USAGE = "Times of day daemon may sync, as HH:MM-HH:MM[@upload[:download]],... (default any time)"
+const DEFAULT_INTERVAL = time.Minute
+
+const BLOCK_FLAG_NAME = "blockSize"
+const BLOCK_FLAG_USAGE = "Size of the blocks used to fragment files (sync, status and put)"
+const DEFAULT_BLOCK_SIZE int = 4096
+
+// Commands
+const SYNC_COMMAND = "sync"
+const STATUS_COMMAND = "status"
+const LS_COMMAND = "ls"
+const CAT_COMMAND = "cat"
+const GET_COMMAND = "get"
+const PUT_COMMAND = "put"
+const RM_COMMAND = "rm"
+const LOG_COMMAND = "log"
+const RESTORE_COMMAND = "restore"
+const SELECT_COMMAND = "select"
+const DAEMON_COMMAND = "daemon"
+const USAGE_COMMAND = "usage"
+const REFS_COMMAND = "refs"
+
+// Arguments of each command after host:port, and how many are optional;
+// local commands take no host:port, and a max of -1 means no limit
+var COMMAND_ARGS = map[string]struct {
+	args, usage string
+	min, max    int
+	local       bool
+}{
+	SYNC_COMMAND:    {"baseDir [blockSize]", "Sync baseDir with the server", 1, 2, false},
+	STATUS_COMMAND:  {"baseDir [blockSize]", "Print what sync would do", 1, 2, false},
+	DAEMON_COMMAND:  {"baseDir [blockSize]", "Sync baseDir every interval until stopped", 1, 2, false},
+	LS_COMMAND:      {"", "List remote files", 0, 0, false},
+	CAT_COMMAND:     {"file", "Print a remote file", 1, 1, false},
+	GET_COMMAND:     {"file [dest]", "Download a remote file", 1, 2, false},
+	PUT_COMMAND:     {"localFile [remoteName]", "Upload a single file", 1, 2, false},
+	RM_COMMAND:      {"file", "Delete a remote file", 1, 1, false},
+	LOG_COMMAND:     {"file", "List the versions the server retains", 1, 1, false},
+	RESTORE_COMMAND: {"file version", "Republish an earlier version", 2, 2, false},
+	SELECT_COMMAND:  {"baseDir [prefix|!prefix|. ...]", "Print or set the paths baseDir syncs", 1, -1, true},
+	USAGE_COMMAND:   {"", "Print the storage used and the quota (every namespace and block store for admins)", 0, 0, false},
+	REFS_COMMAND:    {"blockHash", "List the files referencing a block (in every namespace for admins)", 1, 1, false},
+}
+var COMMAND_ORDER = []string{SYNC_COMMAND, STATUS_COMMAND, DAEMON_COMMAND, LS_COMMAND, CAT_COMMAND, GET_COMMAND,
+	PUT_COMMAND, RM_COMMAND, LOG_COMMAND, RESTORE_COMMAND, SELECT_COMMAND, USAGE_COMMAND, REFS_COMMAND}
+
+// Exit codes, following sysexits.h
+const EX_OK int = 0
+const EX_FAILURE int = 1
 const EX_USAGE int = 64
+const EX_DATAERR int = 65
+const EX_NOINPUT int = 66
+const EX_UNAVAILABLE int = 69
+const EX_CANTCREAT int = 73
+const EX_IOERR int = 74
+const EX_TEMPFAIL int = 75
+const EX_NOPERM int = 77
+const EX_INTERRUPTED int = 130
 
 func main() {
 	// Custom flag Usage message
 	flag.Usage = func() {
 		w := flag.CommandLine.Output()
 		fmt.Fprintf(w, "Usage of %s:\n", USAGE_STRING)
+		fmt.Fprintf(w, "Commands:\n")
+		for _, command := range COMMAND_ORDER {
+			spec := COMMAND_ARGS[command]
+			if spec.local {
+				fmt.Fprintf(w, "  %s: %v\n", strings.TrimSpace(command+" "+spec.args), spec.usage)
+			} else {
+				fmt.Fprintf(w, "  %s: %v\n", strings.TrimSpace(command+" host:port "+spec.args), spec.usage)
+			}
+		}
+		fmt.Fprintf(w, "  host:port baseDir blockSize: Same as sync\n")
+		fmt.Fprintf(w, "Flags:\n")
 		fmt.Fprintf(w, "  -%s: %v\n", DEBUG_NAME, DEBUG_USAGE)
-		fmt.Fprintf(w, "  %s: %v\n", ADDR_NAME, ADDR_USAGE)
-		fmt.Fprintf(w, "  %s: %v\n", BASEDIR_NAME, BASEDIR_USAGE)
-		fmt.Fprintf(w, "  %s: %v\n", BLOCK_NAME, BLOCK_USAGE)
+		fmt.Fprintf(w, "  -%s: %v (default %v)\n", LOG_LEVEL_NAME, LOG_LEVEL_USAGE, DEFAULT_LOG_LEVEL)
+		fmt.Fprintf(w, "  -%s: %v (default %v)\n", LOG_FORMAT_NAME, LOG_FORMAT_USAGE, surfstore.LogText)
+		fmt.Fprintf(w, "  -%s: %v\n", LOG_FILE_NAME, LOG_FILE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", REQUEST_ID_NAME, REQUEST_ID_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", TOKEN_NAME, TOKEN_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", TLS_NAME, TLS_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", TLS_CA_NAME, TLS_CA_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", TLS_CERT_NAME, TLS_CERT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", TLS_KEY_NAME, TLS_KEY_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", ENCRYPT_NAME, ENCRYPT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", PASSPHRASE_FILE_NAME, PASSPHRASE_FILE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", ENCRYPT_NAMES_NAME, ENCRYPT_NAMES_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", COMPRESS_NAME, COMPRESS_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", PARANOID_NAME, PARANOID_USAGE)
+		fmt.Fprintf(w, "  -%s: %v (default %v)\n", SYMLINKS_NAME, SYMLINKS_USAGE, surfstore.SymlinkFollow)
+		fmt.Fprintf(w, "  -%s: %v (default %v)\n", IGNORE_FILE_NAME, IGNORE_FILE_USAGE, surfstore.DefaultGlobalIgnoreFile())
+		fmt.Fprintf(w, "  -%s: %v\n", DRY_RUN_NAME, DRY_RUN_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", JSON_NAME, JSON_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", REPORT_NAME, REPORT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v (default %v)\n", RPC_TIMEOUT_NAME, RPC_TIMEOUT_USAGE, surfstore.DEFAULT_RPC_TIMEOUT)
+		fmt.Fprintf(w, "  -%s: %v\n", TIMEOUT_NAME, TIMEOUT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", UPLOAD_LIMIT_NAME, UPLOAD_LIMIT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", DOWNLOAD_LIMIT_NAME, DOWNLOAD_LIMIT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v (default %v)\n", INTERVAL_NAME, INTERVAL_USAGE, DEFAULT_INTERVAL)
+		fmt.Fprintf(w, "  -%s: %v\n", SCHEDULE_NAME, SCHEDULE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v (default %d)\n", BLOCK_FLAG_NAME, BLOCK_FLAG_USAGE, DEFAULT_BLOCK_SIZE)
+		fmt.Fprintf(w, "Exit status: 0 success, 1 failure, %d usage, %d corrupted block, %d no such file, %d server unavailable, %d over quota, %d local I/O error, %d conflict, retry, %d permission denied, %d interrupted\n",
+			EX_USAGE, EX_DATAERR, EX_NOINPUT, EX_UNAVAILABLE, EX_CANTCREAT, EX_IOERR, EX_TEMPFAIL, EX_NOPERM, EX_INTERRUPTED)
 	}
 
 	// Parse command-line arguments and flags
-	debug := flag.Bool("d", false, DEBUG_USAGE)
+	debug := flag.Bool(DEBUG_NAME, false, DEBUG_USAGE)
+	logLevelName := flag.String(LOG_LEVEL_NAME, DEFAULT_LOG_LEVEL, LOG_LEVEL_USAGE)
+	logFormatName := flag.String(LOG_FORMAT_NAME, string(surfstore.LogText), LOG_FORMAT_USAGE)
+	logFileName := flag.String(LOG_FILE_NAME, "", LOG_FILE_USAGE)
+	requestID := flag.String(REQUEST_ID_NAME, "", REQUEST_ID_USAGE)
+	token := flag.String(TOKEN_NAME, os.Getenv(TOKEN_ENV), TOKEN_USAGE)
+	useTLS := flag.Bool(TLS_NAME, false, TLS_USAGE)
+	tlsCA := flag.String(TLS_CA_NAME, "", TLS_CA_USAGE)
+	tlsCert := flag.String(TLS_CERT_NAME, "", TLS_CERT_USAGE)
+	tlsKey := flag.String(TLS_KEY_NAME, "", TLS_KEY_USAGE)
+	encrypt := flag.Bool(ENCRYPT_NAME, false, ENCRYPT_USAGE)
+	passphraseFile := flag.String(PASSPHRASE_FILE_NAME, "", PASSPHRASE_FILE_USAGE)
+	encryptNames := flag.Bool(ENCRYPT_NAMES_NAME, false, ENCRYPT_NAMES_USAGE)
+	compress := flag.String(COMPRESS_NAME, "none", COMPRESS_USAGE)
+	paranoid := flag.Bool(PARANOID_NAME, false, PARANOID_USAGE)
+	symlinks := flag.String(SYMLINKS_NAME, string(surfstore.SymlinkFollow), SYMLINKS_USAGE)
+	ignoreFile := flag.String(IGNORE_FILE_NAME, surfstore.DefaultGlobalIgnoreFile(), IGNORE_FILE_USAGE)
+	dryRun := flag.Bool(DRY_RUN_NAME, false, DRY_RUN_USAGE)
+	jsonOutput := flag.Bool(JSON_NAME, false, JSON_USAGE)
+	report := flag.String(REPORT_NAME, "", REPORT_USAGE)
+	rpcTimeout := flag.Duration(RPC_TIMEOUT_NAME, surfstore.DEFAULT_RPC_TIMEOUT, RPC_TIMEOUT_USAGE)
+	timeout := flag.Duration(TIMEOUT_NAME, 0, TIMEOUT_USAGE)
+	uploadLimit := flag.String(UPLOAD_LIMIT_NAME, "off", UPLOAD_LIMIT_USAGE)
+	downloadLimit := flag.String(DOWNLOAD_LIMIT_NAME, "off", DOWNLOAD_LIMIT_USAGE)
+	interval := flag.Duration(INTERVAL_NAME, DEFAULT_INTERVAL, INTERVAL_USAGE)
+	scheduleSpec := flag.String(SCHEDULE_NAME, "", SCHEDULE_USAGE)
+	blockSize := flag.Int(BLOCK_FLAG_NAME, DEFAULT_BLOCK_SIZE, BLOCK_FLAG_USAGE)
 	flag.Parse()
 
-	// Use tail arguments to hold non-flag arguments
+	// Global flags may also follow the command
 	args := flag.Args()
-
-	if len(args) != ARG_COUNT {
+	command := SYNC_COMMAND
+	if len(args) > 0 {
+		if _, ok := COMMAND_ARGS[args[0]]; ok {
+			command = args[0]
+			flag.CommandLine.Parse(args[1:])
+			args = flag.Args()
+		}
+	}
+	spec := COMMAND_ARGS[command]
+	server_args := 1
+	if spec.local {
+		server_args = 0
+	}
+	if len(args) < server_args+spec.min || (spec.max >= 0 && len(args) > server_args+spec.max) {
 		flag.Usage()
 		os.Exit(EX_USAGE)
 	}
-
+	if command == SELECT_COMMAND {
+		os.Exit(runSelect(args[0], args[1:], *jsonOutput))
+	}
 	hostPort := args[0]
-	baseDir := args[1]
-	blockSize, err := strconv.Atoi(args[2])
+	args = args[1:]
+	if command == STATUS_COMMAND {
+		*dryRun = true
+	}
+
+	baseDir := ""
+	if command == SYNC_COMMAND || command == STATUS_COMMAND || command == DAEMON_COMMAND {
+		baseDir = args[0]
+		if len(args) == 2 {
+			size, err := strconv.Atoi(args[1])
+			if err != nil {
+				flag.Usage()
+				os.Exit(EX_USAGE)
+			}
+			*blockSize = size
+		}
+	}
+	if *blockSize <= 0 {
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+	codec, err := surfstore.ParseCodec(*compress)
+	if err != nil {
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+	symlinkPolicy, err := surfstore.ParseSymlinkPolicy(*symlinks)
+	if err != nil {
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+	limits := make([]int64, 2)
+	for i, limit := range []string{*uploadLimit, *downloadLimit} {
+		if limits[i], err = surfstore.ParseRate(limit); err != nil {
+			os.Exit(fail(err, EX_USAGE))
+		}
+	}
+	schedule, err := surfstore.ParseSchedule(*scheduleSpec)
 	if err != nil {
+		os.Exit(fail(err, EX_USAGE))
+	}
+	if *interval <= 0 {
 		flag.Usage()
 		os.Exit(EX_USAGE)
 	}
+	if *jsonOutput && *report == "" {
+		*report = REPORT_JSON
+	}
+	if *report != "" && *report != REPORT_TEXT && *report != REPORT_JSON {
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+
+	logLevel, err := surfstore.ParseLogLevel(*logLevelName)
+	if err != nil {
+		os.Exit(fail(err, EX_USAGE))
+	}
+	if *debug {
+		logLevel = surfstore.LevelDebug
+	}
+	logFormat, err := surfstore.ParseLogFormat(*logFormatName)
+	if err != nil {
+		os.Exit(fail(err, EX_USAGE))
+	}
+	var logOutput io.Writer = os.Stderr
+	if *logFileName != "" {
+		logFile, err := os.OpenFile(*logFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			os.Exit(fail(err, EX_IOERR))
+		}
+		logOutput = logFile
+	}
+
+	rpcClient := surfstore.NewSurfstoreRPCClient(hostPort, baseDir, *blockSize)
+	rpcClient.Token = *token
+	rpcClient.Compression = codec
+	rpcClient.Paranoid = *paranoid
+	rpcClient.RPCTimeout = *rpcTimeout
+	rpcClient.Symlinks = symlinkPolicy
+	rpcClient.IgnoreFile = *ignoreFile
+	rpcClient.UploadThrottle = surfstore.NewThrottle(limits[0])
+	rpcClient.DownloadThrottle = surfstore.NewThrottle(limits[1])
+	rpcClient.Logger = surfstore.NewLogger(logOutput, logLevel, logFormat)
+	if *useTLS || *tlsCA != "" || *tlsCert != "" {
+		creds, err := surfstore.NewClientTLSCredentials(*tlsCA, *tlsCert, *tlsKey)
+		if err != nil {
+			os.Exit(fail(err, EX_USAGE))
+		}
+		rpcClient.TransportCredentials = creds
+	}
+	if *token != "" && rpcClient.TransportCredentials == nil {
+		// tokens are bearer credentials, anyone who reads one can use it
+		os.Exit(fail(fmt.Errorf("-%v needs TLS (-%v or -tlsCA)", TOKEN_NAME, TLS_NAME), EX_USAGE))
+	}
+	// the progress line would be torn by frequent logs on the same terminal
+	var progress *surfstore.TerminalProgress
+	quietLog := *logFileName != "" || logLevel >= surfstore.LevelWarn
+	if (command == SYNC_COMMAND || command == DAEMON_COMMAND) && !*dryRun && isTerminal(os.Stderr) && quietLog {
+		progress = surfstore.NewTerminalProgress(os.Stderr)
+		rpcClient.Progress = progress
+	}
+	useCipher := *encrypt || *encryptNames || *passphraseFile != ""
+	passphrase := os.Getenv(PASSPHRASE_ENV)
+	if *passphraseFile != "" {
+		content, err := ioutil.ReadFile(*passphraseFile)
+		if err != nil {
+			os.Exit(fail(err, EX_NOINPUT))
+		}
+		passphrase = strings.TrimRight(string(content), "\r\n")
+	}
+	if useCipher && passphrase == "" {
+		os.Exit(fail(errors.New("Empty passphrase"), EX_USAGE))
+	}
+	if useCipher && codec != surfstore.Codec_CODEC_NONE {
+		// blocks are compressed after sealing, and ciphertext does not compress
+		os.Exit(fail(fmt.Errorf("-%v cannot be combined with encryption", COMPRESS_NAME), EX_USAGE))
+	}
+
+	// Ctrl-C cancels the command; a sync stops between blocks and still
+	// records the files it finished in the index
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	cancel := stop
+	if *timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, *timeout)
+	}
+	if *requestID == "" && command != DAEMON_COMMAND {
+		*requestID = surfstore.NewRequestID()
+	}
+	if *requestID != "" {
+		ctx = surfstore.WithRequestID(ctx, *requestID)
+	}
+	if useCipher {
+		// the keys depend on the salt of the namespace, kept by the MetaStore;
+		// only commands that upload create it
+		uploads := command == DAEMON_COMMAND || command == PUT_COMMAND || (command == SYNC_COMMAND && !*dryRun)
+		var salt []byte
+		if err := rpcClient.GetNamespaceSalt(ctx, uploads, &salt); err != nil {
+			os.Exit(fail(err, exitCode(ctx, err)))
+		}
+		if len(salt) == 0 {
+			// nothing in the namespace is encrypted yet, and a throwaway salt
+			// finds the same: no file to open
+			salt = make([]byte, surfstore.CRYPTO_SALT_SIZE)
+			if _, err := rand.Read(salt); err != nil {
+				os.Exit(fail(err, EX_FAILURE))
+			}
+		}
+		cipher, err := surfstore.NewBlockCipher(passphrase, salt, *encryptNames)
+		if err != nil {
+			os.Exit(fail(err, EX_FAILURE))
+		}
+		rpcClient.Cipher = cipher
+	}
+	var code int
+	if command == DAEMON_COMMAND {
+		code = runDaemon(ctx, rpcClient, progress, *interval, schedule, limits[0], limits[1], *report)
+	} else {
+		code = runCommand(ctx, rpcClient, progress, command, args, *dryRun, *jsonOutput, *report)
+	}
+	cancel()
+	stop()
+	rpcClient.Close()
+	os.Exit(code)
+}
+
+// runCommand runs one command and returns the exit code.
+func runCommand(ctx context.Context, client surfstore.RPCClient, progress *surfstore.TerminalProgress,
+	command string, args []string, dryRun bool, jsonOutput bool, report string) int {
+	var err error
+	switch command {
+	case SYNC_COMMAND, STATUS_COMMAND:
+		if !dryRun {
+			var result *surfstore.SyncResult
+			result, err = surfstore.ClientSync(ctx, client)
+			if progress != nil {
+				progress.Clear()
+			}
+			// the report lists the files done before a failure too
+			if report != "" {
+				if report_err := writeSyncReport(result, report, true); report_err != nil && err == nil {
+					err = report_err
+				}
+			}
+			break
+		}
+		var plan *surfstore.SyncPlan
+		plan, err = surfstore.PlanSync(ctx, client)
+		if err == nil {
+			if jsonOutput {
+				err = plan.WriteJSON(os.Stdout)
+			} else {
+				err = plan.WriteText(os.Stdout)
+			}
+		}
+	case LS_COMMAND:
+		var files []*surfstore.FileMetaData
+		files, err = surfstore.ListRemoteFiles(ctx, client)
+		if err == nil {
+			err = writeFileList(files, jsonOutput)
+		}
+	case CAT_COMMAND:
+		_, err = surfstore.DownloadFile(ctx, client, args[0], os.Stdout)
+	case GET_COMMAND:
+		dest := filepath.Base(args[0])
+		if len(args) == 2 {
+			dest = args[1]
+		}
+		var downloadErr error
+		err = surfstore.ReplaceFileAtomic(dest, surfstore.FilePerm(dest, 0644), func(w io.Writer) error {
+			_, downloadErr = surfstore.DownloadFile(ctx, client, args[0], w)
+			return downloadErr
+		})
+		if err != nil && downloadErr == nil {
+			return fail(err, EX_IOERR)
+		}
+	case PUT_COMMAND:
+		remoteName := filepath.Base(args[0])
+		if len(args) == 2 {
+			remoteName = args[1]
+		}
+		info, statErr := os.Stat(args[0])
+		if statErr != nil {
+			return fail(statErr, EX_NOINPUT)
+		}
+		if !info.Mode().IsRegular() {
+			return fail(fmt.Errorf("%v is not a regular file", args[0]), EX_NOINPUT)
+		}
+		var meta *surfstore.FileMetaData
+		if meta, err = surfstore.UploadFile(ctx, client, args[0], remoteName); err == nil {
+			fmt.Printf("%v: version %d\n", meta.Filename, meta.Version)
+		}
+	case RM_COMMAND:
+		var meta *surfstore.FileMetaData
+		if meta, err = surfstore.RemoveRemoteFile(ctx, client, args[0]); err == nil {
+			fmt.Printf("%v: deleted in version %d\n", meta.Filename, meta.Version)
+		}
+	case LOG_COMMAND:
+		var history []*surfstore.FileMetaData
+		if err = client.GetFileHistory(ctx, args[0], &history); err == nil {
+			if len(history) == 0 {
+				err = fmt.Errorf("%v: %w", args[0], surfstore.ErrFileNotFound)
+			} else {
+				err = writeFileList(history, jsonOutput)
+			}
+		}
+	case USAGE_COMMAND:
+		var usage *surfstore.StorageUsage
+		if usage, err = surfstore.GetStorageUsage(ctx, client); err == nil {
+			err = writeUsage(usage, jsonOutput)
+		}
+	case REFS_COMMAND:
+		refs := &surfstore.BlockReferences{}
+		if err = client.GetBlockReferences(ctx, args[0], refs); err == nil {
+			if len(refs.Files) == 0 {
+				err = fmt.Errorf("%v: %w", args[0], surfstore.ErrBlockNotReferenced)
+			} else {
+				err = writeBlockReferences(refs, jsonOutput)
+			}
+		}
+	case RESTORE_COMMAND:
+		version, convErr := strconv.ParseInt(args[1], 10, 32)
+		if convErr != nil {
+			flag.Usage()
+			return EX_USAGE
+		}
+		var meta *surfstore.FileMetaData
+		if meta, err = surfstore.RestoreFileVersion(ctx, client, args[0], int32(version)); err == nil {
+			fmt.Printf("%v: version %d restored as version %d\n", meta.Filename, version, meta.Version)
+		}
+	}
+	if err != nil {
+		return fail(err, exitCode(ctx, err))
+	}
+	return EX_OK
+}
+
+// runDaemon syncs every interval inside the windows of schedule, applying
+// each window's rate limits, until ctx is cancelled. Failed syncs are
+// reported and retried at the next interval.
+func runDaemon(ctx context.Context, client surfstore.RPCClient, progress *surfstore.TerminalProgress, interval time.Duration,
+	schedule surfstore.Schedule, uploadLimit int64, downloadLimit int64, report string) int {
+	for {
+		window, ok := schedule.At(time.Now())
+		if !ok {
+			wait := schedule.Next(time.Now())
+			client.Logger.Info("Outside the schedule", "next_sync", wait)
+			if !sleepContext(ctx, wait) {
+				return EX_OK
+			}
+			continue
+		}
+		client.UploadThrottle.SetLimit(windowLimit(window.UploadLimit, uploadLimit))
+		client.DownloadThrottle.SetLimit(windowLimit(window.DownloadLimit, downloadLimit))
+
+		start := time.Now()
+		uploaded, downloaded := client.UploadThrottle.Total(), client.DownloadThrottle.Total()
+		result, err := surfstore.ClientSync(ctx, client)
+		if progress != nil {
+			progress.Clear()
+		}
+		if ctx.Err() != nil {
+			return EX_OK
+		}
+		if report == REPORT_JSON {
+			// one line per sync, failed ones included
+			if err := writeSyncReport(result, report, false); err != nil {
+				return fail(err, EX_IOERR)
+			}
+		} else if err != nil {
+			fmt.Fprintf(os.Stderr, "%v error: %v\n", time.Now().Format(time.RFC3339), err)
+		} else {
+			if report == REPORT_TEXT {
+				if err := writeFileReports(result); err != nil {
+					return fail(err, EX_IOERR)
+				}
+			}
+			elapsed := time.Since(start).Seconds()
+			uploaded = client.UploadThrottle.Total() - uploaded
+			downloaded = client.DownloadThrottle.Total() - downloaded
+			fmt.Printf("%v synced: %d uploaded, %d downloaded, %d removed, %d conflicts; sent %v (%v), received %v (%v)\n",
+				time.Now().Format(time.RFC3339), len(result.Uploaded), len(result.Downloaded), len(result.Removed),
+				len(result.Conflicts), surfstore.FormatBytes(float64(uploaded)), surfstore.FormatRate(float64(uploaded)/elapsed),
+				surfstore.FormatBytes(float64(downloaded)), surfstore.FormatRate(float64(downloaded)/elapsed))
+		}
+		if !sleepContext(ctx, interval) {
+			return EX_OK
+		}
+	}
+}
+
+func windowLimit(limit *int64, def int64) int64 {
+	if limit == nil {
+		return def
+	}
+	return *limit
+}
+
+// sleepContext waits for d and reports false if ctx ends first.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// isTerminal reports whether f is a terminal.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// writeSyncReport prints every file of a sync result and the totals, as
+// text or as JSON, indented or on a single line.
+func writeSyncReport(result *surfstore.SyncResult, format string, indent bool) error {
+	if format == REPORT_JSON {
+		encoder := json.NewEncoder(os.Stdout)
+		if indent {
+			encoder.SetIndent("", "  ")
+		}
+		return encoder.Encode(result)
+	}
+	if err := writeFileReports(result); err != nil {
+		return err
+	}
+	_, err := fmt.Printf("%d uploaded, %d downloaded, %d removed, %d conflicts; sent %v, received %v in %.1fs\n",
+		len(result.Uploaded), len(result.Downloaded), len(result.Removed), len(result.Conflicts),
+		surfstore.FormatBytes(float64(result.BytesUploaded)), surfstore.FormatBytes(float64(result.BytesDownloaded)),
+		result.Duration)
+	return err
+}
+
+// writeFileReports prints a line for every file of a sync result.
+func writeFileReports(result *surfstore.SyncResult) error {
+	for _, file := range result.Files {
+		line := fmt.Sprintf("%-10v %v", file.Result, file.Filename)
+		if file.Status == surfstore.StatusConflict || file.Status == surfstore.StatusDeleted {
+			line += fmt.Sprintf(" (%v)", file.Status)
+		} else if file.Result != surfstore.ResultRemoved && file.Result != surfstore.ResultFailed {
+			line += fmt.Sprintf(" v%d, %v", file.Version, surfstore.FormatBytes(float64(file.Bytes)))
+		}
+		if file.Error != "" {
+			line += ": " + file.Error
+		}
+		if _, err := fmt.Println(line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	// Disable log outputs if debug flag is missing
-	if !(*debug) {
-		log.SetFlags(0)
-		log.SetOutput(ioutil.Discard)
+// runSelect prints the selection of baseDir, or replaces it with prefixes.
+func runSelect(baseDir string, prefixes []string, jsonOutput bool) int {
+	if info, err := os.Stat(baseDir); err != nil || !info.IsDir() {
+		return fail(fmt.Errorf("%v is not a directory", baseDir), EX_NOINPUT)
+	}
+	selection, err := surfstore.LoadSelection(baseDir)
+	if err != nil {
+		return fail(err, EX_DATAERR)
+	}
+	if len(prefixes) > 0 {
+		if selection, err = surfstore.ParseSelection(prefixes); err != nil {
+			return fail(err, EX_USAGE)
+		}
+		if err := surfstore.WriteSelection(baseDir, selection); err != nil {
+			return fail(err, EX_IOERR)
+		}
+	}
+	if jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(selection)
 	} else {
-		logFile, err := os.OpenFile(baseDir[:len(baseDir)-1]+".log",
-			os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		_, err = fmt.Println(selection)
+	}
+	if err != nil {
+		return fail(err, EX_IOERR)
+	}
+	return EX_OK
+}
+
+// writeUsage prints one line per namespace and block store, or a JSON object.
+func writeUsage(usage *surfstore.StorageUsage, jsonOutput bool) error {
+	type namespaceEntry struct {
+		Namespace       string `json:"namespace"`
+		Blocks          int64  `json:"blocks"`
+		LogicalBytes    int64  `json:"logicalBytes"`
+		QuotaBytes      int64  `json:"quotaBytes"`
+		ReferencedBytes int64  `json:"referencedBytes"`
+		UniqueBytes     int64  `json:"uniqueBytes"`
+	}
+	type blockStoreEntry struct {
+		Addr          string `json:"addr"`
+		Blocks        int64  `json:"blocks"`
+		StoredBytes   int64  `json:"storedBytes"`
+		CapacityBytes int64  `json:"capacityBytes"`
+	}
+	output := struct {
+		Namespaces  []namespaceEntry  `json:"namespaces"`
+		BlockStores []blockStoreEntry `json:"blockStores,omitempty"`
+	}{Namespaces: []namespaceEntry{}}
+	for _, ns := range usage.Namespaces {
+		output.Namespaces = append(output.Namespaces, namespaceEntry{ns.Namespace, ns.Blocks,
+			ns.LogicalBytes, ns.QuotaBytes, ns.ReferencedBytes, ns.UniqueBytes})
+	}
+	for addr, bs := range usage.BlockStores {
+		output.BlockStores = append(output.BlockStores, blockStoreEntry{addr, bs.Blocks, bs.StoredBytes, bs.CapacityBytes})
+	}
+	sort.Slice(output.BlockStores, func(i, j int) bool { return output.BlockStores[i].Addr < output.BlockStores[j].Addr })
+	if jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(output)
+	}
+	limit := func(used int64, limit int64) string {
+		if limit == 0 {
+			return surfstore.FormatBytes(float64(used)) + " (no limit)"
+		}
+		return fmt.Sprintf("%v of %v (%.0f%%)", surfstore.FormatBytes(float64(used)), surfstore.FormatBytes(float64(limit)),
+			100*float64(used)/float64(limit))
+	}
+	for _, entry := range output.Namespaces {
+		if _, err := fmt.Printf("namespace %v\t%d blocks\t%v\t%v before dedup, %v not shared\n", entry.Namespace, entry.Blocks,
+			limit(entry.LogicalBytes, entry.QuotaBytes), surfstore.FormatBytes(float64(entry.ReferencedBytes)),
+			surfstore.FormatBytes(float64(entry.UniqueBytes))); err != nil {
+			return err
+		}
+	}
+	for _, entry := range output.BlockStores {
+		if _, err := fmt.Printf("blockstore %v\t%d blocks\t%v\n", entry.Addr, entry.Blocks, limit(entry.StoredBytes, entry.CapacityBytes)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeBlockReferences prints one line per file referencing a block, or a
+// JSON object.
+func writeBlockReferences(refs *surfstore.BlockReferences, jsonOutput bool) error {
+	type fileEntry struct {
+		Namespace string  `json:"namespace"`
+		Filename  string  `json:"filename"`
+		Versions  []int32 `json:"versions"`
+	}
+	output := struct {
+		Size     int64       `json:"size"`
+		RefCount int64       `json:"refCount"`
+		Files    []fileEntry `json:"files"`
+	}{Size: refs.Size, RefCount: refs.RefCount, Files: []fileEntry{}}
+	for _, ref := range refs.Files {
+		output.Files = append(output.Files, fileEntry{ref.Namespace, ref.Filename, ref.Versions})
+	}
+	if jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(output)
+	}
+	for _, entry := range output.Files {
+		versions := make([]string, len(entry.Versions))
+		for i, version := range entry.Versions {
+			versions[i] = fmt.Sprintf("v%d", version)
+		}
+		if _, err := fmt.Printf("%v\t%v\t%v\n", entry.Namespace, entry.Filename, strings.Join(versions, ",")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFileList prints one line per file version, or a JSON array.
+func writeFileList(files []*surfstore.FileMetaData, jsonOutput bool) error {
+	type fileEntry struct {
+		Filename string `json:"filename"`
+		Version  int32  `json:"version"`
+		Blocks   int    `json:"blocks"`
+		Deleted  bool   `json:"deleted"`
+		Mode     string `json:"mode,omitempty"`
+		Symlink  string `json:"symlink,omitempty"`
+	}
+	entries := make([]fileEntry, len(files))
+	for i, meta := range files {
+		entries[i] = fileEntry{Filename: meta.Filename, Version: meta.Version}
+		if surfstore.IsTombstone(meta.BlockHashList) {
+			entries[i].Deleted = true
+		} else if surfstore.IsSymlink(meta) {
+			entries[i].Symlink = meta.SymlinkTarget
+		} else {
+			if meta.Mode != 0 {
+				entries[i].Mode = fmt.Sprintf("%04o", meta.Mode)
+			}
+			entries[i].Blocks = len(meta.BlockHashList)
+		}
+	}
+	if jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+	for _, entry := range entries {
+		var err error
+		if entry.Deleted {
+			_, err = fmt.Printf("%v\tv%d\tdeleted\n", entry.Filename, entry.Version)
+		} else if entry.Symlink != "" {
+			_, err = fmt.Printf("%v\tv%d\t-> %v\n", entry.Filename, entry.Version, entry.Symlink)
+		} else {
+			_, err = fmt.Printf("%v\tv%d\t%d blocks\n", entry.Filename, entry.Version, entry.Blocks)
+		}
 		if err != nil {
-			panic(err)
+			return err
 		}
-		log.SetOutput(logFile)
 	}
-	log.Println("Hello world")
+	return nil
+}
+
+// exitCode classifies an error returned by a command.
+func exitCode(ctx context.Context, err error) int {
+	switch {
+	case errors.Is(ctx.Err(), context.Canceled):
+		return EX_INTERRUPTED
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return EX_TEMPFAIL
+	case errors.Is(err, surfstore.ErrFileNotFound), errors.Is(err, surfstore.ErrVersionNotFound),
+		errors.Is(err, surfstore.ErrBlockNotReferenced):
+		return EX_NOINPUT
+	case errors.Is(err, surfstore.ErrConflict):
+		return EX_TEMPFAIL
+	case errors.Is(err, surfstore.ErrIntegrity):
+		return EX_DATAERR
+	case errors.Is(err, surfstore.ErrLocalIO):
+		return EX_IOERR
+	case errors.Is(err, surfstore.ErrQuota):
+		return EX_CANTCREAT
+	case errors.Is(err, surfstore.ErrNetwork):
+		switch status.Code(err) {
+		case codes.Unauthenticated, codes.PermissionDenied:
+			return EX_NOPERM
+		}
+		return EX_UNAVAILABLE
+	}
+	return EX_FAILURE
+}
 
-	rpcClient := surfstore.NewSurfstoreRPCClient(hostPort, baseDir, blockSize)
-	surfstore.ClientSync(rpcClient)
+// fail prints err to stderr and returns code.
+func fail(err error, code int) int {
+	fmt.Fprintf(os.Stderr, "error: %v\n", err)
+	return code
 }
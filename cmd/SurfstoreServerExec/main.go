@@ -1,53 +1,151 @@
 package main
 
 import (
+	"context"
 	"cse224/proj4/pkg/surfstore"
 	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"reflect"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 // Usage String
-const USAGE_STRING = "./run-server.sh -s <service_type> -p <port> -l -d (blockStoreAddr*)"
+const USAGE_STRING = "./run-server.sh -s <service_type> -p <port> -l -d -logLevel <level> -logFormat <format> -logFile <file> -a <authFile> -m <metaStoreAddr> -tlsCert <cert> -tlsKey <key> -tlsClientCA <ca> -tlsCA <ca> -history <n> -admins <users> -quota <sizes> -capacity <size> -metrics <addr> -shutdownTimeout <duration> (blockStoreAddr*)"
+
+// Usage String when the settings come from a config file
+const CONFIG_USAGE_STRING = "./run-server.sh -config <file> -name <server> -d"
+
+// Flags that may be combined with -config
+var CONFIG_FLAGS = map[string]bool{"config": true, "name": true, "d": true}
 
 // Set of valid services
 var SERVICE_TYPES = map[string]bool{"meta": true, "block": true, "both": true}
 
+// Path of the Prometheus metrics on the -metrics listener
+const METRICS_PATH = "/metrics"
+
 // Exit codes
+const EX_FAILURE int = 1
 const EX_USAGE int = 64
 
+// Optional security settings
+type serverOptions struct {
+	authFile        string
+	metaStoreAddr   string
+	tlsCert         string
+	tlsKey          string
+	tlsClientCA     string
+	tlsCA           string
+	historyLimit    int
+	admins          []string
+	defaultQuota    int64
+	quotas          map[string]int64
+	capacity        int64
+	metricsAddr     string
+	shutdownTimeout time.Duration
+	logger          *surfstore.Logger
+	// configPath is re-read on SIGHUP to reload the block store ring
+	configPath string
+	config     *surfstore.ClusterConfig
+}
+
 func main() {
 
 	// Custom flag Usage message
 	flag.Usage = func() {
 		w := flag.CommandLine.Output()
 		fmt.Fprintf(w, "Usage of %s:\n", USAGE_STRING)
+		fmt.Fprintf(w, "   or %s\n", CONFIG_USAGE_STRING)
 		flag.VisitAll(func(f *flag.Flag) {
 			fmt.Fprintf(w, "  -%s: %v\n", f.Name, f.Usage)
 		})
-		fmt.Fprintf(w, "  (blockStoreAddr*): BlockStore Address (include self if service type is both)\n")
+		fmt.Fprintf(w, "  (blockStoreAddr*): BlockStore Addresses forming the ring (include self if service type is both)\n")
 	}
 
 	// Parse command-line argument flags
 	service := flag.String("s", "", "(required) Service Type of the Server: meta, block, both")
 	port := flag.Int("p", 8080, "(default = 8080) Port to accept connections")
 	localOnly := flag.Bool("l", false, "Only listen on localhost")
-	debug := flag.Bool("d", false, "Output log statements")
+	debug := flag.Bool("d", false, "Output debug log statements (same as -logLevel debug)")
+	logLevelName := flag.String("logLevel", "info", "Lowest level logged: debug, info, warn or error")
+	logFormatName := flag.String("logFormat", "text", "Log format: text or json")
+	logFileName := flag.String("logFile", "", "Append logs to this file instead of stderr")
+	var opts serverOptions
+	flag.StringVar(&opts.authFile, "a", "", "User/token file; enables authentication and per-user namespaces")
+	flag.StringVar(&opts.metaStoreAddr, "m", "", "MetaStore address used to authorize block reads (block service with -a only)")
+	flag.StringVar(&opts.tlsCert, "tlsCert", "", "PEM certificate; enables TLS together with -tlsKey")
+	flag.StringVar(&opts.tlsKey, "tlsKey", "", "PEM private key for -tlsCert")
+	flag.StringVar(&opts.tlsClientCA, "tlsClientCA", "", "PEM CA bundle; require client certificates signed by it (mTLS)")
+	flag.StringVar(&opts.tlsCA, "tlsCA", "", "PEM CA bundle used to verify other servers (default system roots)")
+	flag.IntVar(&opts.historyLimit, "history", surfstore.DEFAULT_HISTORY_LIMIT, "Versions of each file kept for log and restore (0 keeps all)")
+	flag.Func("admins", "Comma-separated users of the -a file allowed to call admin RPCs", func(s string) error {
+		opts.admins = strings.Split(s, ",")
+		return nil
+	})
+	flag.Func("quota", "Logical bytes each namespace may use, as <size>[,namespace=<size>...] such as 10G,alice=50G (default none)", func(s string) error {
+		var err error
+		opts.defaultQuota, opts.quotas, err = parseQuotas(s)
+		return err
+	})
+	flag.Func("capacity", "Bytes of block data the block service stores, such as 100G (default no limit)", func(s string) error {
+		var err error
+		opts.capacity, err = surfstore.ParseSize(s)
+		return err
+	})
+	flag.StringVar(&opts.metricsAddr, "metrics", "", "Serve Prometheus metrics at http://<addr>/metrics (default off)")
+	flag.DurationVar(&opts.shutdownTimeout, "shutdownTimeout", surfstore.DEFAULT_SHUTDOWN_TIMEOUT, "Time RPCs in flight get to finish after SIGTERM")
+	flag.StringVar(&opts.configPath, "config", "", "YAML cluster config; replaces every other flag but -name and -d")
+	name := flag.String("name", "", "Server of the -config file to run (may be left out if it defines one)")
 	flag.Parse()
 
-	// Use tail arguments to hold BlockStore address
-	args := flag.Args()
-	blockStoreAddr := ""
-	if len(args) == 1 {
-		blockStoreAddr = args[0]
+	// Use tail arguments to hold the BlockStore ring
+	blockStoreAddrs := flag.Args()
+
+	var addr string
+	if opts.configPath != "" {
+		mixed := false
+		flag.Visit(func(f *flag.Flag) {
+			mixed = mixed || !CONFIG_FLAGS[f.Name]
+		})
+		if mixed || len(blockStoreAddrs) > 0 {
+			fmt.Fprintln(os.Stderr, "-config cannot be combined with other flags or block store addresses")
+			flag.Usage()
+			os.Exit(EX_USAGE)
+		}
+		config, err := surfstore.LoadClusterConfig(opts.configPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(EX_USAGE)
+		}
+		server, err := config.Server(*name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(EX_USAGE)
+		}
+		opts.applyConfig(config, server)
+		*service = server.ServiceType()
+		addr = server.Listen
+		blockStoreAddrs = config.BlockStores
+		*logLevelName, *logFormatName, *logFileName = config.Log.Level, config.Log.Format, config.Log.File
+	} else {
+		// Add localhost if necessary
+		if *localOnly {
+			addr += "localhost"
+		}
+		addr += ":" + strconv.Itoa(*port)
 	}
 
 	// Valid service type argument
@@ -56,44 +154,293 @@ func main() {
 		os.Exit(EX_USAGE)
 	}
 
-	// Add localhost if necessary
-	addr := ""
-	if *localOnly {
-		addr += "localhost"
+	logLevel, err := surfstore.ParseLogLevel(*logLevelName)
+	if err != nil {
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+	if *debug {
+		logLevel = surfstore.LevelDebug
 	}
-	addr += ":" + strconv.Itoa(*port)
+	logFormat, err := surfstore.ParseLogFormat(*logFormatName)
+	if err != nil {
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+	var logOutput io.Writer = os.Stderr
+	if *logFileName != "" {
+		logFile, err := os.OpenFile(*logFileName, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(EX_FAILURE)
+		}
+		logOutput = logFile
+	}
+	opts.logger = surfstore.NewLogger(logOutput, logLevel, logFormat).With("role", strings.ToLower(*service))
 
-	// Disable log outputs if debug flag is missing
-	if !(*debug) {
-		log.SetFlags(0)
-		log.SetOutput(ioutil.Discard)
-	} else {
-		logFile, err := os.OpenFile(fmt.Sprintf("/home/rorshach/Projects/courses/CSE124/proj4-Rorshachk/logs/%v.log", service), os.O_CREATE|os.O_WRONLY, 0644)
+	// SIGTERM or Ctrl-C stops the server gracefully
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := startServer(ctx, addr, strings.ToLower(*service), blockStoreAddrs, opts); err != nil {
+		opts.logger.Error("Server stopped", "error", err)
+		os.Exit(EX_FAILURE)
+	}
+}
+
+// applyConfig takes the settings of one server of a cluster config.
+func (opts *serverOptions) applyConfig(config *surfstore.ClusterConfig, server *surfstore.ServerConfig) {
+	opts.config = config
+	opts.authFile = config.Security.AuthFile
+	opts.metaStoreAddr = config.MetaStore
+	opts.tlsCert = config.Security.TLS.Cert
+	opts.tlsKey = config.Security.TLS.Key
+	opts.tlsClientCA = config.Security.TLS.ClientCA
+	opts.tlsCA = config.Security.TLS.CA
+	opts.historyLimit = config.HistoryLimit
+	opts.admins = config.Security.Admins
+	opts.defaultQuota = int64(config.DefaultQuota)
+	opts.quotas = make(map[string]int64)
+	for namespace, quota := range config.Quotas {
+		opts.quotas[namespace] = int64(quota)
+	}
+	opts.capacity = int64(server.Capacity)
+	opts.shutdownTimeout = config.ShutdownTimeout
+	opts.metricsAddr = server.Metrics
+}
+
+// parseQuotas parses a default quota followed by per-namespace ones, such
+// as "10G,alice=50G"; either part may be left out.
+func parseQuotas(s string) (int64, map[string]int64, error) {
+	var defaultQuota int64
+	quotas := make(map[string]int64)
+	for _, item := range strings.Split(s, ",") {
+		namespace, size := "", item
+		if i := strings.Index(item, "="); i >= 0 {
+			namespace, size = strings.TrimSpace(item[:i]), item[i+1:]
+			if namespace == "" {
+				return 0, nil, fmt.Errorf("Bad quota %v", item)
+			}
+		}
+		quota, err := surfstore.ParseSize(size)
 		if err != nil {
-			panic(err)
+			return 0, nil, err
+		}
+		if namespace == "" {
+			defaultQuota = quota
+		} else {
+			quotas[namespace] = quota
 		}
-		log.SetOutput(logFile)
 	}
-	log.Println("Hello world")
-	log.Fatal(startServer(addr, strings.ToLower(*service), blockStoreAddr))
+	return defaultQuota, quotas, nil
 }
 
-func startServer(hostAddr string, serviceType string, blockStoreAddr string) error {
+// startServer serves until ctx is cancelled, then stops accepting calls and
+// waits up to opts.shutdownTimeout for the calls in flight.
+func startServer(ctx context.Context, hostAddr string, serviceType string, blockStoreAddrs []string, opts serverOptions) error {
+	// Calls are logged with their request ID, rejected ones included
+	interceptors := []grpc.UnaryServerInterceptor{surfstore.LoggingInterceptor(opts.logger)}
+	var metrics *surfstore.Metrics
+	if opts.metricsAddr != "" {
+		metrics = surfstore.NewMetrics()
+		interceptors = append(interceptors, metrics.UnaryInterceptor)
+	}
+	if opts.authFile != "" {
+		auth, err := surfstore.LoadAuthFile(opts.authFile)
+		if err != nil {
+			return err
+		}
+		if err := auth.SetAdmins(opts.admins); err != nil {
+			return err
+		}
+		interceptors = append(interceptors, auth.UnaryInterceptor)
+	} else if len(opts.admins) > 0 {
+		return errors.New("-admins needs an auth file (-a)")
+	} else {
+		opts.logger.Info("No auth file given, serving every client from the default namespace")
+	}
+	server_opts := []grpc.ServerOption{grpc.ChainUnaryInterceptor(interceptors...)}
+
+	// Connections this server makes to other servers present the same
+	// certificate, so they pass mTLS as well
+	var peerCreds credentials.TransportCredentials
+	if opts.tlsCert != "" || opts.tlsKey != "" {
+		creds, err := surfstore.NewServerTLSCredentials(opts.tlsCert, opts.tlsKey, opts.tlsClientCA)
+		if err != nil {
+			return err
+		}
+		server_opts = append(server_opts, grpc.Creds(creds))
+		peerCreds, err = surfstore.NewClientTLSCredentials(opts.tlsCA, opts.tlsCert, opts.tlsKey)
+		if err != nil {
+			return err
+		}
+	} else if opts.tlsClientCA != "" {
+		return errors.New("-tlsClientCA needs -tlsCert and -tlsKey")
+	} else if opts.authFile != "" {
+		opts.logger.Warn("Auth tokens travel in plaintext without -tlsCert and -tlsKey; serve behind a TLS proxy")
+	}
+
 	listen, err := net.Listen("tcp", hostAddr)
-	grpc_server := grpc.NewServer()
 	if err != nil {
-		panic(err)
+		return err
 	}
+	grpc_server := grpc.NewServer(server_opts...)
+	healthChecker := surfstore.NewHealthChecker()
+	healthChecker.TransportCredentials = peerCreds
+	healthChecker.Logger = opts.logger
+	healthpb.RegisterHealthServer(grpc_server, healthChecker.Server)
+	var metaStore *surfstore.MetaStore
 	if serviceType == "block" {
-		surfstore.RegisterBlockStoreServer(grpc_server, surfstore.NewBlockStore())
+		blockStore := surfstore.NewBlockStore()
+		blockStore.Logger = opts.logger
+		blockStore.Capacity = opts.capacity
+		if metrics != nil {
+			metrics.RegisterBlockStore(blockStore)
+		}
+		healthChecker.AddBlockStore(blockStore)
+		if opts.authFile != "" {
+			if opts.metaStoreAddr == "" {
+				return errors.New("Block service with authentication needs a MetaStore address (-m)")
+			}
+			blockStore.Authorizer = &surfstore.RemoteBlockAuthorizer{MetaStoreAddr: opts.metaStoreAddr,
+				TransportCredentials: peerCreds}
+		}
+		surfstore.RegisterBlockStoreServer(grpc_server, blockStore)
 	} else if serviceType == "meta" {
-		surfstore.RegisterMetaStoreServer(grpc_server, surfstore.NewMetaStore(blockStoreAddr))
+		metaStore = newMetaStore(blockStoreAddrs, opts, peerCreds)
+		if metrics != nil {
+			metrics.RegisterMetaStore(metaStore)
+		}
+		healthChecker.AddMetaStore(metaStore)
+		surfstore.RegisterMetaStoreServer(grpc_server, metaStore)
 	} else if serviceType == "both" {
-		surfstore.RegisterBlockStoreServer(grpc_server, surfstore.NewBlockStore())
-		surfstore.RegisterMetaStoreServer(grpc_server, surfstore.NewMetaStore(blockStoreAddr))
+		blockStore := surfstore.NewBlockStore()
+		blockStore.Logger = opts.logger
+		blockStore.Capacity = opts.capacity
+		if metrics != nil {
+			metrics.RegisterBlockStore(blockStore)
+		}
+		healthChecker.AddBlockStore(blockStore)
+		metaStore = newMetaStore(blockStoreAddrs, opts, peerCreds)
+		if metrics != nil {
+			metrics.RegisterMetaStore(metaStore)
+		}
+		healthChecker.AddMetaStore(metaStore)
+		if opts.authFile != "" {
+			blockStore.Authorizer = metaStore
+		}
+		surfstore.RegisterBlockStoreServer(grpc_server, blockStore)
+		surfstore.RegisterMetaStoreServer(grpc_server, metaStore)
 	} else {
 		return errors.New("Unknown service type.")
 	}
 
-	return grpc_server.Serve(listen)
+	var metricsServer *http.Server
+	if metrics != nil {
+		metricsServer, err = serveMetrics(opts.metricsAddr, metrics, opts.logger)
+		if err != nil {
+			return err
+		}
+	}
+	healthCtx, stopHealth := context.WithCancel(ctx)
+	defer stopHealth()
+	go healthChecker.Run(healthCtx, surfstore.HEALTH_CHECK_INTERVAL)
+	if opts.configPath != "" {
+		go reloadOnHangup(healthCtx, metaStore, opts)
+	}
+
+	opts.logger.Info("Listening", "addr", listen.Addr().String())
+	served := make(chan error, 1)
+	go func() {
+		served <- grpc_server.Serve(listen)
+	}()
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	// Report not serving first so that balancers move away, then let the
+	// calls in flight finish
+	opts.logger.Info("Shutting down", "timeout", opts.shutdownTimeout)
+	healthChecker.Shutdown()
+	drained := make(chan struct{})
+	go func() {
+		grpc_server.GracefulStop()
+		close(drained)
+	}()
+	timer := time.NewTimer(opts.shutdownTimeout)
+	defer timer.Stop()
+	select {
+	case <-drained:
+		opts.logger.Info("Stopped")
+	case <-timer.C:
+		opts.logger.Warn("RPCs still in flight after the shutdown timeout, stopping them")
+		grpc_server.Stop()
+	}
+	if metricsServer != nil {
+		metricsServer.Close()
+	}
+	return nil
+}
+
+// newMetaStore returns a MetaStore with the options of the server. Block
+// sizes are only looked up on the block stores when a quota counts them.
+func newMetaStore(blockStoreAddrs []string, opts serverOptions, peerCreds credentials.TransportCredentials) *surfstore.MetaStore {
+	metaStore := surfstore.NewMetaStore(blockStoreAddrs)
+	metaStore.HistoryLimit = opts.historyLimit
+	metaStore.DefaultQuota = opts.defaultQuota
+	metaStore.Quotas = opts.quotas
+	metaStore.Logger = opts.logger
+	if opts.defaultQuota > 0 || len(opts.quotas) > 0 {
+		metaStore.BlockSizer = &surfstore.RemoteBlockSizer{TransportCredentials: peerCreds}
+	}
+	return metaStore
+}
+
+// reloadOnHangup re-reads the config on every SIGHUP and hands the new
+// block store ring to the MetaStore, if the server runs one. Other settings
+// only change on restart, and an invalid config keeps the current ring.
+func reloadOnHangup(ctx context.Context, metaStore *surfstore.MetaStore, opts serverOptions) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	defer signal.Stop(hangup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+		}
+		config, err := surfstore.LoadClusterConfig(opts.configPath)
+		if err != nil {
+			opts.logger.Error("Config reload failed, keeping the current settings", "error", err)
+			continue
+		}
+		if metaStore != nil {
+			metaStore.SetBlockStoreAddrs(config.BlockStores)
+			opts.logger.Info("Block store ring reloaded", "block_stores", strings.Join(config.BlockStores, ","))
+		}
+		current := *opts.config
+		current.BlockStores = config.BlockStores
+		if !reflect.DeepEqual(&current, config) {
+			opts.logger.Warn("Config changes other than blockStores take effect on restart")
+		}
+	}
+}
+
+// serveMetrics serves the metrics over HTTP in the background.
+func serveMetrics(addr string, metrics *surfstore.Metrics, logger *surfstore.Logger) (*http.Server, error) {
+	listen, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(METRICS_PATH, metrics.Handler())
+	server := &http.Server{Handler: mux}
+	logger.Info("Serving metrics", "addr", listen.Addr().String(), "path", METRICS_PATH)
+	go func() {
+		if err := server.Serve(listen); err != nil && err != http.ErrServerClosed {
+			logger.Error("Metrics listener stopped", "error", err)
+		}
+	}()
+	return server, nil
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"cse224/proj4/pkg/surfstore"
+	"net"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// freeAddr returns a local address nothing listens on.
+func freeAddr(t *testing.T) string {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listen.Close()
+	return listen.Addr().String()
+}
+
+func TestStartServerShutsDown(t *testing.T) {
+	addr := freeAddr(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- startServer(ctx, addr, "both", []string{addr}, serverOptions{shutdownTimeout: 5 * time.Second})
+	}()
+
+	conn, err := grpc.Dial(addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	health := healthpb.NewHealthClient(conn)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		resp, err := health.Check(ctx, &healthpb.HealthCheckRequest{})
+		if err == nil && resp.Status == healthpb.HealthCheckResponse_SERVING {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server not serving: %v, %v", resp, err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	data := []byte("block")
+	if _, err := surfstore.NewBlockStoreClient(conn).PutBlock(ctx,
+		&surfstore.Block{BlockData: data, BlockSize: int32(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+
+	cancel()
+	select {
+	case err := <-stopped:
+		if err != nil {
+			t.Fatalf("startServer = %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("server still running after the shutdown timeout")
+	}
+	call_ctx, call_cancel := context.WithTimeout(context.Background(), time.Second)
+	defer call_cancel()
+	if _, err := health.Check(call_ctx, &healthpb.HealthCheckRequest{}); err == nil {
+		t.Errorf("stopped server still answers")
+	}
+}
+
+func TestNewMetaStoreSizesBlocksOnlyWithQuotas(t *testing.T) {
+	cases := []struct {
+		quota string
+		sizer bool
+	}{
+		{"0", false},
+		{"10G", true},
+		{"team=1G", true},
+		{"0,team=1G", true},
+	}
+	for _, c := range cases {
+		var opts serverOptions
+		var err error
+		opts.defaultQuota, opts.quotas, err = parseQuotas(c.quota)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sizer := newMetaStore(nil, opts, nil).BlockSizer != nil; sizer != c.sizer {
+			t.Errorf("quota %v: block sizer installed = %v, want %v", c.quota, sizer, c.sizer)
+		}
+	}
+}
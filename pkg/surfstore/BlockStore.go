@@ -3,45 +3,123 @@ package surfstore
 import (
 	context "context"
 	"errors"
-	"log"
 	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
 type BlockStore struct {
 	BlockMap map[string]*Block
+	// Authorizer restricts GetBlock to blocks the caller can read; nil allows all
+	Authorizer BlockAuthorizer
+	// Logger records block operations by hash, never their data; nil discards
+	Logger *Logger
+	// Capacity bounds the bytes of block data stored; 0 for no limit
+	Capacity int64
 	UnimplementedBlockStoreServer
 	rw_lock sync.RWMutex
+	// sum of the stored BlockData lengths
+	stored_bytes int64
+	// namespaces that uploaded each block, and so proved they hold its data
+	uploaders map[string]map[string]bool
+	// size of the decoded data of each block, which quotas count
+	decoded_sizes map[string]int64
+}
+
+// BlockStoreStats describes what a BlockStore holds.
+type BlockStoreStats struct {
+	Blocks int
+	// Bytes of block data as stored, after client-side compression and encryption
+	Bytes int64
 }
 
 func (bs *BlockStore) GetBlock(ctx context.Context, blockHash *BlockHash) (*Block, error) {
-	// log.Printf("Get block called, block hash: %v", blockHash)
+	logger := bs.Logger.WithContext(ctx)
+	if bs.Authorizer != nil {
+		// Referencing a block is not enough: a hash learned elsewhere could
+		// be listed in a file of the caller's namespace
+		if !bs.uploadedBy(blockHash.GetHash(), NamespaceFromContext(ctx)) {
+			logger.Warn("Block access denied, not uploaded by the namespace", "hash", blockHash.GetHash())
+			return nil, status.Error(codes.PermissionDenied, "Block access denied")
+		}
+		ok, err := bs.Authorizer.CanReadBlock(ctx, blockHash.GetHash())
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			logger.Warn("Block access denied", "hash", blockHash.GetHash())
+			return nil, status.Error(codes.PermissionDenied, "Block access denied")
+		}
+	}
 	bs.rw_lock.RLock()
 	defer bs.rw_lock.RUnlock()
-	log.Printf("Get block %v", blockHash.GetHash())
 	blk, ok := bs.BlockMap[blockHash.GetHash()]
 	if ok {
-		// log.Printf("Block found: %v", string(blk.BlockData[:blk.BlockSize]))
-		return &Block{BlockSize: blk.BlockSize, BlockData: blk.BlockData}, nil
+		logger.Debug("Get block", "hash", blockHash.GetHash(), "size", blk.BlockSize, "codec", blk.Codec)
+		if !acceptsCodec(blockHash.GetAcceptCodecs(), blk.Codec) {
+			// caller cannot decode the stored form
+			data, err := DecodeBlock(blk)
+			if err != nil {
+				return nil, status.Error(codes.DataLoss, err.Error())
+			}
+			return &Block{BlockSize: int32(len(data)), BlockData: data}, nil
+		}
+		return &Block{BlockSize: blk.BlockSize, BlockData: blk.BlockData, Codec: blk.Codec}, nil
 	} else {
-		log.Println("Block not found")
+		logger.Debug("Block not found", "hash", blockHash.GetHash())
 		return &Block{}, errors.New("Block not found")
 	}
 }
 
 func (bs *BlockStore) PutBlock(ctx context.Context, block *Block) (*Success, error) {
+	// The hash is taken over the decoded bytes; the block is stored as sent
+	data, err := DecodeBlock(block)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	hash := GetBlockHashString(data)
+
 	bs.rw_lock.Lock()
 	defer bs.rw_lock.Unlock()
-	log.Printf("Put block called, block len: %v, hash: %v", block.BlockSize, GetBlockHashString(block.BlockData[:block.BlockSize]))
-	bs.BlockMap[GetBlockHashString(block.BlockData[:block.BlockSize])] = &Block{BlockData: block.BlockData, BlockSize: block.BlockSize}
+	logger := bs.Logger.WithContext(ctx)
+	logger.Debug("Put block", "hash", hash, "size", block.BlockSize, "codec", block.Codec)
+	var old_size int64
+	if old, ok := bs.BlockMap[hash]; ok {
+		old_size = int64(len(old.BlockData))
+	}
+	if bs.Capacity > 0 && bs.stored_bytes-old_size+int64(block.BlockSize) > bs.Capacity {
+		logger.Warn("Block store full", "hash", hash, "stored_bytes", bs.stored_bytes, "capacity", bs.Capacity)
+		return nil, status.Errorf(codes.ResourceExhausted, "Block store full: %v of %v used",
+			FormatBytes(float64(bs.stored_bytes)), FormatBytes(float64(bs.Capacity)))
+	}
+	bs.stored_bytes -= old_size
+	bs.BlockMap[hash] = &Block{BlockData: block.BlockData[:block.BlockSize], BlockSize: block.BlockSize, Codec: block.Codec}
+	bs.stored_bytes += int64(block.BlockSize)
+	bs.decoded_sizes[hash] = int64(len(data))
+	namespaces, ok := bs.uploaders[hash]
+	if !ok {
+		namespaces = make(map[string]bool)
+		bs.uploaders[hash] = namespaces
+	}
+	namespaces[NamespaceFromContext(ctx)] = true
 	return &Success{Flag: true}, nil
 }
 
+// uploadedBy reports whether the namespace uploaded a block.
+func (bs *BlockStore) uploadedBy(blockHash string, namespace string) bool {
+	bs.rw_lock.RLock()
+	defer bs.rw_lock.RUnlock()
+	return bs.uploaders[blockHash][namespace]
+}
+
 // Given a list of hashes “in”, returns a list containing the
 // subset of in that are stored in the key-value store
 func (bs *BlockStore) HasBlocks(ctx context.Context, blockHashesIn *BlockHashes) (*BlockHashes, error) {
 	bs.rw_lock.RLock()
 	defer bs.rw_lock.RUnlock()
-	log.Println("Has blocks called")
+	bs.Logger.WithContext(ctx).Debug("Has blocks", "count", len(blockHashesIn.GetHashes()))
 	var blockHashesString []string
 	hashes := blockHashesIn.GetHashes()
 	for i := 0; i < len(hashes); i++ {
@@ -53,11 +131,58 @@ func (bs *BlockStore) HasBlocks(ctx context.Context, blockHashesIn *BlockHashes)
 	return &BlockHashes{Hashes: hashes}, nil
 }
 
+// GetBlockSizes reports the decoded size of the requested blocks the
+// caller's namespace uploaded. MetaStores count these sizes against quotas
+// instead of the ones clients send; blocks left out are not stored, or
+// not yet uploaded by the namespace.
+func (bs *BlockStore) GetBlockSizes(ctx context.Context, blockHashesIn *BlockHashes) (*BlockSizes, error) {
+	bs.rw_lock.RLock()
+	defer bs.rw_lock.RUnlock()
+	bs.Logger.WithContext(ctx).Debug("Get block sizes", "count", len(blockHashesIn.GetHashes()))
+	namespace := NamespaceFromContext(ctx)
+	sizes := make(map[string]int64)
+	for _, hash := range blockHashesIn.GetHashes() {
+		if size, ok := bs.decoded_sizes[hash]; ok && bs.uploaders[hash][namespace] {
+			sizes[hash] = size
+		}
+	}
+	return &BlockSizes{Sizes: sizes}, nil
+}
+
+// GetBlockStoreUsage reports the blocks stored and the capacity to admins.
+func (bs *BlockStore) GetBlockStoreUsage(ctx context.Context, _ *emptypb.Empty) (*BlockStoreUsage, error) {
+	if err := requireAdmin(ctx); err != nil {
+		return nil, err
+	}
+	stats := bs.Stats()
+	return &BlockStoreUsage{Blocks: int64(stats.Blocks), StoredBytes: stats.Bytes, CapacityBytes: bs.Capacity}, nil
+}
+
+// Stats returns the number and size of the stored blocks.
+func (bs *BlockStore) Stats() BlockStoreStats {
+	bs.rw_lock.RLock()
+	defer bs.rw_lock.RUnlock()
+	return BlockStoreStats{Blocks: len(bs.BlockMap), Bytes: bs.stored_bytes}
+}
+
+// Full reports whether the BlockStore has less than BLOCK_STORE_MIN_FREE
+// bytes of capacity left, too little to take further blocks.
+func (bs *BlockStore) Full() bool {
+	if bs.Capacity <= 0 {
+		return false
+	}
+	bs.rw_lock.RLock()
+	defer bs.rw_lock.RUnlock()
+	return bs.Capacity-bs.stored_bytes < BLOCK_STORE_MIN_FREE
+}
+
 // This line guarantees all method for BlockStore are implemented
 var _ BlockStoreInterface = new(BlockStore)
 
 func NewBlockStore() *BlockStore {
 	return &BlockStore{
-		BlockMap: map[string]*Block{},
+		BlockMap:      map[string]*Block{},
+		uploaders:     map[string]map[string]bool{},
+		decoded_sizes: map[string]int64{},
 	}
 }
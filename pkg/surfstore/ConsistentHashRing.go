@@ -3,6 +3,7 @@ package surfstore
 import (
 	"crypto/sha256"
 	"encoding/hex"
+	"sort"
 	"strconv"
 )
 
@@ -90,6 +91,47 @@ func NewConsistentHashRing(numServers int, downServer []int) *ConsistentHashRing
 	return c
 }
 
+// NewBlockStoreRing returns a ring placing every block store at the hash of
+// its address.
+func NewBlockStoreRing(addrs []string) *ConsistentHashRing {
+	c := &ConsistentHashRing{
+		ServerMap: make(map[string]string),
+	}
+
+	for _, addr := range addrs {
+		c.InsertServer(addr)
+	}
+
+	return c
+}
+
+// Servers returns the addresses on the ring in ring order.
+func (c ConsistentHashRing) Servers() []string {
+	keys := make([]string, 0, len(c.ServerMap))
+	for k := range c.ServerMap {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	servers := make([]string, len(keys))
+	for i, k := range keys {
+		servers[i] = c.ServerMap[k]
+	}
+	return servers
+}
+
+// ServersFor returns every server on the ring, starting with the one
+// responsible for blockId and going around the ring from there. Blocks
+// written before the ring changed are found on one of the later servers.
+func (c ConsistentHashRing) ServersFor(blockId string) []string {
+	servers := c.Servers()
+	for i, server := range servers {
+		if compareHexString(c.Hash(server), blockId) {
+			return append(servers[i:], servers[:i]...)
+		}
+	}
+	return servers
+}
+
 func compareHexString(hex1 string, hex2 string) bool {
 	for i := 0; i < len(hex1); i++ {
 		if hex1[i] != hex2[i] {
@@ -2,65 +2,620 @@ package surfstore
 
 import (
 	context "context"
-	"log"
+	"crypto/rand"
+	"fmt"
+	"sort"
 	"sync"
 
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
 type MetaStore struct {
-	FileMetaMap    map[string]*FileMetaData
-	BlockStoreAddr string
+	// One file map per namespace, keyed by namespace
+	FileMetaMaps map[string]map[string]*FileMetaData
+	// Retained versions per namespace and file, oldest first
+	FileHistories map[string]map[string][]*FileMetaData
+	// Number of versions retained per file, 0 keeps every version
+	HistoryLimit int
+	// Logical bytes each namespace may reference, by namespace, with
+	// DefaultQuota for the others; 0 for no limit
+	Quotas       map[string]int64
+	DefaultQuota int64
+	// BlockSizer looks up the block sizes quotas count; nil trusts the
+	// sizes clients send
+	BlockSizer BlockSizer
+	// Logger records file updates; nil discards
+	Logger *Logger
 	UnimplementedMetaStoreServer
 	rw_lock sync.RWMutex
+	// ring of block stores clients are sent to
+	blockStoreAddrs []string
+	// block references of each namespace, and the number of namespaces
+	// referencing each block
+	blockIndexes     map[string]*blockIndex
+	block_namespaces map[string]int
+	// accepted and rejected UpdateFile calls
+	updates, rejected uint64
+	// encryption salt of each namespace
+	salts map[string][]byte
+}
+
+// MetaStoreStats describes the files of a MetaStore and the updates it took.
+type MetaStoreStats struct {
+	// Current files of every namespace, deleted files excluded
+	Files    int
+	Updates  uint64
+	Rejected uint64
 }
 
 func (m *MetaStore) GetFileInfoMap(ctx context.Context, _ *emptypb.Empty) (*FileInfoMap, error) {
 	m.rw_lock.RLock()
 	defer m.rw_lock.RUnlock()
-	log.Println("Get File Info Map Called")
-	// defer func() {
-	// 	for k := range m.FileMetaMap {
-	// 		m.FileMetaMap[k].Version += 1
-	// 		log.Printf("Increment the file %v version to %v", m.FileMetaMap[k].Filename, m.FileMetaMap[k].Version)
-	// 	}
-	// }()
-	// PrintMetaMap(m.FileMetaMap)
-	return &FileInfoMap{FileInfoMap: CloneFileMetaMap(m.FileMetaMap)}, nil
+	m.Logger.WithContext(ctx).Debug("Get file info map", "namespace", NamespaceFromContext(ctx))
+	return &FileInfoMap{FileInfoMap: CloneFileMetaMap(m.FileMetaMaps[NamespaceFromContext(ctx)])}, nil
 }
 
 func (m *MetaStore) UpdateFile(ctx context.Context, fileMetaData *FileMetaData) (*Version, error) {
+	namespace := NamespaceFromContext(ctx)
+	logger := m.Logger.WithContext(ctx).With("namespace", namespace, "file", fileMetaData.Filename,
+		"version", fileMetaData.Version)
+	if err := m.resolveBlockSizes(ctx, []*FileMetaData{fileMetaData}); err != nil {
+		logger.Warn("File update rejected", "error", err)
+		return nil, err
+	}
 	m.rw_lock.Lock()
 	defer m.rw_lock.Unlock()
-	log.Println("Update File called")
-	log.Printf("Updating file: %v", fileMetaData.Filename)
-	current_meta, ok := m.FileMetaMap[fileMetaData.Filename]
+	current_meta, ok := m.FileMetaMaps[namespace][fileMetaData.Filename]
 	if !ok || current_meta.Version+1 == fileMetaData.Version {
-		m.FileMetaMap[fileMetaData.Filename] = &FileMetaData{Filename: fileMetaData.Filename,
-			Version:       fileMetaData.Version,
-			BlockHashList: fileMetaData.BlockHashList}
+		update := m.prepareUpdate(namespace, fileMetaData)
+		if err := m.checkQuota(namespace, []*fileUpdate{update}); err != nil {
+			logger.Warn("File update over quota", "error", err)
+			return nil, err
+		}
+		m.applyUpdate(namespace, update)
+		logger.Info("File updated", "blocks", len(fileMetaData.BlockHashList))
 		return &Version{Version: fileMetaData.Version}, nil
 	} else {
 		// when current file is at least up-to-date
-		*fileMetaData = FileMetaData{Filename: current_meta.Filename,
-			Version:       current_meta.Version,
-			BlockHashList: current_meta.BlockHashList}
-		log.Printf("Updating rejected!")
+		m.rejected++
+		logger.Info("File update rejected", "current_version", current_meta.Version)
+		proto.Reset(fileMetaData)
+		proto.Merge(fileMetaData, current_meta)
 		return &Version{Version: -1}, nil
 	}
 }
 
+// CommitBatch applies the updates of a batch together, or none of them
+// when one conflicts with the current version of its file or the batch
+// would take the namespace over quota. Other callers see the file map
+// either before or after the whole batch.
+func (m *MetaStore) CommitBatch(ctx context.Context, fileBatch *FileBatch) (*BatchResult, error) {
+	namespace := NamespaceFromContext(ctx)
+	logger := m.Logger.WithContext(ctx).With("namespace", namespace, "files", len(fileBatch.Files))
+	if err := m.resolveBlockSizes(ctx, fileBatch.Files); err != nil {
+		logger.Warn("Batch rejected", "error", err)
+		return nil, err
+	}
+	m.rw_lock.Lock()
+	defer m.rw_lock.Unlock()
+	fileMetaMap := m.FileMetaMaps[namespace]
+
+	result := &BatchResult{}
+	seen := make(map[string]bool)
+	for _, fileMetaData := range fileBatch.Files {
+		if seen[fileMetaData.Filename] {
+			return nil, status.Errorf(codes.InvalidArgument, "%v is updated twice in the batch", fileMetaData.Filename)
+		}
+		seen[fileMetaData.Filename] = true
+		if current_meta, ok := fileMetaMap[fileMetaData.Filename]; ok && current_meta.Version+1 != fileMetaData.Version {
+			result.Conflicts = append(result.Conflicts, proto.Clone(current_meta).(*FileMetaData))
+		}
+	}
+	if len(result.Conflicts) > 0 {
+		m.rejected += uint64(len(result.Conflicts))
+		logger.Info("Batch rejected", "conflicts", len(result.Conflicts))
+		return result, nil
+	}
+
+	updates := make([]*fileUpdate, len(fileBatch.Files))
+	for i, fileMetaData := range fileBatch.Files {
+		updates[i] = m.prepareUpdate(namespace, fileMetaData)
+	}
+	if err := m.checkQuota(namespace, updates); err != nil {
+		logger.Warn("Batch over quota", "error", err)
+		return nil, err
+	}
+	for _, update := range updates {
+		m.applyUpdate(namespace, update)
+	}
+	result.Committed = true
+	logger.Info("Batch committed")
+	return result, nil
+}
+
+// UpdateFileIf publishes a file only when its current version or hash list
+// is the expected one, numbering the new version after the current one.
+// Either way the result carries the metadata the server holds afterwards,
+// so a rejected caller needs no further lookup.
+func (m *MetaStore) UpdateFileIf(ctx context.Context, update *ConditionalUpdate) (*UpdateResult, error) {
+	fileMetaData := update.GetFile()
+	if fileMetaData == nil || update.GetExpected() == nil {
+		return nil, status.Error(codes.InvalidArgument, "UpdateFileIf needs a file and an expected version or digest")
+	}
+	namespace := NamespaceFromContext(ctx)
+	logger := m.Logger.WithContext(ctx).With("namespace", namespace, "file", fileMetaData.Filename)
+	if err := m.resolveBlockSizes(ctx, []*FileMetaData{fileMetaData}); err != nil {
+		logger.Warn("File update rejected", "error", err)
+		return nil, err
+	}
+	m.rw_lock.Lock()
+	defer m.rw_lock.Unlock()
+	current_meta := m.FileMetaMaps[namespace][fileMetaData.Filename]
+	if reason := unmetCondition(current_meta, update); reason != UpdateReason_UPDATE_APPLIED {
+		m.rejected++
+		result := &UpdateResult{Reason: reason, Version: -1}
+		if current_meta != nil {
+			result.Current = proto.Clone(current_meta).(*FileMetaData)
+			logger = logger.With("current_version", current_meta.Version)
+		}
+		logger.Info("File update rejected", "reason", reason)
+		return result, nil
+	}
+
+	pending := m.prepareUpdate(namespace, fileMetaData)
+	pending.meta.Version = 1
+	if current_meta != nil {
+		pending.meta.Version = current_meta.Version + 1
+	}
+	if err := m.checkQuota(namespace, []*fileUpdate{pending}); err != nil {
+		logger.Warn("File update over quota", "error", err)
+		return nil, err
+	}
+	m.applyUpdate(namespace, pending)
+	logger.Info("File updated", "version", pending.meta.Version, "blocks", len(fileMetaData.BlockHashList))
+	return &UpdateResult{Reason: UpdateReason_UPDATE_APPLIED, Version: pending.meta.Version,
+		Current: proto.Clone(pending.meta).(*FileMetaData)}, nil
+}
+
+// unmetCondition returns why a file, nil when it does not exist, fails the
+// condition of an update, or UPDATE_APPLIED when it meets it.
+func unmetCondition(current *FileMetaData, update *ConditionalUpdate) UpdateReason {
+	var expect_missing, matches bool
+	mismatch := UpdateReason_UPDATE_VERSION_MISMATCH
+	switch expected := update.GetExpected().(type) {
+	case *ConditionalUpdate_ExpectedVersion:
+		expect_missing = expected.ExpectedVersion == 0
+		matches = current != nil && current.Version == expected.ExpectedVersion
+	case *ConditionalUpdate_ExpectedDigest:
+		expect_missing = expected.ExpectedDigest == ""
+		matches = current != nil && HashListDigest(current.BlockHashList) == expected.ExpectedDigest
+		mismatch = UpdateReason_UPDATE_DIGEST_MISMATCH
+	}
+	switch {
+	case expect_missing && current != nil:
+		return UpdateReason_UPDATE_ALREADY_EXISTS
+	case !expect_missing && current == nil:
+		return UpdateReason_UPDATE_NOT_FOUND
+	case !expect_missing && !matches:
+		return mismatch
+	}
+	return UpdateReason_UPDATE_APPLIED
+}
+
+// fileUpdate is a new version accepted by the version check, together with
+// the history it leaves.
+type fileUpdate struct {
+	meta    *FileMetaData
+	history []*FileMetaData
+	// versions falling out of the history
+	dropped []*FileMetaData
+}
+
+// prepareUpdate works out the history of a file once fileMetaData is
+// added, leaving the store as it is. The caller holds the write lock.
+func (m *MetaStore) prepareUpdate(namespace string, fileMetaData *FileMetaData) *fileUpdate {
+	new_meta := proto.Clone(fileMetaData).(*FileMetaData)
+	old_history := m.FileHistories[namespace][fileMetaData.Filename]
+	history := m.retainedHistory(old_history, new_meta)
+	return &fileUpdate{meta: new_meta, history: history, dropped: old_history[:len(old_history)+1-len(history)]}
+}
+
+// applyUpdate publishes a prepared version. The index changes together
+// with the file map and history, under the same lock.
+func (m *MetaStore) applyUpdate(namespace string, update *fileUpdate) {
+	fileMetaMap, ok := m.FileMetaMaps[namespace]
+	if !ok {
+		fileMetaMap = make(map[string]*FileMetaData)
+		m.FileMetaMaps[namespace] = fileMetaMap
+	}
+	fileMetaMap[update.meta.Filename] = update.meta
+	m.setHistory(namespace, update.meta.Filename, update.history)
+	m.indexBlocks(namespace, update.meta, update.dropped)
+	m.updates++
+}
+
+// GetBlockStoreAddr returns the first block store of the ring, for clients
+// that only know a single block store.
 func (m *MetaStore) GetBlockStoreAddr(ctx context.Context, _ *emptypb.Empty) (*BlockStoreAddr, error) {
-	log.Println("Get block store addr called")
-	return &BlockStoreAddr{Addr: m.BlockStoreAddr}, nil
+	addrs := m.BlockStoreAddrs()
+	if len(addrs) == 0 {
+		return &BlockStoreAddr{}, nil
+	}
+	return &BlockStoreAddr{Addr: addrs[0]}, nil
+}
+
+// GetBlockStoreAddrs returns every block store of the ring.
+func (m *MetaStore) GetBlockStoreAddrs(ctx context.Context, _ *emptypb.Empty) (*BlockStoreAddrs, error) {
+	return &BlockStoreAddrs{Addrs: m.BlockStoreAddrs()}, nil
+}
+
+// BlockStoreAddrs returns the block stores clients are sent to.
+func (m *MetaStore) BlockStoreAddrs() []string {
+	m.rw_lock.RLock()
+	defer m.rw_lock.RUnlock()
+	return append([]string(nil), m.blockStoreAddrs...)
+}
+
+// SetBlockStoreAddrs replaces the ring of block stores. Blocks stay where
+// they are: clients look for them on the other members of the ring when
+// the responsible one does not have them.
+func (m *MetaStore) SetBlockStoreAddrs(addrs []string) {
+	m.rw_lock.Lock()
+	defer m.rw_lock.Unlock()
+	m.blockStoreAddrs = append([]string(nil), addrs...)
+}
+
+// GetNamespaceSalt returns the encryption salt of the caller's namespace,
+// creating a random one on the first call that is not a lookup only.
+func (m *MetaStore) GetNamespaceSalt(ctx context.Context, saltRequest *NamespaceSaltRequest) (*NamespaceSalt, error) {
+	m.rw_lock.Lock()
+	defer m.rw_lock.Unlock()
+	namespace := NamespaceFromContext(ctx)
+	salt, ok := m.salts[namespace]
+	if !ok && saltRequest.LookupOnly {
+		return &NamespaceSalt{}, nil
+	} else if !ok {
+		salt = make([]byte, CRYPTO_SALT_SIZE)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, status.Errorf(codes.Internal, "Unable to create a salt: %v", err)
+		}
+		if m.salts == nil {
+			m.salts = make(map[string][]byte)
+		}
+		m.salts[namespace] = salt
+		m.Logger.WithContext(ctx).Info("Namespace salt created", "namespace", namespace)
+	}
+	return &NamespaceSalt{Salt: append([]byte(nil), salt...)}, nil
+}
+
+// Stats counts the current files and the updates taken so far.
+func (m *MetaStore) Stats() MetaStoreStats {
+	m.rw_lock.RLock()
+	defer m.rw_lock.RUnlock()
+	stats := MetaStoreStats{Updates: m.updates, Rejected: m.rejected}
+	for _, fileMetaMap := range m.FileMetaMaps {
+		for _, fileMeta := range fileMetaMap {
+			if !IsTombstone(fileMeta.BlockHashList) {
+				stats.Files++
+			}
+		}
+	}
+	return stats
+}
+
+// GetFileHistory returns the retained versions of a file, oldest first.
+func (m *MetaStore) GetFileHistory(ctx context.Context, fileName *FileName) (*FileHistory, error) {
+	m.rw_lock.RLock()
+	defer m.rw_lock.RUnlock()
+	m.Logger.WithContext(ctx).Debug("Get file history", "file", fileName.GetFilename())
+	history := m.FileHistories[NamespaceFromContext(ctx)][fileName.GetFilename()]
+	versions := make([]*FileMetaData, len(history))
+	for i, meta := range history {
+		versions[i] = proto.Clone(meta).(*FileMetaData)
+	}
+	return &FileHistory{Versions: versions}, nil
+}
+
+// setHistory replaces the retained versions of a file. The caller holds
+// the write lock.
+func (m *MetaStore) setHistory(namespace string, filename string, history []*FileMetaData) {
+	histories, ok := m.FileHistories[namespace]
+	if !ok {
+		histories = make(map[string][]*FileMetaData)
+		m.FileHistories[namespace] = histories
+	}
+	histories[filename] = history
+}
+
+// retainedHistory returns the versions kept once fileMetaData is added,
+// dropping the oldest ones beyond HistoryLimit.
+func (m *MetaStore) retainedHistory(history []*FileMetaData, fileMetaData *FileMetaData) []*FileMetaData {
+	history = append(history[:len(history):len(history)], fileMetaData)
+	if m.HistoryLimit > 0 && len(history) > m.HistoryLimit {
+		history = append([]*FileMetaData(nil), history[len(history)-m.HistoryLimit:]...)
+	}
+	return history
+}
+
+// QuotaFor returns the quota of a namespace, 0 for none.
+func (m *MetaStore) QuotaFor(namespace string) int64 {
+	if quota, ok := m.Quotas[namespace]; ok {
+		return quota
+	}
+	return m.DefaultQuota
+}
+
+// checkQuota rejects new versions that would take their namespace over
+// quota once the dropped versions are gone. Updates that do not grow the
+// namespace are always accepted, so that files can be deleted or shrunk
+// after the quota was lowered. The caller holds the write lock.
+func (m *MetaStore) checkQuota(namespace string, updates []*fileUpdate) error {
+	added := make([]*FileMetaData, len(updates))
+	var dropped []*FileMetaData
+	for i, update := range updates {
+		added[i] = update.meta
+		dropped = append(dropped, update.dropped...)
+	}
+	quota := m.QuotaFor(namespace)
+	if quota <= 0 || len(updates) == 0 {
+		return nil
+	}
+	for _, fileMetaData := range added {
+		if len(fileMetaData.BlockSizeList) == 0 && len(fileMetaData.BlockHashList) > 0 && !IsTombstone(fileMetaData.BlockHashList) {
+			return status.Errorf(codes.FailedPrecondition,
+				"Namespace %v has a quota, but the update of %v carries no block sizes; upgrade the client", namespace, fileMetaData.Filename)
+		}
+	}
+	idx := m.indexFor(namespace)
+	before := idx.logical_bytes
+	after := idx.logicalBytesAfter(added, dropped)
+	if after > quota && after > before {
+		what := added[0].Filename
+		if len(added) > 1 {
+			what = fmt.Sprintf("a batch of %d files", len(added))
+		}
+		return status.Errorf(codes.ResourceExhausted, "Quota of namespace %v exceeded: %v would use %v of %v",
+			namespace, what, FormatBytes(float64(after)), FormatBytes(float64(quota)))
+	}
+	return nil
+}
+
+// resolveBlockSizes replaces the block sizes of new versions with the ones
+// the block stores report, so that clients cannot shrink their usage by
+// sending smaller sizes, and rejects sizes that disagree. A block the block
+// stores do not hold for the namespace, or cannot be asked about, fails the
+// update when the namespace has a quota and otherwise leaves the sizes of
+// its file unknown. The caller does not hold the lock.
+func (m *MetaStore) resolveBlockSizes(ctx context.Context, files []*FileMetaData) error {
+	for _, fileMetaData := range files {
+		if len(fileMetaData.BlockSizeList) > 0 && len(fileMetaData.BlockSizeList) != len(fileMetaData.BlockHashList) {
+			return status.Errorf(codes.InvalidArgument, "%v has %d block sizes for %d blocks",
+				fileMetaData.Filename, len(fileMetaData.BlockSizeList), len(fileMetaData.BlockHashList))
+		}
+	}
+	if m.BlockSizer == nil {
+		return nil
+	}
+	namespace := NamespaceFromContext(ctx)
+
+	// sizes the index already learned from the block stores
+	sizes := make(map[string]int64)
+	var unknown []string
+	m.rw_lock.RLock()
+	quota := m.QuotaFor(namespace)
+	idx := m.blockIndexes[namespace]
+	for _, fileMetaData := range files {
+		for _, hash := range indexedHashes(fileMetaData) {
+			if _, ok := sizes[hash]; ok {
+				continue
+			}
+			sizes[hash] = -1
+			if idx != nil {
+				if ref, ok := idx.refs[hash]; ok && ref.size >= 0 {
+					sizes[hash] = ref.size
+					continue
+				}
+			}
+			unknown = append(unknown, hash)
+		}
+	}
+	m.rw_lock.RUnlock()
+
+	if len(unknown) > 0 {
+		found, err := m.BlockSizer.BlockSizes(ctx, m.BlockStoreAddrs(), unknown)
+		if err != nil {
+			if quota > 0 {
+				return status.Errorf(codes.Unavailable, "Cannot look up block sizes for the quota of namespace %v: %v", namespace, err)
+			}
+			m.Logger.WithContext(ctx).Warn("Cannot look up block sizes", "namespace", namespace, "error", err)
+		}
+		for hash, size := range found {
+			sizes[hash] = size
+		}
+	}
+
+	for _, fileMetaData := range files {
+		hashes := indexedHashes(fileMetaData)
+		if hashes == nil {
+			continue
+		}
+		block_sizes := make([]int32, len(hashes))
+		for i, hash := range hashes {
+			size := sizes[hash]
+			if size < 0 {
+				if quota > 0 {
+					return status.Errorf(codes.FailedPrecondition, "Block %d of %v has not been uploaded", i, fileMetaData.Filename)
+				}
+				block_sizes = nil
+				break
+			}
+			if i < len(fileMetaData.BlockSizeList) && int64(fileMetaData.BlockSizeList[i]) != size {
+				return status.Errorf(codes.InvalidArgument, "Block %d of %v is %d bytes, not %d",
+					i, fileMetaData.Filename, size, fileMetaData.BlockSizeList[i])
+			}
+			block_sizes[i] = int32(size)
+		}
+		fileMetaData.BlockSizeList = block_sizes
+	}
+	return nil
+}
+
+// indexFor returns the block index of a namespace, creating it when the
+// namespace has none yet. The caller holds the lock.
+func (m *MetaStore) indexFor(namespace string) *blockIndex {
+	idx, ok := m.blockIndexes[namespace]
+	if !ok {
+		idx = newBlockIndex()
+		if m.blockIndexes == nil {
+			m.blockIndexes = make(map[string]*blockIndex)
+			m.block_namespaces = make(map[string]int)
+		}
+		m.blockIndexes[namespace] = idx
+	}
+	return idx
+}
+
+// indexBlocks counts the references of a new version and drops those of
+// the versions no longer retained. The caller holds the write lock.
+func (m *MetaStore) indexBlocks(namespace string, added *FileMetaData, dropped []*FileMetaData) {
+	idx := m.indexFor(namespace)
+	for _, hash := range idx.add(added) {
+		m.block_namespaces[hash]++
+	}
+	for _, fileMeta := range dropped {
+		for _, hash := range idx.remove(fileMeta) {
+			if m.block_namespaces[hash]--; m.block_namespaces[hash] <= 0 {
+				delete(m.block_namespaces, hash)
+			}
+		}
+	}
+}
+
+// namespaceUsage describes the blocks referenced by the current and
+// retained versions of a namespace. The caller holds the lock.
+func (m *MetaStore) namespaceUsage(namespace string) *NamespaceUsage {
+	usage := &NamespaceUsage{Namespace: namespace, QuotaBytes: m.QuotaFor(namespace)}
+	idx, ok := m.blockIndexes[namespace]
+	if !ok {
+		return usage
+	}
+	usage.Blocks = int64(len(idx.refs))
+	usage.LogicalBytes = idx.logical_bytes
+	usage.ReferencedBytes = idx.referencedBytes()
+	for hash, ref := range idx.refs {
+		if ref.size > 0 && m.block_namespaces[hash] == 1 {
+			usage.UniqueBytes += ref.size
+		}
+	}
+	return usage
+}
+
+// GetNamespaceUsage reports the storage used by the caller's namespace, or
+// by every namespace when the caller is an admin.
+func (m *MetaStore) GetNamespaceUsage(ctx context.Context, _ *emptypb.Empty) (*NamespaceUsageList, error) {
+	m.rw_lock.RLock()
+	defer m.rw_lock.RUnlock()
+	namespaces := []string{NamespaceFromContext(ctx)}
+	if requireAdmin(ctx) == nil {
+		namespaces = namespaces[:0]
+		for namespace := range m.FileHistories {
+			namespaces = append(namespaces, namespace)
+		}
+		sort.Strings(namespaces)
+	}
+	list := &NamespaceUsageList{}
+	for _, namespace := range namespaces {
+		list.Namespaces = append(list.Namespaces, m.namespaceUsage(namespace))
+	}
+	return list, nil
+}
+
+// CheckBlockAccess reports whether the caller may read a block. BlockStores
+// that run apart from the MetaStore use it to authorize GetBlock.
+func (m *MetaStore) CheckBlockAccess(ctx context.Context, blockHash *BlockHash) (*Success, error) {
+	ok, err := m.CanReadBlock(ctx, blockHash.GetHash())
+	if err != nil {
+		return nil, err
+	}
+	return &Success{Flag: ok}, nil
+}
+
+// CanReadBlock reports whether a current or retained version of a file in
+// the caller's namespace references the block.
+func (m *MetaStore) CanReadBlock(ctx context.Context, blockHash string) (bool, error) {
+	m.rw_lock.RLock()
+	defer m.rw_lock.RUnlock()
+	if idx, ok := m.blockIndexes[NamespaceFromContext(ctx)]; ok {
+		_, ok := idx.refs[blockHash]
+		return ok, nil
+	}
+	return false, nil
+}
+
+// GetBlockReferences lists the files whose current or retained versions
+// reference a block, in the caller's namespace or, for admins, in every
+// namespace.
+func (m *MetaStore) GetBlockReferences(ctx context.Context, blockHash *BlockHash) (*BlockReferences, error) {
+	m.rw_lock.RLock()
+	defer m.rw_lock.RUnlock()
+	namespaces := []string{NamespaceFromContext(ctx)}
+	if requireAdmin(ctx) == nil {
+		namespaces = namespaces[:0]
+		for namespace := range m.blockIndexes {
+			namespaces = append(namespaces, namespace)
+		}
+		sort.Strings(namespaces)
+	}
+	block_hash := blockHash.GetHash()
+	refs := &BlockReferences{Size: -1}
+	for _, namespace := range namespaces {
+		idx, ok := m.blockIndexes[namespace]
+		if !ok {
+			continue
+		}
+		ref, ok := idx.refs[block_hash]
+		if !ok {
+			continue
+		}
+		if ref.size >= 0 {
+			refs.Size = ref.size
+		}
+		refs.RefCount += int64(ref.count)
+		filenames := make([]string, 0, len(ref.files))
+		for filename := range ref.files {
+			filenames = append(filenames, filename)
+		}
+		sort.Strings(filenames)
+		for _, filename := range filenames {
+			file_ref := &BlockReference{Namespace: namespace, Filename: filename}
+			for _, fileMeta := range m.FileHistories[namespace][filename] {
+				for _, hash := range indexedHashes(fileMeta) {
+					if hash == block_hash {
+						file_ref.Versions = append(file_ref.Versions, fileMeta.Version)
+						break
+					}
+				}
+			}
+			refs.Files = append(refs.Files, file_ref)
+		}
+	}
+	return refs, nil
 }
 
 // This line guarantees all method for MetaStore are implemented
 var _ MetaStoreInterface = new(MetaStore)
+var _ BlockAuthorizer = new(MetaStore)
 
-func NewMetaStore(blockStoreAddr string) *MetaStore {
+func NewMetaStore(blockStoreAddrs []string) *MetaStore {
 	return &MetaStore{
-		FileMetaMap:    map[string]*FileMetaData{},
-		BlockStoreAddr: blockStoreAddr,
+		FileMetaMaps:     map[string]map[string]*FileMetaData{},
+		FileHistories:    map[string]map[string][]*FileMetaData{},
+		HistoryLimit:     DEFAULT_HISTORY_LIMIT,
+		blockStoreAddrs:  append([]string(nil), blockStoreAddrs...),
+		blockIndexes:     map[string]*blockIndex{},
+		block_namespaces: map[string]int{},
 	}
 }
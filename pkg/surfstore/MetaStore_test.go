@@ -0,0 +1,251 @@
+package surfstore
+
+import (
+	"bytes"
+	context "context"
+	"errors"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// namespaceContext returns a context as left by the auth interceptor for
+// a user of the namespace.
+func namespaceContext(namespace string) context.Context {
+	return context.WithValue(context.Background(), userContextKey{}, &User{Name: namespace, Namespace: namespace})
+}
+
+func TestGetNamespaceSalt(t *testing.T) {
+	m := NewMetaStore([]string{"localhost:8081"})
+	lookup := func(namespace string, lookupOnly bool) []byte {
+		namespace_salt, err := m.GetNamespaceSalt(namespaceContext(namespace), &NamespaceSaltRequest{LookupOnly: lookupOnly})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return namespace_salt.Salt
+	}
+	salt := func(namespace string) []byte { return lookup(namespace, false) }
+	if len(lookup("alice", true)) != 0 {
+		t.Fatalf("lookup of a namespace without salt returned one")
+	}
+	alice := salt("alice")
+	if len(alice) != CRYPTO_SALT_SIZE {
+		t.Fatalf("salt of %d bytes, want %d", len(alice), CRYPTO_SALT_SIZE)
+	}
+	if !bytes.Equal(salt("alice"), alice) || !bytes.Equal(lookup("alice", true), alice) {
+		t.Errorf("salt of a namespace changed between calls")
+	}
+	if bytes.Equal(salt("bob"), alice) {
+		t.Errorf("namespaces share a salt")
+	}
+}
+
+// fixedBlockSizer reports the sizes of a fixed set of blocks, or fails.
+type fixedBlockSizer struct {
+	sizes map[string]int64
+	err   error
+}
+
+func (f *fixedBlockSizer) BlockSizes(ctx context.Context, blockStoreAddrs []string, blockHashes []string) (map[string]int64, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	sizes := make(map[string]int64)
+	for _, hash := range blockHashes {
+		if size, ok := f.sizes[hash]; ok {
+			sizes[hash] = size
+		}
+	}
+	return sizes, nil
+}
+
+func TestQuotaCountsBlockStoreSizes(t *testing.T) {
+	m := NewMetaStore([]string{"localhost:8081"})
+	m.Quotas = map[string]int64{"alice": 100}
+	m.BlockSizer = &fixedBlockSizer{sizes: map[string]int64{"h1": 60, "h2": 60}}
+	ctx := namespaceContext("alice")
+	update := func(meta *FileMetaData) error {
+		_, err := m.UpdateFile(ctx, meta)
+		return err
+	}
+
+	// a client claiming smaller blocks than it uploaded
+	err := update(&FileMetaData{Filename: "a", Version: 1, BlockHashList: []string{"h1"}, BlockSizeList: []int32{1}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("update with a wrong block size: %v", err)
+	}
+	// sizes are looked up when the client sends none
+	if err := update(&FileMetaData{Filename: "a", Version: 1, BlockHashList: []string{"h1"}}); err != nil {
+		t.Fatal(err)
+	}
+	if usage := m.namespaceUsage("alice"); usage.LogicalBytes != 60 {
+		t.Fatalf("LogicalBytes = %d, want 60", usage.LogicalBytes)
+	}
+	err = update(&FileMetaData{Filename: "b", Version: 1, BlockHashList: []string{"h2"}, BlockSizeList: []int32{60}})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("update over quota: %v", err)
+	}
+	// a deduplicated block counts once
+	if err := update(&FileMetaData{Filename: "b", Version: 1, BlockHashList: []string{"h1", "h1"}}); err != nil {
+		t.Fatal(err)
+	}
+	err = update(&FileMetaData{Filename: "c", Version: 1, BlockHashList: []string{"missing"}, BlockSizeList: []int32{1}})
+	if status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("update referencing a block never uploaded: %v", err)
+	}
+}
+
+func TestBlockSizesWithoutQuota(t *testing.T) {
+	m := NewMetaStore([]string{"localhost:8081"})
+	sizer := &fixedBlockSizer{sizes: map[string]int64{"h1": 60}}
+	m.BlockSizer = sizer
+	ctx := namespaceContext("alice")
+	// unknown sizes are left out rather than taken from the client
+	if _, err := m.UpdateFile(ctx, &FileMetaData{Filename: "a", Version: 1,
+		BlockHashList: []string{"h1", "missing"}, BlockSizeList: []int32{60, 1 << 30}}); err != nil {
+		t.Fatal(err)
+	}
+	if usage := m.namespaceUsage("alice"); usage.LogicalBytes != 0 {
+		t.Errorf("LogicalBytes = %d with unknown sizes, want 0", usage.LogicalBytes)
+	}
+
+	sizer.err = errors.New("block store down")
+	if _, err := m.UpdateFile(ctx, &FileMetaData{Filename: "b", Version: 1, BlockHashList: []string{"h1"}}); err != nil {
+		t.Errorf("update without quota failed on an unreachable block store: %v", err)
+	}
+	m.DefaultQuota = 1000
+	_, err := m.UpdateFile(ctx, &FileMetaData{Filename: "c", Version: 1, BlockHashList: []string{"h2"}})
+	if status.Code(err) != codes.Unavailable {
+		t.Errorf("update with quota on an unreachable block store: %v", err)
+	}
+}
+
+func TestCommitBatchIsAllOrNothing(t *testing.T) {
+	m := NewMetaStore([]string{"localhost:8081"})
+	m.DefaultQuota = 100
+	ctx := namespaceContext("alice")
+	if _, err := m.UpdateFile(ctx, &FileMetaData{Filename: "a", Version: 1,
+		BlockHashList: []string{"h1"}, BlockSizeList: []int32{10}}); err != nil {
+		t.Fatal(err)
+	}
+	files := func() map[string]*FileMetaData {
+		fileInfoMap, err := m.GetFileInfoMap(ctx, &emptypb.Empty{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fileInfoMap.FileInfoMap
+	}
+	unchanged := func(what string) {
+		if current := files(); len(current) != 1 || current["a"].Version != 1 {
+			t.Errorf("%v changed the file map: %v", what, current)
+		}
+		if usage := m.namespaceUsage("alice"); usage.LogicalBytes != 10 {
+			t.Errorf("%v changed the index: %v", what, usage)
+		}
+	}
+
+	// b could be applied, but a conflicts
+	result, err := m.CommitBatch(ctx, &FileBatch{Files: []*FileMetaData{
+		{Filename: "b", Version: 1, BlockHashList: []string{"h2"}, BlockSizeList: []int32{10}},
+		{Filename: "a", Version: 1, BlockHashList: []string{"h3"}, BlockSizeList: []int32{10}},
+	}})
+	if err != nil || result.Committed || len(result.Conflicts) != 1 || result.Conflicts[0].Filename != "a" {
+		t.Fatalf("conflicting batch = %v, %v", result, err)
+	}
+	unchanged("conflicting batch")
+
+	_, err = m.CommitBatch(ctx, &FileBatch{Files: []*FileMetaData{
+		{Filename: "b", Version: 1, BlockHashList: []string{"h2"}, BlockSizeList: []int32{10}},
+		{Filename: "c", Version: 1, BlockHashList: []string{"h3"}, BlockSizeList: []int32{90}},
+	}})
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("batch over quota = %v", err)
+	}
+	unchanged("batch over quota")
+
+	_, err = m.CommitBatch(ctx, &FileBatch{Files: []*FileMetaData{
+		{Filename: "b", Version: 1, BlockHashList: []string{"h2"}},
+		{Filename: "b", Version: 2, BlockHashList: []string{"h3"}},
+	}})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("batch updating a file twice = %v", err)
+	}
+	unchanged("batch updating a file twice")
+
+	result, err = m.CommitBatch(ctx, &FileBatch{Files: []*FileMetaData{
+		{Filename: "a", Version: 2, BlockHashList: []string{TOMBSTONE_HASH}},
+		{Filename: "b", Version: 1, BlockHashList: []string{"h2"}, BlockSizeList: []int32{10}},
+	}})
+	if err != nil || !result.Committed || len(result.Conflicts) != 0 {
+		t.Fatalf("batch = %v, %v", result, err)
+	}
+	if current := files(); current["a"].Version != 2 || current["b"].Version != 1 {
+		t.Errorf("file map after the batch = %v", current)
+	}
+	if stats := m.Stats(); stats.Updates != 3 || stats.Rejected != 1 {
+		t.Errorf("stats = %+v, want 3 updates and 1 rejected", stats)
+	}
+}
+
+func TestUnmetCondition(t *testing.T) {
+	current := &FileMetaData{Filename: "a", Version: 3, BlockHashList: []string{"h1", "h2"}}
+	digest := HashListDigest(current.BlockHashList)
+	version := func(v int32) *ConditionalUpdate {
+		return &ConditionalUpdate{Expected: &ConditionalUpdate_ExpectedVersion{ExpectedVersion: v}}
+	}
+	hashes := func(d string) *ConditionalUpdate {
+		return &ConditionalUpdate{Expected: &ConditionalUpdate_ExpectedDigest{ExpectedDigest: d}}
+	}
+	cases := []struct {
+		current *FileMetaData
+		update  *ConditionalUpdate
+		want    UpdateReason
+	}{
+		{current, version(3), UpdateReason_UPDATE_APPLIED},
+		{current, version(2), UpdateReason_UPDATE_VERSION_MISMATCH},
+		{current, version(0), UpdateReason_UPDATE_ALREADY_EXISTS},
+		{nil, version(0), UpdateReason_UPDATE_APPLIED},
+		{nil, version(1), UpdateReason_UPDATE_NOT_FOUND},
+		{current, hashes(digest), UpdateReason_UPDATE_APPLIED},
+		{current, hashes(HashListDigest([]string{"h1"})), UpdateReason_UPDATE_DIGEST_MISMATCH},
+		{current, hashes(""), UpdateReason_UPDATE_ALREADY_EXISTS},
+		{nil, hashes(""), UpdateReason_UPDATE_APPLIED},
+		{nil, hashes(digest), UpdateReason_UPDATE_NOT_FOUND},
+	}
+	for i, c := range cases {
+		if got := unmetCondition(c.current, c.update); got != c.want {
+			t.Errorf("case %d: unmetCondition = %v, want %v", i, got, c.want)
+		}
+	}
+}
+
+func TestUpdateFileIfNumbersVersions(t *testing.T) {
+	m := NewMetaStore([]string{"localhost:8081"})
+	ctx := namespaceContext("alice")
+	update := func(expected int32, hashes []string) *UpdateResult {
+		result, err := m.UpdateFileIf(ctx, &ConditionalUpdate{
+			File:     &FileMetaData{Filename: "a", Version: 42, BlockHashList: hashes},
+			Expected: &ConditionalUpdate_ExpectedVersion{ExpectedVersion: expected}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	// the version the client sends is ignored
+	if result := update(0, []string{"h1"}); result.Reason != UpdateReason_UPDATE_APPLIED || result.Version != 1 {
+		t.Fatalf("create = %v", result)
+	}
+	if result := update(1, []string{"h2"}); result.Version != 2 || result.Current.Version != 2 {
+		t.Fatalf("update = %v", result)
+	}
+	result := update(1, []string{"h3"})
+	if result.Reason != UpdateReason_UPDATE_VERSION_MISMATCH || result.Version != -1 ||
+		result.Current.Version != 2 || result.Current.BlockHashList[0] != "h2" {
+		t.Fatalf("stale update = %v", result)
+	}
+	if _, err := m.UpdateFileIf(ctx, &ConditionalUpdate{File: &FileMetaData{Filename: "a"}}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("update without a condition = %v", err)
+	}
+}
@@ -1,5 +1,7 @@
 package surfstore
 
+import "time"
+
 const DEFAULT_META_FILENAME string = "index.txt"
 
 const FILENAME_INDEX int = 0
@@ -8,3 +10,85 @@ const HASH_LIST_INDEX int = 2
 
 const CONFIG_DELIMITER string = ","
 const HASH_DELIMITER string = " "
+
+const DEFAULT_NAMESPACE string = "default"
+
+const AUTH_METADATA_KEY string = "authorization"
+const AUTH_SCHEME string = "Bearer "
+
+const AUTH_USER_INDEX int = 0
+const AUTH_TOKEN_INDEX int = 1
+const AUTH_NAMESPACE_INDEX int = 2
+
+// Methods of the standard health service, open to unauthenticated callers
+const HEALTH_METHOD_PREFIX string = "/grpc.health.v1.Health/"
+
+// Bytes of the random salt each namespace derives encryption keys with
+const CRYPTO_SALT_SIZE int = 16
+
+// Upper bound on a decompressed block, guards against decompression bombs
+const MAX_DECODED_BLOCK_SIZE = 64 << 20
+
+// Local index format, written as a JSON header line followed by one JSON
+// entry per file
+const INDEX_FORMAT_NAME string = "surfstore-index"
+const INDEX_FORMAT_VERSION int = 1
+
+const TEMP_FILE_SUFFIX string = ".tmp"
+
+// Prefix of the temporary files downloads and index writes are staged in
+const TEMP_FILE_PREFIX string = ".surfstore-tmp-"
+
+// Files modified this shortly before they were hashed are not trusted by
+// the stat fast path
+const RACY_MTIME_WINDOW = 2 * time.Second
+
+// Hash list of a deleted file
+const TOMBSTONE_HASH string = "0"
+
+// Versions of each file retained by the MetaStore
+const DEFAULT_HISTORY_LIMIT int = 10
+
+// Deadline of a single client RPC unless configured otherwise
+const DEFAULT_RPC_TIMEOUT = 30 * time.Second
+
+// Sync journal in the base directory, and how many downloaded blocks are
+// written between two journaled progress records
+const JOURNAL_FILENAME string = ".surfstore-journal"
+const JOURNAL_PROGRESS_INTERVAL int = 64
+
+// Ignore file read from every directory of a base directory
+const IGNORE_FILENAME string = ".surfignore"
+
+// Selective sync settings of a base directory
+const SELECTION_FILENAME string = ".surfstore-selection"
+
+// How often the progress line is redrawn, and the window its throughput
+// is measured over
+const PROGRESS_REDRAW_INTERVAL = 200 * time.Millisecond
+const PROGRESS_RATE_WINDOW = 5 * time.Second
+
+// Metadata carrying the request ID of a client operation to the servers,
+// and the bounds of request IDs
+const REQUEST_ID_METADATA_KEY string = "x-request-id"
+const REQUEST_ID_BYTES int = 8
+const MAX_REQUEST_ID_LENGTH int = 128
+
+// Prefix of every Prometheus metric a server exports
+const METRICS_NAMESPACE string = "surfstore"
+
+// How often a MetaStore checks the health of its block stores, and the
+// deadline of each check
+const HEALTH_CHECK_INTERVAL = 5 * time.Second
+const HEALTH_CHECK_TIMEOUT = 2 * time.Second
+
+// Free capacity below which a BlockStore takes no more blocks and reports
+// not serving, one block of the usual size
+const BLOCK_STORE_MIN_FREE int64 = 4096
+
+// Time a stopping server waits for RPCs in flight unless configured otherwise
+const DEFAULT_SHUTDOWN_TIMEOUT = 30 * time.Second
+
+// Roles a server can take in a cluster config
+const SERVER_ROLE_META string = "meta"
+const SERVER_ROLE_BLOCK string = "block"
@@ -26,6 +26,8 @@ type BlockStoreClient interface {
 	GetBlock(ctx context.Context, in *BlockHash, opts ...grpc.CallOption) (*Block, error)
 	PutBlock(ctx context.Context, in *Block, opts ...grpc.CallOption) (*Success, error)
 	HasBlocks(ctx context.Context, in *BlockHashes, opts ...grpc.CallOption) (*BlockHashes, error)
+	GetBlockStoreUsage(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreUsage, error)
+	GetBlockSizes(ctx context.Context, in *BlockHashes, opts ...grpc.CallOption) (*BlockSizes, error)
 }
 
 type blockStoreClient struct {
@@ -63,6 +65,24 @@ func (c *blockStoreClient) HasBlocks(ctx context.Context, in *BlockHashes, opts
 	return out, nil
 }
 
+func (c *blockStoreClient) GetBlockStoreUsage(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreUsage, error) {
+	out := new(BlockStoreUsage)
+	err := c.cc.Invoke(ctx, "/surfstore.BlockStore/GetBlockStoreUsage", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *blockStoreClient) GetBlockSizes(ctx context.Context, in *BlockHashes, opts ...grpc.CallOption) (*BlockSizes, error) {
+	out := new(BlockSizes)
+	err := c.cc.Invoke(ctx, "/surfstore.BlockStore/GetBlockSizes", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // BlockStoreServer is the server API for BlockStore service.
 // All implementations must embed UnimplementedBlockStoreServer
 // for forward compatibility
@@ -70,6 +90,8 @@ type BlockStoreServer interface {
 	GetBlock(context.Context, *BlockHash) (*Block, error)
 	PutBlock(context.Context, *Block) (*Success, error)
 	HasBlocks(context.Context, *BlockHashes) (*BlockHashes, error)
+	GetBlockStoreUsage(context.Context, *emptypb.Empty) (*BlockStoreUsage, error)
+	GetBlockSizes(context.Context, *BlockHashes) (*BlockSizes, error)
 	mustEmbedUnimplementedBlockStoreServer()
 }
 
@@ -86,6 +108,12 @@ func (UnimplementedBlockStoreServer) PutBlock(context.Context, *Block) (*Success
 func (UnimplementedBlockStoreServer) HasBlocks(context.Context, *BlockHashes) (*BlockHashes, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method HasBlocks not implemented")
 }
+func (UnimplementedBlockStoreServer) GetBlockStoreUsage(context.Context, *emptypb.Empty) (*BlockStoreUsage, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBlockStoreUsage not implemented")
+}
+func (UnimplementedBlockStoreServer) GetBlockSizes(context.Context, *BlockHashes) (*BlockSizes, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBlockSizes not implemented")
+}
 func (UnimplementedBlockStoreServer) mustEmbedUnimplementedBlockStoreServer() {}
 
 // UnsafeBlockStoreServer may be embedded to opt out of forward compatibility for this service.
@@ -153,6 +181,42 @@ func _BlockStore_HasBlocks_Handler(srv interface{}, ctx context.Context, dec fun
 	return interceptor(ctx, in, info, handler)
 }
 
+func _BlockStore_GetBlockStoreUsage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlockStoreServer).GetBlockStoreUsage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.BlockStore/GetBlockStoreUsage",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlockStoreServer).GetBlockStoreUsage(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _BlockStore_GetBlockSizes_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockHashes)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlockStoreServer).GetBlockSizes(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.BlockStore/GetBlockSizes",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlockStoreServer).GetBlockSizes(ctx, req.(*BlockHashes))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // BlockStore_ServiceDesc is the grpc.ServiceDesc for BlockStore service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -172,6 +236,14 @@ var BlockStore_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "HasBlocks",
 			Handler:    _BlockStore_HasBlocks_Handler,
 		},
+		{
+			MethodName: "GetBlockStoreUsage",
+			Handler:    _BlockStore_GetBlockStoreUsage_Handler,
+		},
+		{
+			MethodName: "GetBlockSizes",
+			Handler:    _BlockStore_GetBlockSizes_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "pkg/surfstore/SurfStore.proto",
@@ -184,6 +256,14 @@ type MetaStoreClient interface {
 	GetFileInfoMap(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*FileInfoMap, error)
 	UpdateFile(ctx context.Context, in *FileMetaData, opts ...grpc.CallOption) (*Version, error)
 	GetBlockStoreAddr(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddr, error)
+	GetBlockStoreAddrs(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddrs, error)
+	CheckBlockAccess(ctx context.Context, in *BlockHash, opts ...grpc.CallOption) (*Success, error)
+	GetFileHistory(ctx context.Context, in *FileName, opts ...grpc.CallOption) (*FileHistory, error)
+	GetNamespaceUsage(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*NamespaceUsageList, error)
+	GetBlockReferences(ctx context.Context, in *BlockHash, opts ...grpc.CallOption) (*BlockReferences, error)
+	CommitBatch(ctx context.Context, in *FileBatch, opts ...grpc.CallOption) (*BatchResult, error)
+	UpdateFileIf(ctx context.Context, in *ConditionalUpdate, opts ...grpc.CallOption) (*UpdateResult, error)
+	GetNamespaceSalt(ctx context.Context, in *NamespaceSaltRequest, opts ...grpc.CallOption) (*NamespaceSalt, error)
 }
 
 type metaStoreClient struct {
@@ -221,6 +301,78 @@ func (c *metaStoreClient) GetBlockStoreAddr(ctx context.Context, in *emptypb.Emp
 	return out, nil
 }
 
+func (c *metaStoreClient) GetBlockStoreAddrs(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddrs, error) {
+	out := new(BlockStoreAddrs)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetBlockStoreAddrs", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) CheckBlockAccess(ctx context.Context, in *BlockHash, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/CheckBlockAccess", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) GetFileHistory(ctx context.Context, in *FileName, opts ...grpc.CallOption) (*FileHistory, error) {
+	out := new(FileHistory)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetFileHistory", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) GetNamespaceUsage(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*NamespaceUsageList, error) {
+	out := new(NamespaceUsageList)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetNamespaceUsage", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) GetBlockReferences(ctx context.Context, in *BlockHash, opts ...grpc.CallOption) (*BlockReferences, error) {
+	out := new(BlockReferences)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetBlockReferences", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) CommitBatch(ctx context.Context, in *FileBatch, opts ...grpc.CallOption) (*BatchResult, error) {
+	out := new(BatchResult)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/CommitBatch", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) UpdateFileIf(ctx context.Context, in *ConditionalUpdate, opts ...grpc.CallOption) (*UpdateResult, error) {
+	out := new(UpdateResult)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/UpdateFileIf", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) GetNamespaceSalt(ctx context.Context, in *NamespaceSaltRequest, opts ...grpc.CallOption) (*NamespaceSalt, error) {
+	out := new(NamespaceSalt)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/GetNamespaceSalt", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // MetaStoreServer is the server API for MetaStore service.
 // All implementations must embed UnimplementedMetaStoreServer
 // for forward compatibility
@@ -228,6 +380,14 @@ type MetaStoreServer interface {
 	GetFileInfoMap(context.Context, *emptypb.Empty) (*FileInfoMap, error)
 	UpdateFile(context.Context, *FileMetaData) (*Version, error)
 	GetBlockStoreAddr(context.Context, *emptypb.Empty) (*BlockStoreAddr, error)
+	GetBlockStoreAddrs(context.Context, *emptypb.Empty) (*BlockStoreAddrs, error)
+	CheckBlockAccess(context.Context, *BlockHash) (*Success, error)
+	GetFileHistory(context.Context, *FileName) (*FileHistory, error)
+	GetNamespaceUsage(context.Context, *emptypb.Empty) (*NamespaceUsageList, error)
+	GetBlockReferences(context.Context, *BlockHash) (*BlockReferences, error)
+	CommitBatch(context.Context, *FileBatch) (*BatchResult, error)
+	UpdateFileIf(context.Context, *ConditionalUpdate) (*UpdateResult, error)
+	GetNamespaceSalt(context.Context, *NamespaceSaltRequest) (*NamespaceSalt, error)
 	mustEmbedUnimplementedMetaStoreServer()
 }
 
@@ -244,6 +404,30 @@ func (UnimplementedMetaStoreServer) UpdateFile(context.Context, *FileMetaData) (
 func (UnimplementedMetaStoreServer) GetBlockStoreAddr(context.Context, *emptypb.Empty) (*BlockStoreAddr, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetBlockStoreAddr not implemented")
 }
+func (UnimplementedMetaStoreServer) GetBlockStoreAddrs(context.Context, *emptypb.Empty) (*BlockStoreAddrs, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBlockStoreAddrs not implemented")
+}
+func (UnimplementedMetaStoreServer) CheckBlockAccess(context.Context, *BlockHash) (*Success, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CheckBlockAccess not implemented")
+}
+func (UnimplementedMetaStoreServer) GetFileHistory(context.Context, *FileName) (*FileHistory, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetFileHistory not implemented")
+}
+func (UnimplementedMetaStoreServer) GetNamespaceUsage(context.Context, *emptypb.Empty) (*NamespaceUsageList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetNamespaceUsage not implemented")
+}
+func (UnimplementedMetaStoreServer) GetBlockReferences(context.Context, *BlockHash) (*BlockReferences, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBlockReferences not implemented")
+}
+func (UnimplementedMetaStoreServer) CommitBatch(context.Context, *FileBatch) (*BatchResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CommitBatch not implemented")
+}
+func (UnimplementedMetaStoreServer) UpdateFileIf(context.Context, *ConditionalUpdate) (*UpdateResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateFileIf not implemented")
+}
+func (UnimplementedMetaStoreServer) GetNamespaceSalt(context.Context, *NamespaceSaltRequest) (*NamespaceSalt, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetNamespaceSalt not implemented")
+}
 func (UnimplementedMetaStoreServer) mustEmbedUnimplementedMetaStoreServer() {}
 
 // UnsafeMetaStoreServer may be embedded to opt out of forward compatibility for this service.
@@ -311,6 +495,150 @@ func _MetaStore_GetBlockStoreAddr_Handler(srv interface{}, ctx context.Context,
 	return interceptor(ctx, in, info, handler)
 }
 
+func _MetaStore_GetBlockStoreAddrs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetBlockStoreAddrs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetBlockStoreAddrs",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetBlockStoreAddrs(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_CheckBlockAccess_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockHash)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).CheckBlockAccess(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/CheckBlockAccess",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).CheckBlockAccess(ctx, req.(*BlockHash))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_GetFileHistory_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileName)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetFileHistory(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetFileHistory",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetFileHistory(ctx, req.(*FileName))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_GetNamespaceUsage_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetNamespaceUsage(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetNamespaceUsage",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetNamespaceUsage(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_GetBlockReferences_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockHash)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetBlockReferences(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetBlockReferences",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetBlockReferences(ctx, req.(*BlockHash))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_CommitBatch_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileBatch)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).CommitBatch(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/CommitBatch",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).CommitBatch(ctx, req.(*FileBatch))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_UpdateFileIf_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ConditionalUpdate)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).UpdateFileIf(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/UpdateFileIf",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).UpdateFileIf(ctx, req.(*ConditionalUpdate))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_GetNamespaceSalt_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(NamespaceSaltRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).GetNamespaceSalt(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/GetNamespaceSalt",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).GetNamespaceSalt(ctx, req.(*NamespaceSaltRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // MetaStore_ServiceDesc is the grpc.ServiceDesc for MetaStore service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -330,6 +658,38 @@ var MetaStore_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetBlockStoreAddr",
 			Handler:    _MetaStore_GetBlockStoreAddr_Handler,
 		},
+		{
+			MethodName: "GetBlockStoreAddrs",
+			Handler:    _MetaStore_GetBlockStoreAddrs_Handler,
+		},
+		{
+			MethodName: "CheckBlockAccess",
+			Handler:    _MetaStore_CheckBlockAccess_Handler,
+		},
+		{
+			MethodName: "GetFileHistory",
+			Handler:    _MetaStore_GetFileHistory_Handler,
+		},
+		{
+			MethodName: "GetNamespaceUsage",
+			Handler:    _MetaStore_GetNamespaceUsage_Handler,
+		},
+		{
+			MethodName: "GetBlockReferences",
+			Handler:    _MetaStore_GetBlockReferences_Handler,
+		},
+		{
+			MethodName: "CommitBatch",
+			Handler:    _MetaStore_CommitBatch_Handler,
+		},
+		{
+			MethodName: "UpdateFileIf",
+			Handler:    _MetaStore_UpdateFileIf_Handler,
+		},
+		{
+			MethodName: "GetNamespaceSalt",
+			Handler:    _MetaStore_GetNamespaceSalt_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "pkg/surfstore/SurfStore.proto",
@@ -0,0 +1,204 @@
+package surfstore
+
+import (
+	"bufio"
+	context "context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// User is an authenticated caller. Users sharing a namespace see the same files.
+type User struct {
+	Name      string
+	Namespace string
+	// Admin users may call the admin RPCs, which report on every namespace
+	Admin bool
+}
+
+type userContextKey struct{}
+
+// UserFromContext returns the user attached to ctx by the auth interceptor.
+func UserFromContext(ctx context.Context) (*User, bool) {
+	user, ok := ctx.Value(userContextKey{}).(*User)
+	return user, ok
+}
+
+// NamespaceFromContext returns the caller's namespace, or the default
+// namespace when the server runs without authentication.
+func NamespaceFromContext(ctx context.Context) string {
+	if user, ok := UserFromContext(ctx); ok {
+		return user.Namespace
+	}
+	return DEFAULT_NAMESPACE
+}
+
+// Authenticator maps bearer tokens to users.
+type Authenticator struct {
+	users map[string]*User
+}
+
+// LoadAuthFile reads a user/token file. Each non-empty line that does not
+// start with '#' has the form "user,token[,namespace]"; the namespace
+// defaults to the user name, so a team shares files by sharing a namespace.
+func LoadAuthFile(path string) (*Authenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	auth := &Authenticator{users: make(map[string]*User)}
+	scanner := bufio.NewScanner(f)
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		items := strings.Split(line, CONFIG_DELIMITER)
+		if len(items) < 2 || len(items) > 3 {
+			return nil, fmt.Errorf("%v:%d: expected user,token[,namespace]", path, lineNum)
+		}
+		user := &User{Name: strings.TrimSpace(items[AUTH_USER_INDEX])}
+		token := strings.TrimSpace(items[AUTH_TOKEN_INDEX])
+		user.Namespace = user.Name
+		if len(items) == 3 {
+			user.Namespace = strings.TrimSpace(items[AUTH_NAMESPACE_INDEX])
+		}
+		if user.Name == "" || token == "" || user.Namespace == "" {
+			return nil, fmt.Errorf("%v:%d: empty field", path, lineNum)
+		}
+		if _, ok := auth.users[token]; ok {
+			return nil, fmt.Errorf("%v:%d: duplicate token", path, lineNum)
+		}
+		auth.users[token] = user
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return auth, nil
+}
+
+// SetAdmins makes the named users admins.
+func (a *Authenticator) SetAdmins(names []string) error {
+	for _, name := range names {
+		found := false
+		for _, user := range a.users {
+			if user.Name == name {
+				user.Admin = true
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("Unknown admin user %v", name)
+		}
+	}
+	return nil
+}
+
+// requireAdmin fails unless the caller is an admin. Without authentication
+// every caller is.
+func requireAdmin(ctx context.Context) error {
+	if user, ok := UserFromContext(ctx); ok && !user.Admin {
+		return status.Error(codes.PermissionDenied, "Admin RPC needs an admin user")
+	}
+	return nil
+}
+
+// Authenticate resolves the bearer token carried in the incoming metadata.
+func (a *Authenticator) Authenticate(ctx context.Context) (*User, error) {
+	token, ok := tokenFromIncoming(ctx)
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "Missing auth token")
+	}
+	user, ok := a.users[token]
+	if !ok {
+		return nil, status.Error(codes.Unauthenticated, "Invalid auth token")
+	}
+	return user, nil
+}
+
+// UnaryInterceptor rejects unauthenticated calls and attaches the user to
+// the request context. Rejections are logged by LoggingInterceptor. Health
+// checks need no token, so probes and peers can run them.
+func (a *Authenticator) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if strings.HasPrefix(info.FullMethod, HEALTH_METHOD_PREFIX) {
+		return handler(ctx, req)
+	}
+	user, err := a.Authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(context.WithValue(ctx, userContextKey{}, user), req)
+}
+
+func tokenFromIncoming(ctx context.Context) (string, bool) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return "", false
+	}
+	values := md.Get(AUTH_METADATA_KEY)
+	if len(values) == 0 || !strings.HasPrefix(values[0], AUTH_SCHEME) {
+		return "", false
+	}
+	return strings.TrimPrefix(values[0], AUTH_SCHEME), true
+}
+
+// tokenCredentials attaches a bearer token to every RPC made on a connection.
+type tokenCredentials string
+
+func (t tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{AUTH_METADATA_KEY: AUTH_SCHEME + string(t)}, nil
+}
+
+// RequireTransportSecurity keeps tokens off plaintext connections.
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return true
+}
+
+// BlockAuthorizer decides whether the caller in ctx may read a block.
+type BlockAuthorizer interface {
+	CanReadBlock(ctx context.Context, blockHash string) (bool, error)
+}
+
+// RemoteBlockAuthorizer asks a MetaStore whether the caller may read a
+// block, forwarding the caller's token so the MetaStore resolves the
+// namespace itself.
+type RemoteBlockAuthorizer struct {
+	MetaStoreAddr string
+	// TransportCredentials secures the connection to the MetaStore; nil dials in plaintext
+	TransportCredentials credentials.TransportCredentials
+	dialOnce             sync.Once
+	conn                 *grpc.ClientConn
+	dialErr              error
+}
+
+func (r *RemoteBlockAuthorizer) CanReadBlock(ctx context.Context, blockHash string) (bool, error) {
+	token, ok := tokenFromIncoming(ctx)
+	if !ok {
+		return false, nil
+	}
+	r.dialOnce.Do(func() {
+		r.conn, r.dialErr = grpc.Dial(r.MetaStoreAddr, transportDialOption(r.TransportCredentials))
+	})
+	if r.dialErr != nil {
+		return false, r.dialErr
+	}
+	c := NewMetaStoreClient(r.conn)
+
+	ctx = metadata.AppendToOutgoingContext(outgoingRequestID(ctx), AUTH_METADATA_KEY, AUTH_SCHEME+token)
+	succ, err := c.CheckBlockAccess(ctx, &BlockHash{Hash: blockHash})
+	if err != nil {
+		return false, err
+	}
+	return succ.GetFlag(), nil
+}
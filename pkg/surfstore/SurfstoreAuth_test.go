@@ -0,0 +1,153 @@
+package surfstore
+
+import (
+	context "context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestLoadAuthFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users.txt")
+	writeTestFile(t, path, "# users\n\nalice, ta\nbob,tb\ncarol,tc,alice\n")
+	auth, err := LoadAuthFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]User{"ta": {"alice", "alice", false}, "tb": {"bob", "bob", false}, "tc": {"carol", "alice", false}}
+	if len(auth.users) != len(want) {
+		t.Fatalf("users = %v", auth.users)
+	}
+	for token, user := range want {
+		if got := auth.users[token]; got == nil || *got != user {
+			t.Errorf("user of %v = %+v, want %+v", token, got, user)
+		}
+	}
+	if err := auth.SetAdmins([]string{"bob"}); err != nil || !auth.users["tb"].Admin {
+		t.Errorf("SetAdmins = %v", err)
+	}
+	if err := auth.SetAdmins([]string{"dave"}); err == nil {
+		t.Errorf("unknown admin accepted")
+	}
+}
+
+func TestLoadAuthFileErrors(t *testing.T) {
+	cases := map[string]string{
+		"alice\n":             "expected user,token",
+		"alice,ta,ns,extra\n": "expected user,token",
+		"alice,\n":            "empty field",
+		",ta\n":               "empty field",
+		"alice,ta,\n":         "empty field",
+		"alice,ta\nbob,ta\n":  ":2: duplicate token",
+	}
+	for content, want := range cases {
+		path := filepath.Join(t.TempDir(), "users.txt")
+		writeTestFile(t, path, content)
+		if _, err := LoadAuthFile(path); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("LoadAuthFile(%q) = %v, want %q", content, err, want)
+		}
+	}
+	if _, err := LoadAuthFile(filepath.Join(t.TempDir(), "missing.txt")); err == nil {
+		t.Errorf("missing auth file accepted")
+	}
+}
+
+func TestUnaryInterceptor(t *testing.T) {
+	auth := &Authenticator{users: map[string]*User{"ta": {Name: "alice", Namespace: "team"}}}
+	var seen *User
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		seen, _ = UserFromContext(ctx)
+		return nil, nil
+	}
+	call := func(method string, md metadata.MD) error {
+		seen = nil
+		ctx := context.Background()
+		if md != nil {
+			ctx = metadata.NewIncomingContext(ctx, md)
+		}
+		_, err := auth.UnaryInterceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: method}, handler)
+		return err
+	}
+	const method = "/surfstore.MetaStore/GetFileInfoMap"
+
+	rejected := map[string]metadata.MD{
+		"no metadata":  nil,
+		"no token":     metadata.Pairs("other", "x"),
+		"wrong scheme": metadata.Pairs(AUTH_METADATA_KEY, "Basic ta"),
+		"bad token":    metadata.Pairs(AUTH_METADATA_KEY, AUTH_SCHEME+"tb"),
+		"empty token":  metadata.Pairs(AUTH_METADATA_KEY, AUTH_SCHEME),
+	}
+	for what, md := range rejected {
+		if err := call(method, md); status.Code(err) != codes.Unauthenticated || seen != nil {
+			t.Errorf("call with %v = %v", what, err)
+		}
+	}
+	if err := call(method, metadata.Pairs(AUTH_METADATA_KEY, AUTH_SCHEME+"ta")); err != nil || seen == nil || seen.Namespace != "team" {
+		t.Errorf("call with a valid token = %v, user %+v", err, seen)
+	}
+	// health checks need no token
+	if err := call(HEALTH_METHOD_PREFIX+"Check", nil); err != nil {
+		t.Errorf("health check without token = %v", err)
+	}
+}
+
+func TestNamespacesAreIsolated(t *testing.T) {
+	m := NewMetaStore([]string{"localhost:8081"})
+	bs := NewBlockStore()
+	bs.Authorizer = m
+	alice, bob := namespaceContext("alice"), namespaceContext("bob")
+
+	data := []byte("alice's secret")
+	hash := GetBlockHashString(data)
+	if _, err := bs.PutBlock(alice, &Block{BlockData: data, BlockSize: int32(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.UpdateFile(alice, &FileMetaData{Filename: "secret", Version: 1, BlockHashList: []string{hash}}); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := m.GetFileInfoMap(bob, nil)
+	if err != nil || len(files.FileInfoMap) != 0 {
+		t.Errorf("bob lists %v, %v", files.GetFileInfoMap(), err)
+	}
+	// bob's file of the same name is his own version 1
+	if v, err := m.UpdateFile(bob, &FileMetaData{Filename: "secret", Version: 1, BlockHashList: []string{hash}}); err != nil || v.Version != 1 {
+		t.Fatalf("bob's update = %v, %v", v, err)
+	}
+	if files, _ := m.GetFileInfoMap(alice, nil); files.FileInfoMap["secret"].Version != 1 {
+		t.Errorf("bob's update changed alice's file: %v", files.FileInfoMap["secret"])
+	}
+	// listing the hash in his own file does not let bob read the block
+	if _, err := bs.GetBlock(bob, &BlockHash{Hash: hash}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("bob's GetBlock = %v", err)
+	}
+	if block, err := bs.GetBlock(alice, &BlockHash{Hash: hash}); err != nil || string(block.BlockData) != string(data) {
+		t.Errorf("alice's GetBlock = %v", err)
+	}
+	// a block alice uploaded but no file of hers references
+	other := []byte("unreferenced")
+	if _, err := bs.PutBlock(alice, &Block{BlockData: other, BlockSize: int32(len(other))}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bs.GetBlock(alice, &BlockHash{Hash: GetBlockHashString(other)}); status.Code(err) != codes.PermissionDenied {
+		t.Errorf("GetBlock of an unreferenced block = %v", err)
+	}
+}
+
+func TestTokensRequireTLS(t *testing.T) {
+	if !tokenCredentials("ta").RequireTransportSecurity() {
+		t.Fatal("tokens allowed over plaintext")
+	}
+	client := NewSurfstoreRPCClient(serveBlockStore(t, NewBlockStore()), t.TempDir(), 4096)
+	client.Token = "ta"
+	defer client.Close()
+	var addr string
+	if err := client.GetBlockStoreAddr(context.Background(), &addr); err == nil {
+		t.Errorf("token sent over a plaintext connection")
+	}
+}
@@ -0,0 +1,135 @@
+package surfstore
+
+// blockIndex counts the references to every block from the current and
+// retained versions of the files of one namespace, so that usage and
+// access checks need no scan of the histories.
+type blockIndex struct {
+	refs map[string]*blockRef
+	// sum of the sizes of the distinct blocks, the bytes the quota limits
+	logical_bytes int64
+}
+
+// blockRef records which files reference a block, and how many times
+// across their retained versions.
+type blockRef struct {
+	// size of the block, -1 until a version carrying block sizes references it
+	size  int64
+	count int
+	files map[string]int
+}
+
+func newBlockIndex() *blockIndex {
+	return &blockIndex{refs: make(map[string]*blockRef)}
+}
+
+// blockSizeAt returns the size of the i-th block of a version, or -1 when
+// the client did not send block sizes.
+func blockSizeAt(fileMeta *FileMetaData, i int) int64 {
+	if i >= len(fileMeta.BlockSizeList) {
+		return -1
+	}
+	return int64(fileMeta.BlockSizeList[i])
+}
+
+// indexedHashes returns the block hashes a version references; tombstones
+// reference none.
+func indexedHashes(fileMeta *FileMetaData) []string {
+	if IsTombstone(fileMeta.BlockHashList) {
+		return nil
+	}
+	return fileMeta.BlockHashList
+}
+
+// add counts the references of a new version and returns the blocks the
+// namespace did not reference before.
+func (idx *blockIndex) add(fileMeta *FileMetaData) []string {
+	var added []string
+	for i, hash := range indexedHashes(fileMeta) {
+		ref, ok := idx.refs[hash]
+		if !ok {
+			ref = &blockRef{size: -1, files: make(map[string]int)}
+			idx.refs[hash] = ref
+			added = append(added, hash)
+		}
+		if size := blockSizeAt(fileMeta, i); ref.size < 0 && size >= 0 {
+			ref.size = size
+			idx.logical_bytes += size
+		}
+		ref.count++
+		ref.files[fileMeta.Filename]++
+	}
+	return added
+}
+
+// remove drops the references of a version that is no longer retained and
+// returns the blocks the namespace no longer references.
+func (idx *blockIndex) remove(fileMeta *FileMetaData) []string {
+	var removed []string
+	for _, hash := range indexedHashes(fileMeta) {
+		ref, ok := idx.refs[hash]
+		if !ok {
+			continue
+		}
+		ref.count--
+		if ref.files[fileMeta.Filename]--; ref.files[fileMeta.Filename] <= 0 {
+			delete(ref.files, fileMeta.Filename)
+		}
+		if ref.count <= 0 {
+			if ref.size > 0 {
+				idx.logical_bytes -= ref.size
+			}
+			delete(idx.refs, hash)
+			removed = append(removed, hash)
+		}
+	}
+	return removed
+}
+
+// logicalBytesAfter returns the logical bytes once the added versions are
+// counted and the dropped ones removed, leaving the index as it is.
+func (idx *blockIndex) logicalBytesAfter(added []*FileMetaData, dropped []*FileMetaData) int64 {
+	counts := make(map[string]int)
+	sizes := make(map[string]int64)
+	for _, fileMeta := range added {
+		for i, hash := range indexedHashes(fileMeta) {
+			counts[hash]++
+			if size := blockSizeAt(fileMeta, i); size >= 0 {
+				sizes[hash] = size
+			}
+		}
+	}
+	for _, fileMeta := range dropped {
+		for _, hash := range indexedHashes(fileMeta) {
+			counts[hash]--
+		}
+	}
+	logical_bytes := idx.logical_bytes
+	for hash, delta := range counts {
+		before, after := 0, delta
+		size := int64(-1)
+		if ref, ok := idx.refs[hash]; ok {
+			before, after, size = ref.count, ref.count+delta, ref.size
+		}
+		new_size, known := sizes[hash]
+		switch {
+		case after > 0 && size < 0 && known:
+			// a new block, or the size of a known one is learned
+			logical_bytes += new_size
+		case before > 0 && after <= 0 && size > 0:
+			logical_bytes -= size
+		}
+	}
+	return logical_bytes
+}
+
+// referencedBytes returns the bytes referenced by every retained version,
+// counting each reference to a block, that is the bytes without dedup.
+func (idx *blockIndex) referencedBytes() int64 {
+	var total int64
+	for _, ref := range idx.refs {
+		if ref.size > 0 {
+			total += ref.size * int64(ref.count)
+		}
+	}
+	return total
+}
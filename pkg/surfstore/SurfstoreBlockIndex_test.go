@@ -0,0 +1,116 @@
+package surfstore
+
+import (
+	context "context"
+	"reflect"
+	"testing"
+)
+
+func TestBlockReferencesFollowHistory(t *testing.T) {
+	m := NewMetaStore([]string{"localhost:8081"})
+	m.HistoryLimit = 2
+	ctx := namespaceContext("alice")
+	update := func(filename string, version int32, hashes []string, sizes []int32) {
+		meta := &FileMetaData{Filename: filename, Version: version, BlockHashList: hashes, BlockSizeList: sizes}
+		if v, err := m.UpdateFile(ctx, meta); err != nil || v.Version != version {
+			t.Fatalf("UpdateFile(%v, %d) = %v, %v", filename, version, v, err)
+		}
+	}
+	references := func(hash string) *BlockReferences {
+		refs, err := m.GetBlockReferences(ctx, &BlockHash{Hash: hash})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return refs
+	}
+	tombstone := []string{TOMBSTONE_HASH}
+
+	update("a", 1, []string{"h1", "h1"}, []int32{10, 10})
+	update("a", 2, []string{"h2"}, []int32{20})
+	update("b", 1, []string{"h1"}, []int32{10})
+	refs := references("h1")
+	want := []*BlockReference{{Namespace: "alice", Filename: "a", Versions: []int32{1}},
+		{Namespace: "alice", Filename: "b", Versions: []int32{1}}}
+	if refs.Size != 10 || refs.RefCount != 3 || !reflect.DeepEqual(refs.Files, want) {
+		t.Fatalf("references of h1 = %v", refs)
+	}
+	if usage := m.namespaceUsage("alice"); usage.Blocks != 2 || usage.LogicalBytes != 30 || usage.ReferencedBytes != 50 {
+		t.Fatalf("usage = %v", usage)
+	}
+
+	// version 1 of a falls out of the history
+	update("a", 3, []string{"h3"}, []int32{30})
+	if refs := references("h1"); refs.RefCount != 1 || len(refs.Files) != 1 || refs.Files[0].Filename != "b" {
+		t.Errorf("references of h1 after a dropped it = %v", refs)
+	}
+	// deleted files keep their blocks until the versions are dropped
+	update("b", 2, tombstone, nil)
+	if ok, _ := m.CanReadBlock(ctx, "h1"); !ok {
+		t.Errorf("block of a retained version not readable")
+	}
+	update("b", 3, tombstone, nil)
+	if refs := references("h1"); refs.RefCount != 0 || len(refs.Files) != 0 || refs.Size != -1 {
+		t.Errorf("references of an unreferenced block = %v", refs)
+	}
+	if ok, _ := m.CanReadBlock(ctx, "h1"); ok {
+		t.Errorf("unreferenced block still readable")
+	}
+	if usage := m.namespaceUsage("alice"); usage.Blocks != 2 || usage.LogicalBytes != 50 {
+		t.Errorf("usage after the drops = %v", usage)
+	}
+}
+
+func TestBlockReferencesAcrossNamespaces(t *testing.T) {
+	m := NewMetaStore([]string{"localhost:8081"})
+	for _, namespace := range []string{"alice", "bob"} {
+		_, err := m.UpdateFile(namespaceContext(namespace), &FileMetaData{Filename: "f", Version: 1,
+			BlockHashList: []string{"shared", namespace}, BlockSizeList: []int32{10, 5}})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// users see their own namespace, admins every namespace
+	refs, err := m.GetBlockReferences(namespaceContext("alice"), &BlockHash{Hash: "shared"})
+	if err != nil || len(refs.Files) != 1 || refs.Files[0].Namespace != "alice" {
+		t.Errorf("references for alice = %v, %v", refs, err)
+	}
+	admin := context.WithValue(context.Background(), userContextKey{}, &User{Name: "root", Namespace: "root", Admin: true})
+	refs, err = m.GetBlockReferences(admin, &BlockHash{Hash: "shared"})
+	if err != nil || refs.RefCount != 2 || len(refs.Files) != 2 || refs.Files[1].Namespace != "bob" {
+		t.Errorf("references for an admin = %v, %v", refs, err)
+	}
+	if ok, _ := m.CanReadBlock(namespaceContext("alice"), "bob"); ok {
+		t.Errorf("block of another namespace readable")
+	}
+	// only the block no other namespace references is unique
+	if usage := m.namespaceUsage("alice"); usage.LogicalBytes != 15 || usage.UniqueBytes != 5 {
+		t.Errorf("usage of alice = %v", usage)
+	}
+}
+
+func TestLogicalBytesAfterMatchesIndex(t *testing.T) {
+	idx := newBlockIndex()
+	v1 := &FileMetaData{Filename: "a", Version: 1, BlockHashList: []string{"h1", "h2"}, BlockSizeList: []int32{10, 20}}
+	v2 := &FileMetaData{Filename: "a", Version: 2, BlockHashList: []string{"h2", "h3"}, BlockSizeList: []int32{20, 30}}
+	// a version without sizes does not count its new blocks
+	v3 := &FileMetaData{Filename: "b", Version: 1, BlockHashList: []string{"h4"}}
+	steps := []struct {
+		added   *FileMetaData
+		dropped []*FileMetaData
+		want    int64
+	}{
+		{v1, nil, 30},
+		{v2, nil, 60},
+		{v3, []*FileMetaData{v1}, 50},
+	}
+	for i, step := range steps {
+		after := idx.logicalBytesAfter([]*FileMetaData{step.added}, step.dropped)
+		idx.add(step.added)
+		for _, fileMeta := range step.dropped {
+			idx.remove(fileMeta)
+		}
+		if after != step.want || idx.logical_bytes != step.want {
+			t.Errorf("step %d: logicalBytesAfter = %d, index = %d, want %d", i, after, idx.logical_bytes, step.want)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package surfstore
+
+import (
+	context "context"
+	"sync"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+)
+
+// BlockSizer looks up the size of blocks stored on a ring of block stores
+// and uploaded by the caller's namespace. Blocks left out of the result are
+// not stored.
+type BlockSizer interface {
+	BlockSizes(ctx context.Context, blockStoreAddrs []string, blockHashes []string) (map[string]int64, error)
+}
+
+// RemoteBlockSizer asks the block stores of a ring for the size of blocks,
+// forwarding the caller's token so that each block store answers for the
+// caller's namespace.
+type RemoteBlockSizer struct {
+	// TransportCredentials secures the connections to block stores; nil dials in plaintext
+	TransportCredentials credentials.TransportCredentials
+
+	lock  sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+func (r *RemoteBlockSizer) BlockSizes(ctx context.Context, blockStoreAddrs []string, blockHashes []string) (map[string]int64, error) {
+	ctx = outgoingRequestID(ctx)
+	if token, ok := tokenFromIncoming(ctx); ok {
+		ctx = metadata.AppendToOutgoingContext(ctx, AUTH_METADATA_KEY, AUTH_SCHEME+token)
+	}
+	ring := NewBlockStoreRing(blockStoreAddrs)
+	servers := len(ring.Servers())
+	sizes := make(map[string]int64)
+	// ask the block store responsible for each block first, then the next
+	// ones for blocks written before the ring changed
+	pending := blockHashes
+	for round := 0; round < servers && len(pending) > 0; round++ {
+		server_hashes := make(map[string][]string)
+		for _, hash := range pending {
+			addr := ring.ServersFor(hash)[round]
+			server_hashes[addr] = append(server_hashes[addr], hash)
+		}
+		pending = nil
+		for addr, hashes := range server_hashes {
+			found, err := r.getBlockSizes(ctx, addr, hashes)
+			if err != nil {
+				return nil, err
+			}
+			for _, hash := range hashes {
+				if size, ok := found[hash]; ok {
+					sizes[hash] = size
+				} else {
+					pending = append(pending, hash)
+				}
+			}
+		}
+	}
+	return sizes, nil
+}
+
+func (r *RemoteBlockSizer) getBlockSizes(ctx context.Context, addr string, blockHashes []string) (map[string]int64, error) {
+	r.lock.Lock()
+	conn, ok := r.conns[addr]
+	if !ok {
+		var err error
+		conn, err = grpc.Dial(addr, transportDialOption(r.TransportCredentials))
+		if err != nil {
+			r.lock.Unlock()
+			return nil, err
+		}
+		if r.conns == nil {
+			r.conns = make(map[string]*grpc.ClientConn)
+		}
+		r.conns[addr] = conn
+	}
+	r.lock.Unlock()
+
+	sizes, err := NewBlockStoreClient(conn).GetBlockSizes(ctx, &BlockHashes{Hashes: blockHashes})
+	if err != nil {
+		return nil, err
+	}
+	return sizes.GetSizes(), nil
+}
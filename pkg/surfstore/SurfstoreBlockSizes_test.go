@@ -0,0 +1,77 @@
+package surfstore
+
+import (
+	"bytes"
+	context "context"
+	"net"
+	"testing"
+
+	grpc "google.golang.org/grpc"
+)
+
+func TestGetBlockSizesReportsUploadsOfTheNamespace(t *testing.T) {
+	bs := NewBlockStore()
+	data := bytes.Repeat([]byte("abc"), 1000)
+	if _, err := bs.PutBlock(namespaceContext("alice"), EncodeBlock(Codec_CODEC_ZSTD, data)); err != nil {
+		t.Fatal(err)
+	}
+	hash := GetBlockHashString(data)
+	request := &BlockHashes{Hashes: []string{hash, "missing"}}
+
+	sizes, err := bs.GetBlockSizes(namespaceContext("alice"), request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes.Sizes) != 1 || sizes.Sizes[hash] != int64(len(data)) {
+		t.Errorf("sizes for the uploader = %v, want the decoded size %d", sizes.Sizes, len(data))
+	}
+	sizes, err = bs.GetBlockSizes(namespaceContext("bob"), request)
+	if err != nil || len(sizes.Sizes) != 0 {
+		t.Errorf("sizes for another namespace = %v, %v", sizes.GetSizes(), err)
+	}
+}
+
+// serveBlockStore serves a BlockStore on a local port until the test ends.
+func serveBlockStore(t *testing.T, bs *BlockStore, opts ...grpc.ServerOption) string {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer(opts...)
+	RegisterBlockStoreServer(server, bs)
+	go server.Serve(listen)
+	t.Cleanup(server.Stop)
+	return listen.Addr().String()
+}
+
+func TestRemoteBlockSizerSearchesTheRing(t *testing.T) {
+	stores := []*BlockStore{NewBlockStore(), NewBlockStore()}
+	addrs := []string{serveBlockStore(t, stores[0]), serveBlockStore(t, stores[1])}
+	ring := NewBlockStoreRing(addrs)
+
+	ctx := context.Background()
+	var hashes []string
+	for i, data := range [][]byte{[]byte("first block"), []byte("second block, longer")} {
+		hash := GetBlockHashString(data)
+		hashes = append(hashes, hash)
+		// the second block sits on the store after the responsible one, as
+		// after a change of the ring
+		owner := ring.ServersFor(hash)[i]
+		for j, addr := range addrs {
+			if addr == owner {
+				if _, err := stores[j].PutBlock(ctx, &Block{BlockData: data, BlockSize: int32(len(data))}); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	sizer := &RemoteBlockSizer{}
+	sizes, err := sizer.BlockSizes(ctx, addrs, append(hashes, "missing"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sizes) != 2 || sizes[hashes[0]] != 11 || sizes[hashes[1]] != 20 {
+		t.Errorf("BlockSizes = %v", sizes)
+	}
+}
@@ -0,0 +1,237 @@
+package surfstore
+
+import (
+	context "context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// ListRemoteFiles returns the files currently on the server, sorted by
+// name. Deleted files are left out.
+func ListRemoteFiles(ctx context.Context, client RPCClient) ([]*FileMetaData, error) {
+	remote := make(map[string]*FileMetaData)
+	if err := client.GetFileInfoMap(ctx, &remote); err != nil {
+		return nil, err
+	}
+	files := make([]*FileMetaData, 0, len(remote))
+	for _, meta := range remote {
+		if !IsTombstone(meta.BlockHashList) {
+			files = append(files, meta)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Filename < files[j].Filename })
+	return files, nil
+}
+
+// StorageUsage is the storage used on the servers, as far as the caller
+// may see it.
+type StorageUsage struct {
+	// The caller's namespace, or every namespace for admins
+	Namespaces []*NamespaceUsage
+	// Every block store of the ring by address, for admins only
+	BlockStores map[string]*BlockStoreUsage
+}
+
+// GetStorageUsage asks the MetaStore for the usage of the namespaces and,
+// when the caller is an admin, every block store for theirs.
+func GetStorageUsage(ctx context.Context, client RPCClient) (*StorageUsage, error) {
+	usage := &StorageUsage{BlockStores: make(map[string]*BlockStoreUsage)}
+	if err := client.GetNamespaceUsage(ctx, &usage.Namespaces); err != nil {
+		return nil, err
+	}
+	ring, err := getBlockStoreRing(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range ring.Servers() {
+		block_usage := &BlockStoreUsage{}
+		err := client.GetBlockStoreUsage(ctx, addr, block_usage)
+		if status.Code(err) == codes.PermissionDenied {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		usage.BlockStores[addr] = block_usage
+	}
+	return usage, nil
+}
+
+// DownloadFile writes the current version of a remote file to w and
+// returns its metadata.
+func DownloadFile(ctx context.Context, client RPCClient, filename string, w io.Writer) (*FileMetaData, error) {
+	meta, err := client.GetUpdatedMetadata(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	if meta == nil || IsTombstone(meta.BlockHashList) {
+		return nil, fmt.Errorf("%v: %w", filename, ErrFileNotFound)
+	}
+	ring, err := getBlockStoreRing(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeBlocks(ctx, client, meta.BlockHashList, ring, w); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// writeBlocks fetches every block of a hash list in order, checks it
+// against its hash and writes the plaintext to w.
+func writeBlocks(ctx context.Context, client RPCClient, hashList []string, ring *ConsistentHashRing, w io.Writer) error {
+	for _, hash := range hashList {
+		data, err := fetchBlock(ctx, client, hash, ring)
+		if err != nil {
+			return err
+		}
+		if _, err := w.Write(data); err != nil {
+			return localIOError("write", "", err)
+		}
+	}
+	return nil
+}
+
+// getBlockStoreRing asks the MetaStore for the block stores to use.
+func getBlockStoreRing(ctx context.Context, client RPCClient) (*ConsistentHashRing, error) {
+	var addrs []string
+	if err := client.GetBlockStoreAddrs(ctx, &addrs); err != nil {
+		return nil, err
+	}
+	return NewBlockStoreRing(addrs), nil
+}
+
+// fetchBlock gets one block, checks it against its hash and returns the
+// plaintext. The block is asked from the block store responsible for it
+// first, then from the rest of the ring, which still holds the blocks
+// uploaded before a block store joined.
+func fetchBlock(ctx context.Context, client RPCClient, hash string, ring *ConsistentHashRing) ([]byte, error) {
+	blk := &Block{}
+	var get_err error
+	for _, addr := range ring.ServersFor(hash) {
+		err := client.GetBlock(ctx, hash, addr, blk)
+		if err == nil {
+			get_err = nil
+			break
+		}
+		if get_err == nil {
+			get_err = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if get_err != nil {
+		return nil, get_err
+	}
+	if GetBlockHashString(blk.BlockData[:blk.BlockSize]) != hash {
+		return nil, integrityError("verify", hash, errors.New("Block does not match its hash"))
+	}
+	data, err := OpenBlock(client.Cipher, blk.BlockData[:blk.BlockSize])
+	if err != nil {
+		return nil, integrityError("decrypt", hash, err)
+	}
+	return data, nil
+}
+
+// UploadFile publishes the local file at localPath as the next version of
+// the remote file filename.
+func UploadFile(ctx context.Context, client RPCClient, localPath string, filename string) (*FileMetaData, error) {
+	remote_meta, err := client.GetUpdatedMetadata(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	ring, err := getBlockStoreRing(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := os.Stat(localPath)
+	if err != nil {
+		return nil, localIOError("stat", localPath, err)
+	}
+	hash_list, err := ComputeSealedHashList(localPath, client.BlockSize, client.Cipher)
+	if err != nil {
+		return nil, err
+	}
+	meta, err := localFileMetaData(localPath, filename, info)
+	if err != nil {
+		return nil, localIOError("stat", localPath, err)
+	}
+	meta.Version = 1
+	meta.BlockHashList = *hash_list
+	if remote_meta != nil {
+		meta.Version = remote_meta.Version + 1
+	}
+	client.Logger.WithContext(ctx).Info("Uploading", "path", localPath, "file", filename, "version", meta.Version)
+	if meta.BlockSizeList, err = uploadBlocksFrom(ctx, client, localPath, ring); err != nil {
+		return nil, err
+	}
+	if len(meta.BlockSizeList) != len(meta.BlockHashList) {
+		return nil, localIOError("read", localPath, errors.New("File changed during the upload"))
+	}
+	return meta, commitVersion(ctx, client, meta)
+}
+
+// RemoveRemoteFile deletes a remote file by publishing a tombstone.
+func RemoveRemoteFile(ctx context.Context, client RPCClient, filename string) (*FileMetaData, error) {
+	remote_meta, err := client.GetUpdatedMetadata(ctx, filename)
+	if err != nil {
+		return nil, err
+	}
+	if remote_meta == nil || IsTombstone(remote_meta.BlockHashList) {
+		return nil, fmt.Errorf("%v: %w", filename, ErrFileNotFound)
+	}
+	meta := &FileMetaData{Filename: filename, Version: remote_meta.Version + 1, BlockHashList: []string{TOMBSTONE_HASH}}
+	return meta, commitVersion(ctx, client, meta)
+}
+
+// RestoreFileVersion publishes the content of an earlier version as the
+// next version of a remote file. Restoring a tombstone deletes the file.
+func RestoreFileVersion(ctx context.Context, client RPCClient, filename string, version int32) (*FileMetaData, error) {
+	var history []*FileMetaData
+	if err := client.GetFileHistory(ctx, filename, &history); err != nil {
+		return nil, err
+	}
+	if len(history) == 0 {
+		return nil, fmt.Errorf("%v: %w", filename, ErrFileNotFound)
+	}
+	var old_meta *FileMetaData
+	for _, meta := range history {
+		if meta.Version == version {
+			old_meta = meta
+		}
+	}
+	if old_meta == nil {
+		return nil, fmt.Errorf("%v version %d: %w", filename, version, ErrVersionNotFound)
+	}
+
+	latest := history[len(history)-1]
+	meta := proto.Clone(old_meta).(*FileMetaData)
+	meta.Version = latest.Version + 1
+	return meta, commitVersion(ctx, client, meta)
+}
+
+// commitVersion publishes meta on top of the version before it.
+func commitVersion(ctx context.Context, client RPCClient, meta *FileMetaData) error {
+	var result UpdateResult
+	if err := client.UpdateFileIf(ctx, expectPrevious(meta), &result); err != nil {
+		return err
+	}
+	if result.Reason != UpdateReason_UPDATE_APPLIED {
+		err := fmt.Errorf("File was changed on the server concurrently (%v)", result.Reason)
+		if result.Current != nil {
+			err = fmt.Errorf("File was changed on the server concurrently (%v, now at version %d)",
+				result.Reason, result.Current.Version)
+		}
+		return conflictError("UpdateFileIf", meta.Filename, err)
+	}
+	return nil
+}
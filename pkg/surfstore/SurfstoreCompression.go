@@ -0,0 +1,81 @@
+package surfstore
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Shared encoder and decoder; both are safe for concurrent EncodeAll/DecodeAll
+var zstdEncoder, _ = zstd.NewWriter(nil)
+var zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(MAX_DECODED_BLOCK_SIZE))
+
+// SupportedCodecs lists every codec this build can decode.
+var SupportedCodecs = []Codec{Codec_CODEC_ZSTD, Codec_CODEC_SNAPPY}
+
+// ParseCodec maps a flag value such as "zstd" to a Codec.
+func ParseCodec(name string) (Codec, error) {
+	switch strings.ToLower(name) {
+	case "", "none":
+		return Codec_CODEC_NONE, nil
+	case "zstd":
+		return Codec_CODEC_ZSTD, nil
+	case "snappy":
+		return Codec_CODEC_SNAPPY, nil
+	}
+	return Codec_CODEC_NONE, fmt.Errorf("Unknown codec %v", name)
+}
+
+// EncodeBlock compresses blockData with codec. It falls back to
+// CODEC_NONE when compression does not make the block smaller.
+func EncodeBlock(codec Codec, blockData []byte) *Block {
+	var encoded []byte
+	switch codec {
+	case Codec_CODEC_ZSTD:
+		encoded = zstdEncoder.EncodeAll(blockData, nil)
+	case Codec_CODEC_SNAPPY:
+		encoded = snappy.Encode(nil, blockData)
+	}
+	if encoded == nil || len(encoded) >= len(blockData) {
+		return &Block{BlockData: blockData, BlockSize: int32(len(blockData)), Codec: Codec_CODEC_NONE}
+	}
+	return &Block{BlockData: encoded, BlockSize: int32(len(encoded)), Codec: codec}
+}
+
+// DecodeBlock returns the uncompressed bytes of a block.
+func DecodeBlock(block *Block) ([]byte, error) {
+	if block.BlockSize < 0 || int(block.BlockSize) > len(block.BlockData) {
+		return nil, fmt.Errorf("Invalid block size %v", block.BlockSize)
+	}
+	data := block.BlockData[:block.BlockSize]
+	switch block.Codec {
+	case Codec_CODEC_NONE:
+		return data, nil
+	case Codec_CODEC_ZSTD:
+		return zstdDecoder.DecodeAll(data, nil)
+	case Codec_CODEC_SNAPPY:
+		n, err := snappy.DecodedLen(data)
+		if err != nil {
+			return nil, err
+		}
+		if n > MAX_DECODED_BLOCK_SIZE {
+			return nil, fmt.Errorf("Decoded block too large: %v bytes", n)
+		}
+		return snappy.Decode(nil, data)
+	}
+	return nil, fmt.Errorf("Unknown codec %v", block.Codec)
+}
+
+func acceptsCodec(accepted []Codec, codec Codec) bool {
+	if codec == Codec_CODEC_NONE {
+		return true
+	}
+	for _, c := range accepted {
+		if c == codec {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,86 @@
+package surfstore
+
+import (
+	"bytes"
+	context "context"
+	"crypto/rand"
+	"testing"
+)
+
+func TestEncodeBlockRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("compressible "), 400)
+	for _, codec := range SupportedCodecs {
+		block := EncodeBlock(codec, data)
+		if block.Codec != codec || int(block.BlockSize) >= len(data) {
+			t.Errorf("%v: encoded to %v bytes with %v", codec, block.BlockSize, block.Codec)
+		}
+		decoded, err := DecodeBlock(block)
+		if err != nil || !bytes.Equal(decoded, data) {
+			t.Errorf("%v: DecodeBlock = %d bytes, %v", codec, len(decoded), err)
+		}
+	}
+}
+
+func TestEncodeBlockKeepsIncompressibleData(t *testing.T) {
+	data := make([]byte, 4096)
+	rand.Read(data)
+	for _, codec := range SupportedCodecs {
+		if block := EncodeBlock(codec, data); block.Codec != Codec_CODEC_NONE || !bytes.Equal(block.BlockData, data) {
+			t.Errorf("%v: random data stored with %v", codec, block.Codec)
+		}
+	}
+}
+
+func TestDecodeBlockRejectsCorruptInput(t *testing.T) {
+	garbage := []byte("definitely not compressed data")
+	for _, block := range []*Block{
+		{BlockData: garbage, BlockSize: int32(len(garbage)), Codec: Codec_CODEC_ZSTD},
+		{BlockData: garbage, BlockSize: int32(len(garbage)), Codec: Codec_CODEC_SNAPPY},
+		{BlockData: garbage, BlockSize: int32(len(garbage)) + 1},
+		{BlockData: garbage, BlockSize: -1},
+		{BlockData: garbage, BlockSize: int32(len(garbage)), Codec: Codec(42)},
+	} {
+		if _, err := DecodeBlock(block); err == nil {
+			t.Errorf("DecodeBlock accepted %v bytes of %v with size %v", len(block.BlockData), block.Codec, block.BlockSize)
+		}
+	}
+	// a snappy header claiming a huge decoded length
+	bomb := []byte{0xff, 0xff, 0xff, 0xff, 0x7f}
+	if _, err := DecodeBlock(&Block{BlockData: bomb, BlockSize: int32(len(bomb)), Codec: Codec_CODEC_SNAPPY}); err == nil {
+		t.Errorf("DecodeBlock accepted an oversized snappy block")
+	}
+}
+
+func TestBlockStoreHashesDecodedBytes(t *testing.T) {
+	bs := NewBlockStore()
+	ctx := context.Background()
+	data := bytes.Repeat([]byte("abc"), 1000)
+	if _, err := bs.PutBlock(ctx, EncodeBlock(Codec_CODEC_ZSTD, data)); err != nil {
+		t.Fatal(err)
+	}
+	hash := GetBlockHashString(data)
+	// stored compressed, decoded for callers that do not accept zstd
+	block, err := bs.GetBlock(ctx, &BlockHash{Hash: hash})
+	if err != nil || block.Codec != Codec_CODEC_NONE || !bytes.Equal(block.BlockData, data) {
+		t.Fatalf("GetBlock = %v bytes of %v, %v", len(block.GetBlockData()), block.GetCodec(), err)
+	}
+	block, err = bs.GetBlock(ctx, &BlockHash{Hash: hash, AcceptCodecs: SupportedCodecs})
+	if err != nil || block.Codec != Codec_CODEC_ZSTD {
+		t.Fatalf("GetBlock accepting zstd = %v, %v", block.GetCodec(), err)
+	}
+	if _, err := bs.PutBlock(ctx, &Block{BlockData: []byte("xx"), BlockSize: 2, Codec: Codec_CODEC_ZSTD}); err == nil {
+		t.Errorf("PutBlock accepted a corrupt block")
+	}
+}
+
+func TestParseCodec(t *testing.T) {
+	for name, want := range map[string]Codec{"": Codec_CODEC_NONE, "none": Codec_CODEC_NONE,
+		"ZSTD": Codec_CODEC_ZSTD, "snappy": Codec_CODEC_SNAPPY} {
+		if codec, err := ParseCodec(name); err != nil || codec != want {
+			t.Errorf("ParseCodec(%q) = %v, %v", name, codec, err)
+		}
+	}
+	if _, err := ParseCodec("gzip"); err == nil {
+		t.Errorf("ParseCodec accepted gzip")
+	}
+}
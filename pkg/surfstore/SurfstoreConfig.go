@@ -0,0 +1,305 @@
+package surfstore
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ClusterConfig describes every server of a cluster. All servers can share
+// one file and pick their own entry by name.
+type ClusterConfig struct {
+	// MetaStore is the address block servers reach the MetaStore at to
+	// authorize block reads
+	MetaStore string `yaml:"metaStore"`
+	// BlockStores is the ring of block stores the MetaStore sends clients to
+	BlockStores []string `yaml:"blockStores"`
+	// HistoryLimit is the number of versions kept per file, 0 keeps all
+	HistoryLimit int `yaml:"historyLimit"`
+	// DefaultQuota bounds the logical bytes of every namespace not listed
+	// in Quotas; 0 for no limit
+	DefaultQuota    ByteSize            `yaml:"defaultQuota"`
+	Quotas          map[string]ByteSize `yaml:"quotas"`
+	ShutdownTimeout time.Duration       `yaml:"shutdownTimeout"`
+	Log             LogConfig           `yaml:"log"`
+	Security        SecurityConfig      `yaml:"security"`
+	Servers         []*ServerConfig     `yaml:"servers"`
+}
+
+// LogConfig says how a server logs.
+type LogConfig struct {
+	Level  string `yaml:"level"`
+	Format string `yaml:"format"`
+	// File logs are appended to; empty writes to stderr
+	File string `yaml:"file"`
+}
+
+// SecurityConfig enables authentication and TLS.
+type SecurityConfig struct {
+	// AuthFile holds the users and their tokens; empty disables authentication
+	AuthFile string `yaml:"authFile"`
+	// Admins are the users of AuthFile allowed to call admin RPCs
+	Admins []string  `yaml:"admins"`
+	TLS    TLSConfig `yaml:"tls"`
+}
+
+// TLSConfig names the PEM files of the server certificate, the CA client
+// certificates must be signed by (mTLS) and the CA other servers are
+// verified with (default system roots).
+type TLSConfig struct {
+	Cert     string `yaml:"cert"`
+	Key      string `yaml:"key"`
+	ClientCA string `yaml:"clientCA"`
+	CA       string `yaml:"ca"`
+}
+
+// ServerConfig describes one server process of the cluster.
+type ServerConfig struct {
+	Name string `yaml:"name"`
+	// Roles are meta, block or both
+	Roles  []string `yaml:"roles"`
+	Listen string   `yaml:"listen"`
+	// Metrics is the address Prometheus metrics are served at; empty disables them
+	Metrics string `yaml:"metrics"`
+	// Capacity bounds the bytes a block server stores; 0 for no limit
+	Capacity ByteSize `yaml:"capacity"`
+}
+
+// ByteSize is a number of bytes written as a plain number or with a
+// binary suffix, such as 10G.
+type ByteSize int64
+
+func (b *ByteSize) UnmarshalYAML(value *yaml.Node) error {
+	size, err := ParseSize(value.Value)
+	if err != nil || value.Kind != yaml.ScalarNode {
+		return fmt.Errorf("line %d: bad size %q", value.Line, value.Value)
+	}
+	*b = ByteSize(size)
+	return nil
+}
+
+// ParseSize parses a size in bytes with an optional binary k, M, G or T
+// suffix, such as 10G; "off" and 0 mean no limit.
+func ParseSize(s string) (int64, error) {
+	size, err := parseByteCount(s)
+	if err != nil {
+		return 0, fmt.Errorf("Bad size %v", s)
+	}
+	return size, nil
+}
+
+func parseByteCount(s string) (int64, error) {
+	s = strings.TrimSpace(s)
+	if s == "" || strings.EqualFold(s, "off") {
+		return 0, nil
+	}
+	multiplier := int64(1)
+	switch s[len(s)-1] {
+	case 'k', 'K':
+		multiplier = 1 << 10
+	case 'm', 'M':
+		multiplier = 1 << 20
+	case 'g', 'G':
+		multiplier = 1 << 30
+	case 't', 'T':
+		multiplier = 1 << 40
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("Bad byte count %v", s)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// LoadClusterConfig reads and validates a YAML cluster config. Fields left
+// out take the same defaults as the server flags; unknown fields are errors.
+func LoadClusterConfig(path string) (*ClusterConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &ClusterConfig{
+		HistoryLimit:    DEFAULT_HISTORY_LIMIT,
+		ShutdownTimeout: DEFAULT_SHUTDOWN_TIMEOUT,
+		Log:             LogConfig{Level: LevelInfo.String(), Format: string(LogText)},
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+	return config, nil
+}
+
+// Validate reports every problem of the config at once.
+func (c *ClusterConfig) Validate() error {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if len(c.Servers) == 0 {
+		problem("servers: no server defined")
+	}
+	names := make(map[string]bool)
+	has_meta, has_block_only := false, false
+	for i, server := range c.Servers {
+		field := fmt.Sprintf("servers[%d]", i)
+		if server.Name != "" {
+			field = fmt.Sprintf("servers[%v]", server.Name)
+			if names[server.Name] {
+				problem("%v: name used by another server", field)
+			}
+			names[server.Name] = true
+		} else if len(c.Servers) > 1 {
+			problem("%v.name: required when there are several servers", field)
+		}
+		roles := make(map[string]bool)
+		for _, role := range server.Roles {
+			if role != SERVER_ROLE_META && role != SERVER_ROLE_BLOCK {
+				problem("%v.roles: unknown role %q, expected %v or %v", field, role, SERVER_ROLE_META, SERVER_ROLE_BLOCK)
+			} else if roles[role] {
+				problem("%v.roles: %v listed twice", field, role)
+			}
+			roles[role] = true
+		}
+		if len(server.Roles) == 0 {
+			problem("%v.roles: no role given", field)
+		}
+		has_meta = has_meta || roles[SERVER_ROLE_META]
+		has_block_only = has_block_only || (roles[SERVER_ROLE_BLOCK] && !roles[SERVER_ROLE_META])
+		if err := checkHostPort(server.Listen); err != nil {
+			problem("%v.listen: %v", field, err)
+		}
+		if server.Metrics != "" {
+			if err := checkHostPort(server.Metrics); err != nil {
+				problem("%v.metrics: %v", field, err)
+			}
+		}
+		if server.Capacity > 0 && !roles[SERVER_ROLE_BLOCK] {
+			problem("%v.capacity: only block servers store blocks", field)
+		}
+	}
+
+	ring := make(map[string]bool)
+	for _, addr := range c.BlockStores {
+		if err := checkHostPort(addr); err != nil {
+			problem("blockStores: %v", err)
+		} else if ring[addr] {
+			problem("blockStores: %v listed twice", addr)
+		}
+		ring[addr] = true
+	}
+	if has_meta && len(c.BlockStores) == 0 {
+		problem("blockStores: a MetaStore needs at least one block store")
+	}
+	if c.MetaStore != "" {
+		if err := checkHostPort(c.MetaStore); err != nil {
+			problem("metaStore: %v", err)
+		}
+	} else if has_block_only && c.Security.AuthFile != "" {
+		problem("metaStore: block servers with authentication need the MetaStore address")
+	}
+
+	if c.HistoryLimit < 0 {
+		problem("historyLimit: must not be negative")
+	}
+	if c.ShutdownTimeout < 0 {
+		problem("shutdownTimeout: must not be negative")
+	}
+	if _, err := ParseLogLevel(c.Log.Level); err != nil {
+		problem("log.level: %v", err)
+	}
+	if _, err := ParseLogFormat(c.Log.Format); err != nil {
+		problem("log.format: %v", err)
+	}
+
+	if c.Security.AuthFile != "" {
+		if auth, err := LoadAuthFile(c.Security.AuthFile); err != nil {
+			problem("security.authFile: %v", err)
+		} else if err := auth.SetAdmins(c.Security.Admins); err != nil {
+			problem("security.admins: %v", err)
+		}
+	} else if len(c.Security.Admins) > 0 {
+		problem("security.admins: needs an authFile")
+	}
+	tls := c.Security.TLS
+	if (tls.Cert == "") != (tls.Key == "") {
+		problem("security.tls: cert and key must be given together")
+	}
+	if tls.ClientCA != "" && tls.Cert == "" {
+		problem("security.tls.clientCA: needs cert and key")
+	}
+	for _, file := range []struct{ field, path string }{
+		{"cert", tls.Cert}, {"key", tls.Key}, {"clientCA", tls.ClientCA}, {"ca", tls.CA}} {
+		if file.path == "" {
+			continue
+		}
+		if _, err := os.Stat(file.path); err != nil {
+			problem("security.tls.%v: %v", file.field, err)
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Invalid config:\n  %v", strings.Join(problems, "\n  "))
+	}
+	return nil
+}
+
+// Server returns the entry of the named server. The name may be left out
+// when the config defines a single server.
+func (c *ClusterConfig) Server(name string) (*ServerConfig, error) {
+	if name == "" && len(c.Servers) == 1 {
+		return c.Servers[0], nil
+	}
+	for _, server := range c.Servers {
+		if server.Name == name && name != "" {
+			return server, nil
+		}
+	}
+	if name == "" {
+		return nil, fmt.Errorf("Config defines %d servers, pick one by name", len(c.Servers))
+	}
+	return nil, fmt.Errorf("Config defines no server named %v", name)
+}
+
+// ServiceType returns meta, block or both.
+func (s *ServerConfig) ServiceType() string {
+	has_meta, has_block := false, false
+	for _, role := range s.Roles {
+		has_meta = has_meta || role == SERVER_ROLE_META
+		has_block = has_block || role == SERVER_ROLE_BLOCK
+	}
+	if has_meta && has_block {
+		return "both"
+	}
+	if has_meta {
+		return SERVER_ROLE_META
+	}
+	return SERVER_ROLE_BLOCK
+}
+
+func checkHostPort(addr string) error {
+	if addr == "" {
+		return fmt.Errorf("address missing")
+	}
+	if _, port, err := net.SplitHostPort(addr); err != nil {
+		return err
+	} else if port == "" {
+		return fmt.Errorf("address %v has no port", addr)
+	}
+	return nil
+}
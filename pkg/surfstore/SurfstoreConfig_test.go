@@ -0,0 +1,37 @@
+package surfstore
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadClusterConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "cluster.yaml")
+	writeTestFile(t, path, `blockStores: [localhost:8081]
+servers:
+  - name: block1
+    roles: [block]
+    listen: localhost:8081
+    capacity: 2K
+`)
+	config, err := LoadClusterConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Servers[0].Capacity != 2048 || config.HistoryLimit != DEFAULT_HISTORY_LIMIT {
+		t.Errorf("config = %+v", config)
+	}
+
+	// settings the server does not implement are unknown fields
+	writeTestFile(t, path, `servers:
+  - name: block1
+    roles: [block]
+    listen: localhost:8081
+    storageDir: /var/lib/surfstore
+`)
+	if _, err := LoadClusterConfig(path); err == nil || !strings.Contains(err.Error(), "storageDir") {
+		t.Errorf("config with storageDir = %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package surfstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// BlockCipher encrypts blocks and filenames on the client so that the
+// servers only ever see ciphertext.
+//
+// Encryption is deterministic: the AES-GCM nonce is an HMAC of the
+// plaintext, so every client holding the same passphrase turns a block
+// into the same ciphertext and the BlockStore can still deduplicate it.
+// Block hashes are taken over the ciphertext.
+type BlockCipher struct {
+	// EncryptNames also hides filenames from the MetaStore
+	EncryptNames bool
+	blockAEAD    cipher.AEAD
+	blockNonce   []byte
+	nameAEAD     cipher.AEAD
+	nameNonce    []byte
+	keyID        string
+}
+
+var ErrDecrypt = errors.New("Unable to decrypt, wrong passphrase or corrupted data")
+
+// NewBlockCipher derives the block and filename keys from a passphrase
+// shared by every client of the namespace and the namespace's salt, so
+// keys precomputed for common passphrases are of no use elsewhere.
+func NewBlockCipher(passphrase string, salt []byte, encryptNames bool) (*BlockCipher, error) {
+	if passphrase == "" {
+		return nil, errors.New("Empty passphrase")
+	}
+	if len(salt) < CRYPTO_SALT_SIZE {
+		return nil, fmt.Errorf("Salt of %d bytes, expected at least %d", len(salt), CRYPTO_SALT_SIZE)
+	}
+	master, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	c := &BlockCipher{EncryptNames: encryptNames}
+	if c.blockAEAD, err = newAEAD(deriveKey(master, "block")); err != nil {
+		return nil, err
+	}
+	if c.nameAEAD, err = newAEAD(deriveKey(master, "name")); err != nil {
+		return nil, err
+	}
+	c.blockNonce = deriveKey(master, "block-nonce")
+	c.nameNonce = deriveKey(master, "name-nonce")
+	c.keyID = hex.EncodeToString(deriveKey(master, "key-id")[:8])
+	return c, nil
+}
+
+// KeyID identifies the passphrase and salt without revealing them, so
+// that hashes cached under another key are not reused.
+func (c *BlockCipher) KeyID() string {
+	return c.keyID
+}
+
+// EncryptBlock returns nonce || AES-GCM(plaintext).
+func (c *BlockCipher) EncryptBlock(plaintext []byte) []byte {
+	return seal(c.blockAEAD, c.blockNonce, plaintext)
+}
+
+// DecryptBlock reverses EncryptBlock and checks the block was produced
+// under the same key.
+func (c *BlockCipher) DecryptBlock(ciphertext []byte) ([]byte, error) {
+	return open(c.blockAEAD, c.blockNonce, ciphertext)
+}
+
+// EncryptFilename returns the name stored on the MetaStore for a local
+// filename. It is the identity unless EncryptNames is set.
+func (c *BlockCipher) EncryptFilename(filename string) string {
+	if !c.EncryptNames {
+		return filename
+	}
+	return base64.RawURLEncoding.EncodeToString(seal(c.nameAEAD, c.nameNonce, []byte(filename)))
+}
+
+// DecryptFilename reverses EncryptFilename.
+func (c *BlockCipher) DecryptFilename(filename string) (string, error) {
+	if !c.EncryptNames {
+		return filename, nil
+	}
+	ciphertext, err := base64.RawURLEncoding.DecodeString(filename)
+	if err != nil {
+		return "", ErrDecrypt
+	}
+	plaintext, err := open(c.nameAEAD, c.nameNonce, ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// EncryptSymlinkTarget hides the target of a symlink, which is file
+// content rather than a name, so it is encrypted with the block key.
+func (c *BlockCipher) EncryptSymlinkTarget(target string) string {
+	return base64.RawURLEncoding.EncodeToString(seal(c.blockAEAD, c.blockNonce, []byte(target)))
+}
+
+// DecryptSymlinkTarget reverses EncryptSymlinkTarget.
+func (c *BlockCipher) DecryptSymlinkTarget(target string) (string, error) {
+	ciphertext, err := base64.RawURLEncoding.DecodeString(target)
+	if err != nil {
+		return "", ErrDecrypt
+	}
+	plaintext, err := open(c.blockAEAD, c.blockNonce, ciphertext)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+func deriveKey(master []byte, purpose string) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(purpose))
+	return mac.Sum(nil)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func syntheticNonce(nonceKey []byte, plaintext []byte, size int) []byte {
+	mac := hmac.New(sha256.New, nonceKey)
+	mac.Write(plaintext)
+	return mac.Sum(nil)[:size]
+}
+
+func seal(aead cipher.AEAD, nonceKey []byte, plaintext []byte) []byte {
+	nonce := syntheticNonce(nonceKey, plaintext, aead.NonceSize())
+	return aead.Seal(nonce, nonce, plaintext, nil)
+}
+
+func open(aead cipher.AEAD, nonceKey []byte, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	nonce := ciphertext[:aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, ciphertext[aead.NonceSize():], nil)
+	if err != nil || !hmac.Equal(nonce, syntheticNonce(nonceKey, plaintext, len(nonce))) {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
@@ -0,0 +1,84 @@
+package surfstore
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func testSalt(b byte) []byte {
+	return bytes.Repeat([]byte{b}, CRYPTO_SALT_SIZE)
+}
+
+func TestBlockCipherRoundTrip(t *testing.T) {
+	c, err := NewBlockCipher("correct horse", testSalt(1), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block := []byte("some block data")
+	sealed := SealBlock(c, block)
+	if bytes.Contains(sealed, block) {
+		t.Fatalf("sealed block contains the plaintext")
+	}
+	opened, err := OpenBlock(c, sealed)
+	if err != nil || !bytes.Equal(opened, block) {
+		t.Fatalf("OpenBlock = %q, %v, want %q", opened, err, block)
+	}
+	// deterministic, so blocks still deduplicate
+	if !bytes.Equal(SealBlock(c, block), sealed) {
+		t.Errorf("sealing twice gave different ciphertext")
+	}
+
+	name := c.EncryptFilename("dir/report.pdf")
+	if name == "dir/report.pdf" {
+		t.Errorf("filename not encrypted")
+	}
+	if got, err := c.DecryptFilename(name); err != nil || got != "dir/report.pdf" {
+		t.Errorf("DecryptFilename = %q, %v", got, err)
+	}
+	target := c.EncryptSymlinkTarget("../other")
+	if got, err := c.DecryptSymlinkTarget(target); err != nil || got != "../other" {
+		t.Errorf("DecryptSymlinkTarget = %q, %v", got, err)
+	}
+}
+
+func TestBlockCipherRejectsOtherKeys(t *testing.T) {
+	c, err := NewBlockCipher("correct horse", testSalt(1), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other_passphrase, err := NewBlockCipher("wrong horse", testSalt(1), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other_salt, err := NewBlockCipher("correct horse", testSalt(2), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := c.EncryptBlock([]byte("data"))
+	for _, other := range []*BlockCipher{other_passphrase, other_salt} {
+		if _, err := other.DecryptBlock(sealed); !errors.Is(err, ErrDecrypt) {
+			t.Errorf("DecryptBlock under another key = %v, want ErrDecrypt", err)
+		}
+		if other.KeyID() == c.KeyID() {
+			t.Errorf("KeyID %v shared by another key", c.KeyID())
+		}
+	}
+
+	sealed[len(sealed)-1] ^= 1
+	if _, err := c.DecryptBlock(sealed); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("DecryptBlock of tampered block = %v, want ErrDecrypt", err)
+	}
+	if _, err := c.DecryptBlock([]byte{1, 2}); !errors.Is(err, ErrDecrypt) {
+		t.Errorf("DecryptBlock of short block = %v, want ErrDecrypt", err)
+	}
+}
+
+func TestNewBlockCipherChecksArguments(t *testing.T) {
+	if _, err := NewBlockCipher("", testSalt(1), false); err == nil {
+		t.Errorf("empty passphrase accepted")
+	}
+	if _, err := NewBlockCipher("pw", []byte("short"), false); err == nil {
+		t.Errorf("short salt accepted")
+	}
+}
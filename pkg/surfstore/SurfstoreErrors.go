@@ -0,0 +1,83 @@
+package surfstore
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Kinds of client failures. Every error returned by the client wraps one of
+// them, so callers can test for a kind with errors.Is.
+var (
+	// The servers could not be reached or an RPC failed
+	ErrNetwork = errors.New("Network error")
+	// Another client changed the file first
+	ErrConflict = errors.New("Version conflict")
+	// A block does not match its hash or cannot be decrypted or decoded
+	ErrIntegrity = errors.New("Integrity error")
+	// Reading or writing the base directory failed
+	ErrLocalIO = errors.New("Local I/O error")
+	// The namespace quota or the capacity of a block store is used up
+	ErrQuota = errors.New("Quota exceeded")
+)
+
+var ErrFileNotFound = errors.New("File not found on the server")
+var ErrVersionNotFound = errors.New("Version not retained by the server")
+var ErrBlockNotReferenced = errors.New("Block not referenced by any retained version")
+
+// SyncError records the kind of a failure, the operation and file it
+// happened in, and the underlying error.
+type SyncError struct {
+	Kind     error
+	Op       string
+	Filename string
+	Err      error
+}
+
+func (e *SyncError) Error() string {
+	if e.Filename != "" {
+		return fmt.Sprintf("%v %v: %v", e.Op, e.Filename, e.Err)
+	}
+	return fmt.Sprintf("%v: %v", e.Op, e.Err)
+}
+
+func (e *SyncError) Unwrap() error {
+	return e.Err
+}
+
+// Is matches the kind as well as anything in the wrapped chain.
+func (e *SyncError) Is(target error) bool {
+	return target == e.Kind
+}
+
+// GRPCStatus exposes the status of a wrapped RPC error, so status.Code
+// keeps working on wrapped errors.
+func (e *SyncError) GRPCStatus() *status.Status {
+	var rpc_err interface{ GRPCStatus() *status.Status }
+	if errors.As(e.Err, &rpc_err) {
+		return rpc_err.GRPCStatus()
+	}
+	return status.New(codes.Unknown, e.Error())
+}
+
+func networkError(op string, err error) error {
+	return &SyncError{Kind: ErrNetwork, Op: op, Err: err}
+}
+
+func conflictError(op string, filename string, err error) error {
+	return &SyncError{Kind: ErrConflict, Op: op, Filename: filename, Err: err}
+}
+
+func integrityError(op string, filename string, err error) error {
+	return &SyncError{Kind: ErrIntegrity, Op: op, Filename: filename, Err: err}
+}
+
+func quotaError(op string, filename string, err error) error {
+	return &SyncError{Kind: ErrQuota, Op: op, Filename: filename, Err: err}
+}
+
+func localIOError(op string, filename string, err error) error {
+	return &SyncError{Kind: ErrLocalIO, Op: op, Filename: filename, Err: err}
+}
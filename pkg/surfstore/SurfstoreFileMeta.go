@@ -0,0 +1,104 @@
+package surfstore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// SymlinkPolicy says how the client treats symlinks in the base directory.
+type SymlinkPolicy string
+
+const (
+	// Sync the file a symlink points to as a regular file; links to
+	// directories or missing files are left alone
+	SymlinkFollow SymlinkPolicy = "follow"
+	// Sync the link itself and recreate it on other clients
+	SymlinkPreserve SymlinkPolicy = "preserve"
+	// Leave local symlinks alone and do not create remote ones
+	SymlinkSkip SymlinkPolicy = "skip"
+)
+
+// ParseSymlinkPolicy maps a flag value to a SymlinkPolicy; the empty
+// string means SymlinkFollow.
+func ParseSymlinkPolicy(name string) (SymlinkPolicy, error) {
+	switch policy := SymlinkPolicy(strings.ToLower(name)); policy {
+	case "":
+		return SymlinkFollow, nil
+	case SymlinkFollow, SymlinkPreserve, SymlinkSkip:
+		return policy, nil
+	}
+	return "", fmt.Errorf("Unknown symlink policy %v", name)
+}
+
+// IsSymlink reports whether metadata describes a symlink.
+func IsSymlink(metadata *FileMetaData) bool {
+	return metadata.FileType == FileType_FILE_TYPE_SYMLINK
+}
+
+// localFileInfo returns the stat a directory entry is synced from, or
+// false when it is not synced: directories, special files and symlinks
+// the policy leaves alone.
+func localFileInfo(path string, info os.FileInfo, policy SymlinkPolicy) (os.FileInfo, bool) {
+	if info.Mode()&os.ModeSymlink != 0 {
+		switch policy {
+		case SymlinkPreserve:
+			return info, true
+		case SymlinkSkip:
+			return nil, false
+		}
+		target, err := os.Stat(path)
+		if err != nil || !target.Mode().IsRegular() {
+			return nil, false
+		}
+		return target, true
+	}
+	return info, info.Mode().IsRegular()
+}
+
+// localFileMetaData describes a local file for upload. The hash list of a
+// regular file is left for the caller to fill in.
+func localFileMetaData(path string, filename string, info os.FileInfo) (*FileMetaData, error) {
+	metadata := &FileMetaData{Filename: filename, ModTime: info.ModTime().UnixNano()}
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		metadata.FileType = FileType_FILE_TYPE_SYMLINK
+		metadata.SymlinkTarget = target
+		metadata.BlockHashList = []string{}
+		return metadata, nil
+	}
+	metadata.Mode = uint32(info.Mode().Perm())
+	return metadata, nil
+}
+
+// restoreFileMetaData applies the synced modification time to a
+// downloaded file.
+func restoreFileMetaData(path string, metadata *FileMetaData) error {
+	if metadata.ModTime == 0 {
+		return nil
+	}
+	mtime := time.Unix(0, metadata.ModTime)
+	return os.Chtimes(path, mtime, mtime)
+}
+
+// replaceWithSymlink atomically replaces path with a symlink to target.
+func replaceWithSymlink(path string, target string) error {
+	dir, base := filepath.Split(path)
+	tmp := filepath.Join(dir, TEMP_FILE_PREFIX+base+".link")
+	if err := RemoveIfExist(tmp); err != nil {
+		return err
+	}
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
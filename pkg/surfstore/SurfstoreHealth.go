@@ -0,0 +1,162 @@
+package surfstore
+
+import (
+	context "context"
+	"fmt"
+	"sync"
+	"time"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// HealthChecker keeps the standard gRPC health service of a server in line
+// with the roles it runs. Each role is reported under its service name,
+// surfstore.BlockStore or surfstore.MetaStore, and the server as a whole
+// under "" while every role is serving. A BlockStore serves while it has
+// room for blocks; a MetaStore only while every block store of its ring
+// answers health checks as serving, since clients cannot sync without them.
+type HealthChecker struct {
+	Server *health.Server
+	// TransportCredentials secures the connections to block stores; nil dials in plaintext
+	TransportCredentials credentials.TransportCredentials
+	// Logger records changes of the serving status; nil discards
+	Logger *Logger
+
+	lock       sync.Mutex
+	statuses   map[string]healthpb.HealthCheckResponse_ServingStatus
+	metaStore  *MetaStore
+	blockStore *BlockStore
+	conns      map[string]*grpc.ClientConn
+}
+
+// NewHealthChecker returns a checker with no roles, not serving yet.
+func NewHealthChecker() *HealthChecker {
+	h := &HealthChecker{Server: health.NewServer(),
+		statuses: make(map[string]healthpb.HealthCheckResponse_ServingStatus),
+		conns:    make(map[string]*grpc.ClientConn)}
+	h.Server.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	return h
+}
+
+// AddBlockStore adds the BlockStore role, serving unless the store is full.
+func (h *HealthChecker) AddBlockStore(bs *BlockStore) {
+	h.lock.Lock()
+	h.blockStore = bs
+	h.lock.Unlock()
+	h.setStatus(BlockStore_ServiceDesc.ServiceName, blockStoreStatus(bs))
+}
+
+// blockStoreStatus is not serving while a BlockStore cannot take blocks.
+func blockStoreStatus(bs *BlockStore) healthpb.HealthCheckResponse_ServingStatus {
+	if bs.Full() {
+		return healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	return healthpb.HealthCheckResponse_SERVING
+}
+
+// AddMetaStore adds the MetaStore role, not serving until Run has reached
+// its block stores.
+func (h *HealthChecker) AddMetaStore(ms *MetaStore) {
+	h.lock.Lock()
+	h.metaStore = ms
+	h.lock.Unlock()
+	h.setStatus(MetaStore_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_NOT_SERVING)
+}
+
+// Run checks the capacity of the BlockStore and the block stores of the
+// MetaStore every interval until ctx is cancelled.
+func (h *HealthChecker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		h.check(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (h *HealthChecker) check(ctx context.Context) {
+	h.lock.Lock()
+	ms, bs := h.metaStore, h.blockStore
+	h.lock.Unlock()
+	if bs != nil {
+		h.setStatus(BlockStore_ServiceDesc.ServiceName, blockStoreStatus(bs))
+	}
+	if ms == nil {
+		return
+	}
+	status := healthpb.HealthCheckResponse_SERVING
+	for _, addr := range ms.BlockStoreAddrs() {
+		if err := h.checkBlockStore(ctx, addr); err != nil {
+			h.Logger.Warn("Block store unavailable", "addr", addr, "error", err)
+			status = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+	}
+	h.setStatus(MetaStore_ServiceDesc.ServiceName, status)
+}
+
+func (h *HealthChecker) checkBlockStore(ctx context.Context, addr string) error {
+	h.lock.Lock()
+	conn, ok := h.conns[addr]
+	if !ok {
+		var err error
+		conn, err = grpc.Dial(addr, transportDialOption(h.TransportCredentials))
+		if err != nil {
+			h.lock.Unlock()
+			return err
+		}
+		h.conns[addr] = conn
+	}
+	h.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(ctx, HEALTH_CHECK_TIMEOUT)
+	defer cancel()
+	resp, err := healthpb.NewHealthClient(conn).Check(ctx,
+		&healthpb.HealthCheckRequest{Service: BlockStore_ServiceDesc.ServiceName})
+	if err != nil {
+		return err
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		return fmt.Errorf("Block store is %v", resp.Status)
+	}
+	return nil
+}
+
+// setStatus updates one role and the overall status.
+func (h *HealthChecker) setStatus(service string, status healthpb.HealthCheckResponse_ServingStatus) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if old, ok := h.statuses[service]; ok && old == status {
+		return
+	}
+	h.statuses[service] = status
+	h.Server.SetServingStatus(service, status)
+	h.Logger.Info("Health status changed", "service", service, "status", status)
+
+	overall := healthpb.HealthCheckResponse_SERVING
+	for _, status := range h.statuses {
+		if status != healthpb.HealthCheckResponse_SERVING {
+			overall = healthpb.HealthCheckResponse_NOT_SERVING
+		}
+	}
+	h.Server.SetServingStatus("", overall)
+}
+
+// Shutdown reports every role as not serving for good, so that load
+// balancers stop sending calls while the server drains, and closes the
+// connections to the block stores.
+func (h *HealthChecker) Shutdown() {
+	h.Server.Shutdown()
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	for addr, conn := range h.conns {
+		conn.Close()
+		delete(h.conns, addr)
+	}
+}
@@ -0,0 +1,96 @@
+package surfstore
+
+import (
+	context "context"
+	"net"
+	"testing"
+
+	grpc "google.golang.org/grpc"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func servingStatus(t *testing.T, h *HealthChecker, service string) healthpb.HealthCheckResponse_ServingStatus {
+	resp, err := h.Server.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.Status
+}
+
+func TestBlockStoreHealthFollowsCapacity(t *testing.T) {
+	bs := NewBlockStore()
+	bs.Capacity = 2 * BLOCK_STORE_MIN_FREE
+	h := NewHealthChecker()
+	h.AddBlockStore(bs)
+	if status := servingStatus(t, h, ""); status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("empty block store is %v", status)
+	}
+	data := make([]byte, BLOCK_STORE_MIN_FREE+1)
+	if _, err := bs.PutBlock(context.Background(), &Block{BlockData: data, BlockSize: int32(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+	h.check(context.Background())
+	for _, service := range []string{BlockStore_ServiceDesc.ServiceName, ""} {
+		if status := servingStatus(t, h, service); status != healthpb.HealthCheckResponse_NOT_SERVING {
+			t.Errorf("full block store reports %q as %v", service, status)
+		}
+	}
+}
+
+func TestMetaStoreHealthFollowsBlockStores(t *testing.T) {
+	bs := NewBlockStore()
+	bs.Capacity = 2 * BLOCK_STORE_MIN_FREE
+	block_health := NewHealthChecker()
+	block_health.AddBlockStore(bs)
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	healthpb.RegisterHealthServer(server, block_health.Server)
+	go server.Serve(listen)
+	t.Cleanup(server.Stop)
+
+	ms := NewMetaStore([]string{listen.Addr().String()})
+	h := NewHealthChecker()
+	defer h.Shutdown()
+	h.AddMetaStore(ms)
+	meta := MetaStore_ServiceDesc.ServiceName
+	if status := servingStatus(t, h, meta); status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("MetaStore is %v before checking its block stores", status)
+	}
+	h.check(context.Background())
+	if status := servingStatus(t, h, meta); status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("MetaStore with a serving block store is %v", status)
+	}
+
+	data := make([]byte, BLOCK_STORE_MIN_FREE+1)
+	if _, err := bs.PutBlock(context.Background(), &Block{BlockData: data, BlockSize: int32(len(data))}); err != nil {
+		t.Fatal(err)
+	}
+	block_health.check(context.Background())
+	h.check(context.Background())
+	if status := servingStatus(t, h, meta); status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("MetaStore with a full block store is %v", status)
+	}
+
+	server.Stop()
+	ms.SetBlockStoreAddrs([]string{listen.Addr().String()})
+	h.check(context.Background())
+	if status := servingStatus(t, h, meta); status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("MetaStore with an unreachable block store is %v", status)
+	}
+}
+
+func TestHealthCheckerShutdown(t *testing.T) {
+	h := NewHealthChecker()
+	h.AddBlockStore(NewBlockStore())
+	h.Shutdown()
+	// later checks cannot bring the server back
+	h.check(context.Background())
+	for _, service := range []string{BlockStore_ServiceDesc.ServiceName, ""} {
+		if status := servingStatus(t, h, service); status != healthpb.HealthCheckResponse_NOT_SERVING {
+			t.Errorf("%q is %v after shutdown", service, status)
+		}
+	}
+}
@@ -2,15 +2,24 @@ package surfstore
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
+
+	"google.golang.org/protobuf/proto"
 )
 
 /* Hash Related */
@@ -25,6 +34,12 @@ func GetBlockHashString(blockData []byte) string {
 	return hex.EncodeToString(blockHash)
 }
 
+// HashListDigest returns the digest conditional updates compare block hash
+// lists by: the hash of the hashes, one per line.
+func HashListDigest(hashList []string) string {
+	return GetBlockHashString([]byte(strings.Join(hashList, "\n")))
+}
+
 /* File Path Related */
 func ConcatPath(baseDir, fileDir string) string {
 	return baseDir + "/" + fileDir
@@ -35,67 +50,210 @@ func ConcatPath(baseDir, fileDir string) string {
 */
 
 // NewFileMetaDataFromConfig returns a FileMetaData struct
-// associated with one line in the local metadata file.
-func NewFileMetaDataFromConfig(configString string) *FileMetaData {
+// associated with one line in the legacy local metadata file.
+func NewFileMetaDataFromConfig(configString string) (*FileMetaData, error) {
 	configItems := strings.Split(configString, CONFIG_DELIMITER)
+	if len(configItems) != 3 {
+		return nil, fmt.Errorf("Expected filename,version,hashes but found %d fields", len(configItems))
+	}
 
 	filename := configItems[FILENAME_INDEX]
-	version, _ := strconv.Atoi(configItems[VERSION_INDEX])
-	blockHashList := strings.Split(configItems[HASH_LIST_INDEX], HASH_DELIMITER)
+	if filename == "" {
+		return nil, errors.New("Empty filename")
+	}
+	version, err := strconv.Atoi(configItems[VERSION_INDEX])
+	if err != nil || version < 0 {
+		return nil, fmt.Errorf("Bad version %q", configItems[VERSION_INDEX])
+	}
+	// hashes are written with a trailing delimiter
+	blockHashList := []string{}
+	if hashes := strings.TrimSuffix(configItems[HASH_LIST_INDEX], HASH_DELIMITER); hashes != "" {
+		blockHashList = strings.Split(hashes, HASH_DELIMITER)
+	}
 
 	return &FileMetaData{
 		Filename:      filename,
 		Version:       int32(version),
-		BlockHashList: blockHashList[:len(blockHashList)-1],
+		BlockHashList: blockHashList,
+	}, nil
+}
+
+// LocalIndex is the content of the local index file.
+type LocalIndex struct {
+	// HashParams records how the cached hash lists were computed; they are
+	// only reused while it matches the client's current settings
+	HashParams string
+	// Selection the entries were synced with; files outside it are not indexed
+	Selection *Selection
+	Entries   map[string]*IndexEntry
+	// Legacy is set when the index was read from the legacy format
+	Legacy bool
+}
+
+// IndexEntry is one file in the local index: the metadata last synced
+// with the server plus the local stat of the file it was computed from.
+type IndexEntry struct {
+	Filename      string   `json:"filename"`
+	Version       int32    `json:"version"`
+	BlockHashList []string `json:"blockHashList"`
+	Size          int64    `json:"size"`
+	// Modification time in nanoseconds since the Unix epoch, 0 if unknown
+	ModTime int64  `json:"mtime"`
+	Inode   uint64 `json:"inode,omitempty"`
+	// Local permission bits of a regular file, 0 if unknown
+	Mode          uint32   `json:"mode,omitempty"`
+	FileType      FileType `json:"fileType,omitempty"`
+	SymlinkTarget string   `json:"symlinkTarget,omitempty"`
+}
+
+// indexHeader is the first line of a versioned index file.
+type indexHeader struct {
+	Format     string     `json:"format"`
+	Version    int        `json:"version"`
+	HashParams string     `json:"hashParams,omitempty"`
+	Selection  *Selection `json:"selection,omitempty"`
+}
+
+// NewLocalIndex returns an empty index.
+func NewLocalIndex(hashParams string) *LocalIndex {
+	return &LocalIndex{HashParams: hashParams, Entries: make(map[string]*IndexEntry)}
+}
+
+// SetStat records the stat a hash list was computed from, hashedAt being
+// a time no later than the stat and the hash were taken. Files modified
+// within RACY_MTIME_WINDOW before hashedAt are recorded without a
+// modification time, since a write after the hash could have kept the
+// same timestamp; they are rehashed on the next sync. A zero hashedAt
+// means unknown and always records the file that way.
+func (e *IndexEntry) SetStat(info os.FileInfo, hashedAt time.Time) {
+	e.Size = info.Size()
+	e.ModTime = info.ModTime().UnixNano()
+	e.Inode = fileInode(info)
+	if hashedAt.Sub(info.ModTime()) < RACY_MTIME_WINDOW {
+		e.ModTime = 0
 	}
 }
 
+// StatMatches reports whether a file still has the stat recorded in the
+// entry, in which case its cached hash list can be reused.
+func (e *IndexEntry) StatMatches(info os.FileInfo) bool {
+	return e.ModTime != 0 &&
+		e.Size == info.Size() &&
+		e.ModTime == info.ModTime().UnixNano() &&
+		e.Inode == fileInode(info)
+}
+
+// NewIndexEntry records synced metadata in the index, without a stat.
+func NewIndexEntry(metadata *FileMetaData) *IndexEntry {
+	return &IndexEntry{Filename: metadata.Filename,
+		Version:       metadata.Version,
+		BlockHashList: metadata.BlockHashList,
+		Mode:          metadata.Mode,
+		FileType:      metadata.FileType,
+		SymlinkTarget: metadata.SymlinkTarget}
+}
+
+// FileMetaData returns the synced metadata of an entry.
+func (e *IndexEntry) FileMetaData() *FileMetaData {
+	return &FileMetaData{Filename: e.Filename,
+		Version:       e.Version,
+		BlockHashList: e.BlockHashList,
+		Mode:          e.Mode,
+		FileType:      e.FileType,
+		SymlinkTarget: e.SymlinkTarget}
+}
+
+// Matches reports whether a local file still has the content, type, link
+// target and, where known, the permissions recorded in the entry.
+func (e *IndexEntry) Matches(local *FileMetaData) bool {
+	return SameHashList(e.BlockHashList, local.BlockHashList) &&
+		e.FileType == local.FileType &&
+		e.SymlinkTarget == local.SymlinkTarget &&
+		(e.Mode == 0 || local.Mode == 0 || e.Mode == local.Mode)
+}
+
 // LoadMetaFromMetaFiles loads the local metadata file into a file meta map.
 // The key is the file's name and the value is the file's metadata.
 // You can use this function to load the index.txt file in this project.
 func LoadMetaFromMetaFile(baseDir string) (fileMetaMap map[string]*FileMetaData, e error) {
-	metaFilePath, _ := filepath.Abs(ConcatPath(baseDir, DEFAULT_META_FILENAME))
-
+	index, e := LoadLocalIndex(baseDir)
+	if e != nil {
+		return nil, e
+	}
 	fileMetaMap = make(map[string]*FileMetaData)
-
-	metaFileStats, e := os.Stat(metaFilePath)
-	if e != nil || metaFileStats.IsDir() {
-		return fileMetaMap, nil
+	for filename, entry := range index.Entries {
+		fileMetaMap[filename] = entry.FileMetaData()
 	}
-	metaFD, e := os.Open(metaFilePath)
-	if e != nil {
-		log.Fatal("Error When Opening Meta")
+	return fileMetaMap, nil
+}
+
+// LoadLocalIndex loads the local index of baseDir. A missing index is
+// empty, and an index in the legacy comma-separated format is migrated
+// in memory; it is rewritten in the current format on the next write.
+func LoadLocalIndex(baseDir string) (*LocalIndex, error) {
+	metaFilePath, _ := filepath.Abs(ConcatPath(baseDir, DEFAULT_META_FILENAME))
+
+	index := NewLocalIndex("")
+	content, err := ioutil.ReadFile(metaFilePath)
+	if os.IsNotExist(err) {
+		return index, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Error when reading local index: %w", err)
 	}
-	defer metaFD.Close()
 
-	leftOverContent := ""
-	metaReader := bufio.NewReader(metaFD)
-	for {
-		lineContent, isPrefix, e := metaReader.ReadLine()
-		if e != nil && e != io.EOF {
-			log.Fatal("Error During Reading Meta")
+	if len(content) == 0 || content[0] != '{' {
+		if index.Entries, err = loadLegacyIndex(metaFilePath, content); err != nil {
+			return nil, err
 		}
+		index.Legacy = true
+		return index, nil
+	}
 
-		leftOverContent += string(lineContent)
-		if isPrefix {
+	lines := strings.Split(string(content), "\n")
+	var header indexHeader
+	if err := json.Unmarshal([]byte(lines[0]), &header); err != nil || header.Format != INDEX_FORMAT_NAME {
+		return nil, fmt.Errorf("%v is not a surfstore index", metaFilePath)
+	}
+	if header.Version > INDEX_FORMAT_VERSION {
+		return nil, fmt.Errorf("%v has index version %v, newer than supported version %v",
+			metaFilePath, header.Version, INDEX_FORMAT_VERSION)
+	}
+	index.HashParams = header.HashParams
+	index.Selection = header.Selection
+	for i, line := range lines[1:] {
+		if line == "" {
 			continue
 		}
-
-		if len(leftOverContent) == 0 {
-			break
+		entry := &IndexEntry{}
+		if err := json.Unmarshal([]byte(line), entry); err != nil {
+			return nil, fmt.Errorf("%v:%d: %w", metaFilePath, i+2, err)
 		}
-
-		currFileMeta := NewFileMetaDataFromConfig(leftOverContent)
-
-		leftOverContent = ""
-		fileMetaMap[currFileMeta.Filename] = currFileMeta
+		index.Entries[entry.Filename] = entry
 	}
+	return index, nil
+}
 
-	return fileMetaMap, nil
+// loadLegacyIndex parses an index in the legacy format. A line it cannot
+// parse fails the migration rather than losing the file's entry.
+func loadLegacyIndex(path string, content []byte) (map[string]*IndexEntry, error) {
+	entries := make(map[string]*IndexEntry)
+	for i, line := range strings.Split(string(content), "\n") {
+		if len(line) == 0 {
+			continue
+		}
+		currFileMeta, err := NewFileMetaDataFromConfig(line)
+		if err != nil {
+			return nil, localIOError("migrate index", path, fmt.Errorf("line %d: %w", i+1, err))
+		}
+		entries[currFileMeta.Filename] = &IndexEntry{Filename: currFileMeta.Filename,
+			Version:       currFileMeta.Version,
+			BlockHashList: currFileMeta.BlockHashList}
+	}
+	return entries, nil
 }
 
 // FileMetaDataToString converts a FileMetaData struct
-// to a string for writing back to local metadata file
+// to a string in the legacy metadata file format
 func FileMetaDataToString(fm *FileMetaData) (result string) {
 	result += fm.Filename + ","
 	result += strconv.Itoa(int(fm.Version)) + ","
@@ -108,30 +266,247 @@ func FileMetaDataToString(fm *FileMetaData) (result string) {
 	return
 }
 
-// WriteMetaFile writes the file meta map back to local metadata file
+// WriteMetaFile writes the file meta map back to local metadata file,
+// recording the current size of each file. The hash lists were computed
+// at an unknown time, so modification times are left out and the files
+// are rehashed on the next sync.
 func WriteMetaFile(fileMetas map[string]*FileMetaData, baseDir string) error {
-	outputMetaPath := ConcatPath(baseDir, DEFAULT_META_FILENAME)
+	index := NewLocalIndex("")
+	for filename, fileMeta := range fileMetas {
+		entry := &IndexEntry{Filename: fileMeta.Filename,
+			Version:       fileMeta.Version,
+			BlockHashList: fileMeta.BlockHashList}
+		if info, err := os.Stat(ConcatPath(baseDir, filename)); err == nil {
+			entry.SetStat(info, time.Time{})
+		}
+		index.Entries[filename] = entry
+	}
+	return WriteLocalIndex(index, baseDir)
+}
+
+// WriteLocalIndex atomically replaces the local index of baseDir: the
+// entries are written to a temporary file that is synced and then renamed
+// over the old index.
+func WriteLocalIndex(index *LocalIndex, baseDir string) error {
+	filenames := make([]string, 0, len(index.Entries))
+	for filename := range index.Entries {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	header := indexHeader{Format: INDEX_FORMAT_NAME, Version: INDEX_FORMAT_VERSION, HashParams: index.HashParams}
+	if !index.Selection.Empty() {
+		header.Selection = index.Selection
+	}
+	if err := encoder.Encode(header); err != nil {
+		return err
+	}
+	for _, filename := range filenames {
+		if err := encoder.Encode(index.Entries[filename]); err != nil {
+			return err
+		}
+	}
+	return WriteFileAtomic(ConcatPath(baseDir, DEFAULT_META_FILENAME), buf.Bytes(), 0644)
+}
+
+// WriteFileAtomic replaces path with data so that readers see either the
+// old or the new content, even if the process dies midway.
+func WriteFileAtomic(path string, data []byte, perm os.FileMode) error {
+	return ReplaceFileAtomic(path, perm, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// ReplaceFileAtomic stages the content produced by write in a temporary
+// file next to path, fsyncs it and renames it over path. When write or any
+// later step fails, path is left untouched.
+func ReplaceFileAtomic(path string, perm os.FileMode, write func(w io.Writer) error) error {
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	tmp, err := ioutil.TempFile(dir, TEMP_FILE_PREFIX+base+".")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	writer := bufio.NewWriter(tmp)
+	if err := write(writer); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	return renameTempFile(tmp, path, perm)
+}
+
+// renameTempFile makes a fully written temp file durable and moves it
+// over path. The temp file is closed in every case.
+func renameTempFile(tmp *os.File, path string, perm os.FileMode) error {
+	if err := tmp.Chmod(perm); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// FilePerm returns the permissions of an existing file, or def when it
+// does not exist.
+func FilePerm(path string, def os.FileMode) os.FileMode {
+	info, err := os.Stat(path)
+	if err != nil {
+		return def
+	}
+	return info.Mode().Perm()
+}
 
-	outFD, err := os.Create(outputMetaPath)
+// syncDir makes a rename in dir durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
 	if err != nil {
-		log.Fatal("Error During Meta Write Back")
+		return err
 	}
+	defer d.Close()
+	return d.Sync()
+}
 
-	for _, fileMeta := range fileMetas {
-		_, err := outFD.WriteString(FileMetaDataToString(fileMeta))
+// IsSyncMetaFile reports whether a file in the base directory belongs to
+// the client itself and must not be synced.
+func IsSyncMetaFile(filename string) bool {
+	return filename == DEFAULT_META_FILENAME || filename == JOURNAL_FILENAME || filename == SELECTION_FILENAME ||
+		IsTempFile(filename)
+}
+
+// IsLocalFilename reports whether a remote filename can be synced to a
+// path inside the base directory: relative, clean, separated by slashes
+// and not one of the client's own files.
+func IsLocalFilename(filename string) bool {
+	return filename != "" && filename != "." && filename != ".." &&
+		!path.IsAbs(filename) && path.Clean(filename) == filename &&
+		!strings.HasPrefix(filename, "../") && !strings.Contains(filename, "\\") &&
+		!IsSyncMetaFile(filename) && !IsTempFile(path.Base(filename))
+}
+
+// IsLocalSymlinkTarget reports whether a symlink named filename with this
+// target resolves inside the base directory: the target is relative and
+// its ".." elements do not climb above the base directory.
+func IsLocalSymlinkTarget(filename string, target string) bool {
+	target = filepath.ToSlash(target)
+	if target == "" || path.IsAbs(target) || filepath.IsAbs(target) || filepath.VolumeName(target) != "" ||
+		strings.Contains(target, "\\") {
+		return false
+	}
+	resolved := path.Join(path.Dir(filename), target)
+	return resolved != ".." && !strings.HasPrefix(resolved, "../")
+}
+
+// symlinkedParent returns the first parent directory of filename that is
+// a symlink in baseDir, or "" when there is none. Whatever is written below
+// such a parent lands where the link points, possibly outside baseDir.
+func symlinkedParent(baseDir string, filename string) (string, error) {
+	parts := strings.Split(filename, "/")
+	for i := 1; i < len(parts); i++ {
+		parent := strings.Join(parts[:i], "/")
+		info, err := os.Lstat(filepath.Join(baseDir, filepath.FromSlash(parent)))
+		if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+			// created as a real directory, if at all
+			return "", nil
+		}
 		if err != nil {
-			log.Fatal("Error During Meta Write Back")
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return parent, nil
 		}
 	}
+	return "", nil
+}
+
+// IsTempFile reports whether a file was staged by ReplaceFileAtomic,
+// including index temp files left by older clients.
+func IsTempFile(filename string) bool {
+	return strings.HasPrefix(filename, TEMP_FILE_PREFIX) || strings.HasPrefix(filename, DEFAULT_META_FILENAME+TEMP_FILE_SUFFIX)
+}
 
+// RemoveTempFiles deletes temp files an interrupted client left in dir,
+// except the paths in keep.
+func RemoveTempFiles(dir string, keep map[string]bool, logger *Logger) error {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if IsTempFile(entry.Name()) && !keep[filepath.Join(dir, entry.Name())] {
+			logger.Debug("Removing stale temp file", "path", filepath.Join(dir, entry.Name()))
+			if err := RemoveIfExist(filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
+// removeEmptyDirs removes dir and its parents below baseDir for as long as
+// they are empty.
+func removeEmptyDirs(baseDir string, dir string) {
+	baseDir = filepath.Clean(baseDir)
+	for dir != baseDir && strings.HasPrefix(dir, baseDir+string(filepath.Separator)) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// IsTombstone reports whether a hash list marks a deleted file.
+func IsTombstone(blockHashList []string) bool {
+	return len(blockHashList) == 1 && blockHashList[0] == TOMBSTONE_HASH
+}
+
+// SameHashList compares two hash lists, treating nil and empty as equal.
+func SameHashList(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
 // Filesystem related
+
+// RemoveIfExist removes a file; a file that does not exist is not an error.
+// A symlink is removed itself, whether or not its target exists.
 func RemoveIfExist(filename string) error {
-	_, err := os.Stat(filename)
-	if err == nil {
-		_ = os.Remove(filename)
+	_, err := os.Lstat(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
+		return err
 	}
 	return nil
 }
@@ -139,7 +514,7 @@ func RemoveIfExist(filename string) error {
 func CloneFileMetaMap(fileMatas map[string]*FileMetaData) map[string]*FileMetaData {
 	ret := make(map[string]*FileMetaData)
 	for k, v := range fileMatas {
-		ret[k] = &FileMetaData{Filename: v.Filename, Version: v.Version, BlockHashList: v.BlockHashList}
+		ret[k] = proto.Clone(v).(*FileMetaData)
 	}
 	return ret
 }
@@ -165,11 +540,18 @@ func PrintMetaMap(metaMap map[string]*FileMetaData) {
 
 }
 
-func ComputeHashList(filepath string, blockSize int) *[]string {
+func ComputeHashList(filepath string, blockSize int) (*[]string, error) {
+	return ComputeSealedHashList(filepath, blockSize, nil)
+}
+
+// ComputeSealedHashList hashes each block in the form it is stored on the
+// BlockStore, that is after encryption when cipher is not nil.
+func ComputeSealedHashList(filepath string, blockSize int, cipher *BlockCipher) (*[]string, error) {
 	file, err := os.OpenFile(filepath, os.O_RDONLY, 0644)
 	if err != nil {
-		panic(err)
+		return nil, localIOError("open", filepath, err)
 	}
+	defer file.Close()
 
 	reader := bufio.NewReader(file)
 	buf := make([]byte, blockSize)
@@ -178,16 +560,31 @@ func ComputeHashList(filepath string, blockSize int) *[]string {
 		n, err := io.ReadFull(reader, buf)
 		if err == io.EOF || err == io.ErrUnexpectedEOF {
 			if n != 0 {
-				hash_list = append(hash_list, GetBlockHashString(buf[:n]))
+				hash_list = append(hash_list, GetBlockHashString(SealBlock(cipher, buf[:n])))
 			}
 			break
 		} else if err == nil {
-			hash_list = append(hash_list, GetBlockHashString(buf))
+			hash_list = append(hash_list, GetBlockHashString(SealBlock(cipher, buf)))
 		} else {
-			fmt.Print(n)
-			panic(err)
+			return nil, localIOError("read", filepath, err)
 		}
 	}
 
-	return &hash_list
+	return &hash_list, nil
+}
+
+// SealBlock encrypts a block when cipher is not nil.
+func SealBlock(cipher *BlockCipher, blockData []byte) []byte {
+	if cipher == nil {
+		return blockData
+	}
+	return cipher.EncryptBlock(blockData)
+}
+
+// OpenBlock decrypts a block when cipher is not nil.
+func OpenBlock(cipher *BlockCipher, blockData []byte) ([]byte, error) {
+	if cipher == nil {
+		return blockData, nil
+	}
+	return cipher.DecryptBlock(blockData)
 }
@@ -0,0 +1,207 @@
+package surfstore
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeIndexFile(t *testing.T, content string) string {
+	dir := t.TempDir()
+	if err := ioutil.WriteFile(filepath.Join(dir, DEFAULT_META_FILENAME), []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestLoadLocalIndexMigratesLegacyFormat(t *testing.T) {
+	dir := writeIndexFile(t, "a.txt,3,h1 h2 \nempty,1,\ngone,2,0 \n")
+	index, err := LoadLocalIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !index.Legacy || len(index.Entries) != 3 {
+		t.Fatalf("Legacy = %v with %d entries", index.Legacy, len(index.Entries))
+	}
+	a := index.Entries["a.txt"]
+	if a.Version != 3 || !SameHashList(a.BlockHashList, []string{"h1", "h2"}) {
+		t.Errorf("a.txt = v%d %v", a.Version, a.BlockHashList)
+	}
+	if empty := index.Entries["empty"]; len(empty.BlockHashList) != 0 {
+		t.Errorf("empty file has hashes %v", empty.BlockHashList)
+	}
+	if !IsTombstone(index.Entries["gone"].BlockHashList) {
+		t.Errorf("tombstone lost: %v", index.Entries["gone"].BlockHashList)
+	}
+
+	// rewritten in the current format
+	if err := WriteLocalIndex(index, dir); err != nil {
+		t.Fatal(err)
+	}
+	index, err = LoadLocalIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if index.Legacy || index.Entries["a.txt"].Version != 3 {
+		t.Errorf("reloaded index: Legacy = %v, a.txt = v%d", index.Legacy, index.Entries["a.txt"].Version)
+	}
+}
+
+func TestLoadLocalIndexRejectsBadLegacyLines(t *testing.T) {
+	for _, line := range []string{"a.txt", "a.txt,3", "a.txt,x,h1 ", "a.txt,-1,h1 ", ",1,h1 ", "a,b,1,h1 "} {
+		dir := writeIndexFile(t, "ok,1,h0 \n"+line+"\n")
+		_, err := LoadLocalIndex(dir)
+		if !errors.Is(err, ErrLocalIO) || !strings.Contains(err.Error(), "line 2") {
+			t.Errorf("%q: err = %v, want a local I/O error naming line 2", line, err)
+		}
+	}
+}
+
+func TestSetStatComparesWithHashTime(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "f")
+	if err := ioutil.WriteFile(path, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry := &IndexEntry{}
+	entry.SetStat(info, time.Now())
+	if !entry.StatMatches(info) {
+		t.Errorf("stat of a file hashed long after its last write not trusted")
+	}
+	// hashed in the same tick as the write, recorded an hour later
+	entry.SetStat(info, mtime.Add(time.Millisecond))
+	if entry.ModTime != 0 || entry.StatMatches(info) {
+		t.Errorf("racy stat trusted")
+	}
+	entry.SetStat(info, time.Time{})
+	if entry.StatMatches(info) {
+		t.Errorf("stat with an unknown hash time trusted")
+	}
+}
+
+func TestIsLocalSymlinkTarget(t *testing.T) {
+	cases := []struct {
+		filename, target string
+		local            bool
+	}{
+		{"link", "file", true},
+		{"link", "sub/file", true},
+		{"d/link", "../file", true},
+		{"d/link", "./x/../y", true},
+		{"link", "", false},
+		{"link", "/etc/passwd", false},
+		{"link", "../outside", false},
+		{"link", "..", false},
+		{"d/link", "../../outside", false},
+		{"link", "a/../../outside", false},
+		{"link", "..\\outside", false},
+	}
+	for _, c := range cases {
+		if got := IsLocalSymlinkTarget(c.filename, c.target); got != c.local {
+			t.Errorf("IsLocalSymlinkTarget(%q, %q) = %v", c.filename, c.target, got)
+		}
+	}
+}
+
+func TestSymlinkedParent(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.MkdirAll(filepath.Join(dir, "real", "sub"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(t.TempDir(), filepath.Join(dir, "real", "link")); err != nil {
+		t.Skip("symlinks not supported: ", err)
+	}
+	cases := map[string]string{
+		"top":               "",
+		"real/sub/file":     "",
+		"missing/dir/file":  "",
+		"real/link/file":    "real/link",
+		"real/link/sub/new": "real/link",
+	}
+	for filename, want := range cases {
+		parent, err := symlinkedParent(dir, filename)
+		if err != nil || parent != want {
+			t.Errorf("symlinkedParent(%q) = %q, %v; want %q", filename, parent, err, want)
+		}
+	}
+}
+
+func TestRemoveIfExist(t *testing.T) {
+	dir := t.TempDir()
+	if err := RemoveIfExist(filepath.Join(dir, "missing")); err != nil {
+		t.Errorf("removing a missing file: %v", err)
+	}
+	writeTestFile(t, filepath.Join(dir, "file"), "x")
+	if err := RemoveIfExist(filepath.Join(dir, "file")); err != nil {
+		t.Errorf("removing a file: %v", err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, "file")); !os.IsNotExist(err) {
+		t.Errorf("file still there: %v", err)
+	}
+	// a dangling symlink is removed, not followed
+	link := filepath.Join(dir, "link")
+	if err := os.Symlink(filepath.Join(dir, "missing"), link); err == nil {
+		if err := RemoveIfExist(link); err != nil {
+			t.Errorf("removing a dangling symlink: %v", err)
+		}
+		if _, err := os.Lstat(link); !os.IsNotExist(err) {
+			t.Errorf("dangling symlink still there: %v", err)
+		}
+	}
+	// a failed removal is reported
+	writeTestFile(t, filepath.Join(dir, "full", "file"), "x")
+	if err := RemoveIfExist(filepath.Join(dir, "full")); err == nil {
+		t.Errorf("removing a non-empty directory reported success")
+	}
+}
+
+func TestReplaceFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "file.txt")
+	writeTestFile(t, path, "old")
+	if err := os.Chmod(path, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	failed := errors.New("write failed")
+	err := ReplaceFileAtomic(path, FilePerm(path, 0644), func(w io.Writer) error {
+		io.WriteString(w, "half of the new")
+		return failed
+	})
+	if err != failed {
+		t.Errorf("ReplaceFileAtomic = %v, want the write error", err)
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != "old" {
+		t.Errorf("failed replacement left %q", content)
+	}
+
+	if err := ReplaceFileAtomic(path, FilePerm(path, 0644), func(w io.Writer) error {
+		_, err := io.WriteString(w, "new")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(path); string(content) != "new" {
+		t.Errorf("replaced file holds %q", content)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("permissions after replacement: %v, %v", info.Mode(), err)
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("temp files left behind: %v, %v", entries, err)
+	}
+}
@@ -0,0 +1,228 @@
+package surfstore
+
+import (
+	"bufio"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ignoreRule is one pattern of an ignore file, in gitignore syntax.
+type ignoreRule struct {
+	// directory of the ignore file, relative to the base directory
+	dir      string
+	segments []string
+	negate   bool
+	dirOnly  bool
+	// patterns with a slash match from dir, the others match any name below it
+	anchored bool
+}
+
+// IgnoreMatcher decides which paths a sync leaves alone. Rules come from a
+// global ignore file and from the .surfignore file of every directory;
+// deeper files take precedence, and within a file the last matching rule
+// wins. Paths are relative to the base directory and separated by slashes.
+type IgnoreMatcher struct {
+	baseDir string
+	global  []*ignoreRule
+	// rules of each directory's .surfignore, loaded on first use
+	dirs map[string][]*ignoreRule
+	// cached results for directories
+	ignoredDirs map[string]bool
+	// reports malformed patterns
+	logger *Logger
+}
+
+// NewIgnoreMatcher reads the global ignore file, if any. .surfignore files
+// in baseDir are read as paths are matched; malformed patterns are skipped
+// with a warning to logger.
+func NewIgnoreMatcher(baseDir string, globalFile string, logger *Logger) (*IgnoreMatcher, error) {
+	m := &IgnoreMatcher{baseDir: baseDir,
+		dirs:        make(map[string][]*ignoreRule),
+		ignoredDirs: make(map[string]bool),
+		logger:      logger}
+	if globalFile != "" {
+		rules, err := readIgnoreFile(globalFile, "", logger)
+		if err != nil {
+			return nil, err
+		}
+		m.global = rules
+	}
+	return m, nil
+}
+
+// DefaultGlobalIgnoreFile returns the global ignore file of the current
+// user, surfstore/ignore in the user config directory.
+func DefaultGlobalIgnoreFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "surfstore", "ignore")
+}
+
+// Ignored reports whether name, or a directory containing it, is ignored.
+// As in git, a file in an ignored directory cannot be re-included.
+func (m *IgnoreMatcher) Ignored(name string, isDir bool) (bool, error) {
+	segments := strings.Split(name, "/")
+	for i := 1; i < len(segments); i++ {
+		ignored, err := m.ignoredDir(strings.Join(segments[:i], "/"))
+		if ignored || err != nil {
+			return ignored, err
+		}
+	}
+	if isDir {
+		return m.ignoredDir(name)
+	}
+	return m.match(name, false)
+}
+
+func (m *IgnoreMatcher) ignoredDir(name string) (bool, error) {
+	if ignored, ok := m.ignoredDirs[name]; ok {
+		return ignored, nil
+	}
+	ignored, err := m.match(name, true)
+	if err != nil {
+		return false, err
+	}
+	m.ignoredDirs[name] = ignored
+	return ignored, nil
+}
+
+// match applies the rules that can see name, without looking at its parents.
+func (m *IgnoreMatcher) match(name string, isDir bool) (bool, error) {
+	ignored := matchRules(m.global, name, isDir, false)
+	segments := strings.Split(name, "/")
+	for i := 0; i < len(segments); i++ {
+		rules, err := m.dirRules(strings.Join(segments[:i], "/"))
+		if err != nil {
+			return false, err
+		}
+		ignored = matchRules(rules, name, isDir, ignored)
+	}
+	return ignored, nil
+}
+
+func (m *IgnoreMatcher) dirRules(dir string) ([]*ignoreRule, error) {
+	if rules, ok := m.dirs[dir]; ok {
+		return rules, nil
+	}
+	rules, err := readIgnoreFile(filepath.Join(m.baseDir, filepath.FromSlash(dir), IGNORE_FILENAME), dir, m.logger)
+	if err != nil {
+		return nil, localIOError("read", IGNORE_FILENAME, err)
+	}
+	m.dirs[dir] = rules
+	return rules, nil
+}
+
+func matchRules(rules []*ignoreRule, name string, isDir bool, ignored bool) bool {
+	for _, rule := range rules {
+		if rule.matches(name, isDir) {
+			ignored = !rule.negate
+		}
+	}
+	return ignored
+}
+
+func (rule *ignoreRule) matches(name string, isDir bool) bool {
+	if rule.dirOnly && !isDir {
+		return false
+	}
+	if rule.dir != "" {
+		if !strings.HasPrefix(name, rule.dir+"/") {
+			return false
+		}
+		name = name[len(rule.dir)+1:]
+	}
+	if !rule.anchored {
+		matched, _ := path.Match(rule.segments[0], path.Base(name))
+		return matched
+	}
+	return matchSegments(rule.segments, strings.Split(name, "/"))
+}
+
+// matchSegments matches a path against a pattern one segment at a time;
+// "**" matches any number of segments.
+func matchSegments(pattern []string, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		if len(pattern) == 1 {
+			// a trailing "/**" matches everything inside, not the directory
+			return len(name) > 0
+		}
+		for i := 0; i <= len(name); i++ {
+			if matchSegments(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	matched, _ := path.Match(pattern[0], name[0])
+	return matched && matchSegments(pattern[1:], name[1:])
+}
+
+// readIgnoreFile parses an ignore file; a missing file has no rules.
+func readIgnoreFile(filename string, dir string, logger *Logger) ([]*ignoreRule, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var rules []*ignoreRule
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if rule := parseIgnoreRule(scanner.Text(), dir); rule != nil {
+			rules = append(rules, rule)
+		} else if strings.TrimSpace(scanner.Text()) != "" && !strings.HasPrefix(scanner.Text(), "#") {
+			logger.Warn("Ignoring bad pattern", "pattern", scanner.Text(), "file", filename)
+		}
+	}
+	return rules, scanner.Err()
+}
+
+// parseIgnoreRule parses one line of an ignore file. It returns nil for
+// blank lines, comments and malformed patterns.
+func parseIgnoreRule(line string, dir string) *ignoreRule {
+	line = strings.TrimSuffix(line, "\r")
+	// trailing spaces are dropped unless escaped with a backslash
+	for strings.HasSuffix(line, " ") && !strings.HasSuffix(line, "\\ ") {
+		line = line[:len(line)-1]
+	}
+	if line == "" || line[0] == '#' {
+		return nil
+	}
+	rule := &ignoreRule{dir: dir}
+	if line[0] == '!' {
+		rule.negate = true
+		line = line[1:]
+	} else if strings.HasPrefix(line, "\\!") || strings.HasPrefix(line, "\\#") {
+		line = line[1:]
+	}
+	if strings.HasSuffix(line, "/") {
+		rule.dirOnly = true
+		line = strings.TrimRight(line, "/")
+	}
+	if strings.Contains(line, "/") {
+		rule.anchored = true
+		line = strings.TrimPrefix(line, "/")
+	}
+	if line == "" {
+		return nil
+	}
+	rule.segments = strings.Split(line, "/")
+	for _, segment := range rule.segments {
+		if _, err := path.Match(segment, ""); err != nil {
+			return nil
+		}
+	}
+	return rule
+}
@@ -0,0 +1,91 @@
+package surfstore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestFile(t *testing.T, path string, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIgnoreMatcher(t *testing.T) {
+	dir := t.TempDir()
+	global := filepath.Join(t.TempDir(), "ignore")
+	writeTestFile(t, global, "*.log\n")
+	writeTestFile(t, filepath.Join(dir, IGNORE_FILENAME), `# build output
+build/
+/top.txt
+*.tmp
+!keep.tmp
+docs/**/*.bak
+logs/
+!logs/important.log
+[bad
+`+"space.txt  \n")
+	writeTestFile(t, filepath.Join(dir, "sub", IGNORE_FILENAME), "!*.log\nlocal.txt\r\n")
+
+	m, err := NewIgnoreMatcher(dir, global, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		name    string
+		isDir   bool
+		ignored bool
+	}{
+		{"app.log", false, true},
+		// deeper files take precedence over the global file
+		{"sub/app.log", false, false},
+		{"build", true, true},
+		{"build/out.bin", false, true},
+		{"src/build", true, true},
+		{"build", false, false},
+		{"top.txt", false, true},
+		{"sub/top.txt", false, false},
+		{"a.tmp", false, true},
+		{"keep.tmp", false, false},
+		{"sub/keep.tmp", false, false},
+		{"docs/a.bak", false, true},
+		{"docs/x/y/a.bak", false, true},
+		{"a.bak", false, false},
+		// files in an ignored directory cannot be re-included
+		{"logs/important.log", false, true},
+		{"space.txt", false, true},
+		{"sub/local.txt", false, true},
+		{"local.txt", false, false},
+		{"[bad", false, false},
+	}
+	for _, c := range cases {
+		ignored, err := m.Ignored(c.name, c.isDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ignored != c.ignored {
+			t.Errorf("Ignored(%q, %v) = %v", c.name, c.isDir, ignored)
+		}
+	}
+}
+
+func TestParseIgnoreRule(t *testing.T) {
+	for _, line := range []string{"", "   ", "# comment", "/", "[bad"} {
+		if rule := parseIgnoreRule(line, ""); rule != nil {
+			t.Errorf("parseIgnoreRule(%q) = %+v, want nil", line, rule)
+		}
+	}
+	rule := parseIgnoreRule("\\#literal", "")
+	if rule == nil || rule.segments[0] != "#literal" || rule.negate {
+		t.Errorf("escaped # parsed as %+v", rule)
+	}
+	rule = parseIgnoreRule("!a/b/", "sub")
+	if rule == nil || !rule.negate || !rule.dirOnly || !rule.anchored || rule.dir != "sub" {
+		t.Errorf("!a/b/ parsed as %+v", rule)
+	}
+}
@@ -15,6 +15,32 @@ type MetaStoreInterface interface {
 
 	// Get the the BlockStore address
 	GetBlockStoreAddr(ctx context.Context, _ *emptypb.Empty) (*BlockStoreAddr, error)
+
+	// Get the addresses of every BlockStore of the ring
+	GetBlockStoreAddrs(ctx context.Context, _ *emptypb.Empty) (*BlockStoreAddrs, error)
+
+	// Check whether the caller may read a block
+	CheckBlockAccess(ctx context.Context, blockHash *BlockHash) (*Success, error)
+
+	// Retrieves the retained versions of a file
+	GetFileHistory(ctx context.Context, fileName *FileName) (*FileHistory, error)
+
+	// Report the storage used by the caller's namespace, or by every
+	// namespace for admins
+	GetNamespaceUsage(ctx context.Context, _ *emptypb.Empty) (*NamespaceUsageList, error)
+
+	// List the files referencing a block in the caller's namespace, or in
+	// every namespace for admins
+	GetBlockReferences(ctx context.Context, blockHash *BlockHash) (*BlockReferences, error)
+
+	// Update several files at once, all of them or none
+	CommitBatch(ctx context.Context, fileBatch *FileBatch) (*BatchResult, error)
+
+	// Update a file only when it is at the expected version or hash list
+	UpdateFileIf(ctx context.Context, update *ConditionalUpdate) (*UpdateResult, error)
+
+	// Get the salt encryption keys of the caller's namespace are derived with
+	GetNamespaceSalt(ctx context.Context, saltRequest *NamespaceSaltRequest) (*NamespaceSalt, error)
 }
 
 type BlockStoreInterface interface {
@@ -28,16 +54,30 @@ type BlockStoreInterface interface {
 	// Given a list of hashes “in”, returns a list containing the
 	// subset of in that are stored in the key-value store
 	HasBlocks(ctx context.Context, blockHashesIn *BlockHashes) (*BlockHashes, error)
+
+	// Report the blocks stored and the capacity (admin only)
+	GetBlockStoreUsage(ctx context.Context, _ *emptypb.Empty) (*BlockStoreUsage, error)
+
+	// Report the decoded size of the given blocks the caller uploaded
+	GetBlockSizes(ctx context.Context, blockHashesIn *BlockHashes) (*BlockSizes, error)
 }
 
 type ClientInterface interface {
 	// MetaStore
-	GetFileInfoMap(serverFileInfoMap *map[string]*FileMetaData) error
-	UpdateFile(fileMetaData *FileMetaData, latestVersion *int32) error
-	GetBlockStoreAddr(blockStoreAddr *string) error
+	GetFileInfoMap(ctx context.Context, serverFileInfoMap *map[string]*FileMetaData) error
+	UpdateFile(ctx context.Context, fileMetaData *FileMetaData, latestVersion *int32) error
+	CommitBatch(ctx context.Context, files []*FileMetaData, conflicts *[]*FileMetaData) error
+	UpdateFileIf(ctx context.Context, update *ConditionalUpdate, result *UpdateResult) error
+	GetNamespaceSalt(ctx context.Context, create bool, salt *[]byte) error
+	GetBlockStoreAddr(ctx context.Context, blockStoreAddr *string) error
+	GetBlockStoreAddrs(ctx context.Context, blockStoreAddrs *[]string) error
+	GetFileHistory(ctx context.Context, filename string, history *[]*FileMetaData) error
+	GetNamespaceUsage(ctx context.Context, usage *[]*NamespaceUsage) error
+	GetBlockReferences(ctx context.Context, blockHash string, refs *BlockReferences) error
 
 	// BlockStore
-	GetBlock(blockHash string, blockStoreAddr string, block *Block) error
-	PutBlock(block *Block, blockStoreAddr string, succ *bool) error
-	HasBlocks(blockHashesIn []string, blockStoreAddr string, blockHashesOut *[]string) error
+	GetBlock(ctx context.Context, blockHash string, blockStoreAddr string, block *Block) error
+	PutBlock(ctx context.Context, block *Block, blockStoreAddr string, succ *bool) error
+	HasBlocks(ctx context.Context, blockHashesIn []string, blockStoreAddr string, blockHashesOut *[]string) error
+	GetBlockStoreUsage(ctx context.Context, blockStoreAddr string, usage *BlockStoreUsage) error
 }
@@ -0,0 +1,208 @@
+package surfstore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Kinds of journal records
+const (
+	journalBegin = "begin"
+	// A change the sync is about to carry out
+	journalPlan = "plan"
+	// The MetaStore accepted an upload
+	journalCommit = "commit"
+	// Verified blocks of a download reached the disk in its temp file
+	journalProgress = "progress"
+	// A download or removal reached the local file
+	journalDone = "done"
+)
+
+type journalRecord struct {
+	Op            string       `json:"op"`
+	HashParams    string       `json:"hashParams,omitempty"`
+	Filename      string       `json:"filename,omitempty"`
+	Action        ChangeAction `json:"action,omitempty"`
+	Version       int32        `json:"version,omitempty"`
+	BlockHashList []string     `json:"blockHashList,omitempty"`
+	TempFile      string       `json:"tempFile,omitempty"`
+	Blocks        int          `json:"blocks,omitempty"`
+	Offset        int64        `json:"offset,omitempty"`
+	Mode          uint32       `json:"mode,omitempty"`
+	FileType      FileType     `json:"fileType,omitempty"`
+	SymlinkTarget string       `json:"symlinkTarget,omitempty"`
+}
+
+// completedRecord records that metadata reached both the server and the
+// local file.
+func completedRecord(op string, metadata *FileMetaData) *journalRecord {
+	return &journalRecord{Op: op, Filename: metadata.Filename, Version: metadata.Version,
+		BlockHashList: metadata.BlockHashList, Mode: metadata.Mode, FileType: metadata.FileType,
+		SymlinkTarget: metadata.SymlinkTarget}
+}
+
+// fileMetaData returns the metadata a completed record carries.
+func (rec *journalRecord) fileMetaData() *FileMetaData {
+	return &FileMetaData{Filename: rec.Filename, Version: rec.Version, BlockHashList: rec.BlockHashList,
+		Mode: rec.Mode, FileType: rec.FileType, SymlinkTarget: rec.SymlinkTarget}
+}
+
+// syncJournal is the append-only log of one sync. The next sync replays
+// the steps it records as complete, so a crash between uploading or
+// downloading a file and writing the index does not look like a conflict.
+type syncJournal struct {
+	file *os.File
+}
+
+// partialDownload is a download that stopped after some verified blocks
+// reached its temp file.
+type partialDownload struct {
+	Version       int32
+	BlockHashList []string
+	TempFile      string
+	Blocks        int
+	Offset        int64
+}
+
+// createSyncJournal starts the journal of a new sync, replacing the
+// journal of an earlier one.
+func createSyncJournal(baseDir string, hashParams string) (*syncJournal, error) {
+	f, err := os.OpenFile(filepath.Join(baseDir, JOURNAL_FILENAME), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	journal := &syncJournal{file: f}
+	if err := journal.append(&journalRecord{Op: journalBegin, HashParams: hashParams}, false); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return journal, nil
+}
+
+// append writes one record; durable records are fsynced before returning.
+// A nil journal records nothing.
+func (j *syncJournal) append(rec *journalRecord, durable bool) error {
+	if j == nil {
+		return nil
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return localIOError("journal", j.file.Name(), err)
+	}
+	if durable {
+		if err := j.file.Sync(); err != nil {
+			return localIOError("journal", j.file.Name(), err)
+		}
+	}
+	return nil
+}
+
+func (j *syncJournal) plan(change *FileChange) error {
+	rec := &journalRecord{Op: journalPlan, Filename: change.Filename, Action: change.Action, Version: change.meta.Version}
+	if change.Action != ActionUpload {
+		rec.BlockHashList = change.meta.BlockHashList
+	}
+	return j.append(rec, false)
+}
+
+func (j *syncJournal) planDownload(metadata *FileMetaData) error {
+	return j.append(&journalRecord{Op: journalPlan, Filename: metadata.Filename, Action: downloadAction(metadata),
+		Version: metadata.Version, BlockHashList: metadata.BlockHashList}, false)
+}
+
+func (j *syncJournal) commit(metadata *FileMetaData) error {
+	return j.append(completedRecord(journalCommit, metadata), true)
+}
+
+// progress records the blocks of a download in its temp file; the caller
+// has synced the temp file so the record never claims lost data.
+func (j *syncJournal) progress(metadata *FileMetaData, tempFile string, blocks int, offset int64) error {
+	return j.append(&journalRecord{Op: journalProgress, Filename: metadata.Filename, Version: metadata.Version,
+		TempFile: tempFile, Blocks: blocks, Offset: offset}, true)
+}
+
+func (j *syncJournal) done(metadata *FileMetaData) error {
+	return j.append(completedRecord(journalDone, metadata), true)
+}
+
+// close keeps the journal for the next sync.
+func (j *syncJournal) close() error {
+	return j.file.Close()
+}
+
+// remove deletes the journal once the index records the whole sync.
+func (j *syncJournal) remove() error {
+	j.file.Close()
+	return RemoveIfExist(j.file.Name())
+}
+
+// recoverSyncJournal applies the uploads and downloads an interrupted sync
+// completed to the local index, and returns its partial downloads keyed by
+// filename. Recovered entries carry no stat, so their files are rehashed;
+// their hash lists were computed with the hash parameters of the journal,
+// which the index takes over.
+func recoverSyncJournal(baseDir string, logger *Logger) (map[string]*partialDownload, error) {
+	partials := make(map[string]*partialDownload)
+	content, err := ioutil.ReadFile(filepath.Join(baseDir, JOURNAL_FILENAME))
+	if os.IsNotExist(err) {
+		return partials, nil
+	} else if err != nil {
+		return nil, err
+	}
+	index, err := LoadLocalIndex(baseDir)
+	if err != nil {
+		return nil, err
+	}
+
+	planned := make(map[string]*journalRecord)
+	hash_params := index.HashParams
+	applied := 0
+	for _, line := range strings.Split(string(content), "\n") {
+		rec := &journalRecord{}
+		if err := json.Unmarshal([]byte(line), rec); err != nil {
+			// the last record may be torn by a crash
+			break
+		}
+		switch rec.Op {
+		case journalBegin:
+			hash_params = rec.HashParams
+		case journalPlan:
+			planned[rec.Filename] = rec
+			delete(partials, rec.Filename)
+		case journalProgress:
+			if plan, ok := planned[rec.Filename]; ok && plan.Version == rec.Version {
+				partials[rec.Filename] = &partialDownload{Version: rec.Version, BlockHashList: plan.BlockHashList,
+					TempFile: rec.TempFile, Blocks: rec.Blocks, Offset: rec.Offset}
+			}
+		case journalCommit, journalDone:
+			index.Entries[rec.Filename] = NewIndexEntry(rec.fileMetaData())
+			delete(partials, rec.Filename)
+			applied++
+		}
+	}
+	if applied > 0 {
+		logger.Info("Recovered completed steps of an interrupted sync", "steps", applied)
+		if hash_params != index.HashParams {
+			// the cached hash lists of the other entries no longer apply
+			for _, entry := range index.Entries {
+				entry.ModTime = 0
+			}
+			index.HashParams = hash_params
+		}
+		if err := WriteLocalIndex(index, baseDir); err != nil {
+			return nil, err
+		}
+	}
+	for filename, partial := range partials {
+		if _, err := os.Stat(filepath.Join(baseDir, partial.TempFile)); err != nil {
+			delete(partials, filename)
+		}
+	}
+	return partials, nil
+}
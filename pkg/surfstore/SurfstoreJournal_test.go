@@ -0,0 +1,164 @@
+package surfstore
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecoverSyncJournal(t *testing.T) {
+	dir := t.TempDir()
+	index := NewLocalIndex("blockSize=4096")
+	index.Entries["up"] = NewIndexEntry(&FileMetaData{Filename: "up", Version: 1, BlockHashList: []string{"h0"}})
+	if err := WriteLocalIndex(index, dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, ".partial.tmp"), []byte("part"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	journal, err := createSyncJournal(dir, index.HashParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	up := &FileMetaData{Filename: "up", Version: 2, BlockHashList: []string{"h1"}}
+	down := &FileMetaData{Filename: "down", Version: 3, BlockHashList: []string{"h2"}}
+	planned := &FileMetaData{Filename: "planned", Version: 1, BlockHashList: []string{"h3"}}
+	partial := &FileMetaData{Filename: "partial", Version: 4, BlockHashList: []string{"h4", "h5"}}
+	lost := &FileMetaData{Filename: "lost", Version: 1, BlockHashList: []string{"h6", "h7"}}
+	steps := []error{
+		journal.plan(&FileChange{Filename: "up", Action: ActionUpload, meta: up}),
+		journal.commit(up),
+		journal.planDownload(down),
+		journal.done(down),
+		// planned but interrupted before completing
+		journal.planDownload(planned),
+		journal.planDownload(partial),
+		journal.progress(partial, ".partial.tmp", 1, 4),
+		// its temp file is gone
+		journal.planDownload(lost),
+		journal.progress(lost, ".lost.tmp", 1, 4),
+	}
+	for _, err := range steps {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a record torn by the crash
+	if _, err := journal.file.WriteString(`{"op":"done","filename":"pla`); err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	partials, err := recoverSyncJournal(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recovered, err := LoadLocalIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for filename, version := range map[string]int32{"up": 2, "down": 3} {
+		entry, ok := recovered.Entries[filename]
+		if !ok || entry.Version != version || entry.ModTime != 0 {
+			t.Errorf("entry of %v = %+v, want version %d without stat", filename, entry, version)
+		}
+	}
+	for _, filename := range []string{"planned", "partial", "lost"} {
+		if _, ok := recovered.Entries[filename]; ok {
+			t.Errorf("incomplete %v recovered into the index", filename)
+		}
+	}
+	if len(partials) != 1 {
+		t.Fatalf("partial downloads = %v, want only partial", partials)
+	}
+	if p := partials["partial"]; p == nil || p.Version != 4 || p.Blocks != 1 || p.Offset != 4 || len(p.BlockHashList) != 2 {
+		t.Errorf("partial download = %+v", p)
+	}
+}
+
+func TestRecoverSyncJournalWithoutJournal(t *testing.T) {
+	dir := t.TempDir()
+	partials, err := recoverSyncJournal(dir, nil)
+	if err != nil || len(partials) != 0 {
+		t.Fatalf("recoverSyncJournal = %v, %v", partials, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, DEFAULT_META_FILENAME)); !os.IsNotExist(err) {
+		t.Errorf("index written without a journal to recover: %v", err)
+	}
+}
+
+func TestOpenDownloadFileVerifiesPartialBlocks(t *testing.T) {
+	cipher, err := NewBlockCipher("secret", bytes.Repeat([]byte{1}, CRYPTO_SALT_SIZE), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []*BlockCipher{nil, cipher} {
+		dir := t.TempDir()
+		blocks := [][]byte{[]byte("aaaa"), []byte("bbbb"), []byte("cc")}
+		var hashes []string
+		for _, block := range blocks {
+			hashes = append(hashes, GetBlockHashString(SealBlock(c, block)))
+		}
+		metadata := &FileMetaData{Filename: "f", Version: 2, BlockHashList: hashes}
+		partial := &partialDownload{Version: 2, BlockHashList: hashes, TempFile: ".f.tmp", Blocks: 2, Offset: 8}
+
+		// bytes past the journaled blocks are dropped
+		writeTestFile(t, filepath.Join(dir, ".f.tmp"), "aaaabbbbc")
+		tmp, resumed, offset, err := openDownloadFile(dir, metadata, partial, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		info, _ := tmp.Stat()
+		tmp.Close()
+		if tmp.Name() != filepath.Join(dir, ".f.tmp") || resumed != 2 || offset != 8 || info.Size() != 8 {
+			t.Errorf("resume = %v at block %d, offset %d, size %d", tmp.Name(), resumed, offset, info.Size())
+		}
+
+		// blocks the journal claims but the disk lost
+		writeTestFile(t, filepath.Join(dir, ".f.tmp"), "aaaabbbX")
+		tmp, resumed, offset, err = openDownloadFile(dir, metadata, partial, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tmp.Close()
+		if tmp.Name() == filepath.Join(dir, ".f.tmp") || resumed != 0 || offset != 0 {
+			t.Errorf("corrupt partial download resumed from %v at block %d", tmp.Name(), resumed)
+		}
+	}
+}
+
+func TestRecoverSyncJournalTakesHashParams(t *testing.T) {
+	dir := t.TempDir()
+	index := NewLocalIndex("blockSize=4096")
+	index.Entries["old"] = &IndexEntry{Filename: "old", Version: 1, BlockHashList: []string{"h0"}, ModTime: 1, Size: 4}
+	if err := WriteLocalIndex(index, dir); err != nil {
+		t.Fatal(err)
+	}
+	journal, err := createSyncJournal(dir, "blockSize=1024")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := journal.commit(&FileMetaData{Filename: "new", Version: 1, BlockHashList: []string{"h1"}}); err != nil {
+		t.Fatal(err)
+	}
+	journal.close()
+
+	if _, err := recoverSyncJournal(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	recovered, err := LoadLocalIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recovered.HashParams != "blockSize=1024" {
+		t.Errorf("HashParams = %q, want those of the journal", recovered.HashParams)
+	}
+	if recovered.Entries["old"].ModTime != 0 {
+		t.Errorf("entry hashed with other parameters keeps its stat")
+	}
+}
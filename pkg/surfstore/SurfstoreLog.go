@@ -0,0 +1,245 @@
+package surfstore
+
+import (
+	context "context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// LogLevel is the severity of a log record.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (level LogLevel) String() string {
+	if level < LevelDebug || level > LevelError {
+		return strconv.Itoa(int(level))
+	}
+	return logLevelNames[level]
+}
+
+// ParseLogLevel parses debug, info, warn or error.
+func ParseLogLevel(s string) (LogLevel, error) {
+	for i, name := range logLevelNames {
+		if strings.EqualFold(s, name) {
+			return LogLevel(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("Unknown log level %v", s)
+}
+
+// LogFormat is how records are written: one logfmt-style text line or one
+// JSON object per record.
+type LogFormat string
+
+const (
+	LogText LogFormat = "text"
+	LogJSON LogFormat = "json"
+)
+
+// ParseLogFormat parses text or json.
+func ParseLogFormat(s string) (LogFormat, error) {
+	switch format := LogFormat(strings.ToLower(s)); format {
+	case LogText, LogJSON:
+		return format, nil
+	}
+	return LogText, fmt.Errorf("Unknown log format %v", s)
+}
+
+// Logger writes leveled records made of a message and key-value fields.
+// Loggers derived with With share the output of their parent. A nil Logger
+// discards everything, so components log unconditionally.
+type Logger struct {
+	out    *logOutput
+	level  LogLevel
+	format LogFormat
+	fields []interface{}
+}
+
+type logOutput struct {
+	lock sync.Mutex
+	w    io.Writer
+}
+
+// NewLogger returns a logger writing the records at level or above to w.
+func NewLogger(w io.Writer, level LogLevel, format LogFormat) *Logger {
+	return &Logger{out: &logOutput{w: w}, level: level, format: format}
+}
+
+// With returns a logger adding the key-value pairs to every record.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+	derived := *l
+	derived.fields = append(append([]interface{}{}, l.fields...), kv...)
+	return &derived
+}
+
+// WithContext returns a logger adding the request ID and the user of ctx,
+// when there are any.
+func (l *Logger) WithContext(ctx context.Context) *Logger {
+	var kv []interface{}
+	if id := RequestIDFromContext(ctx); id != "" {
+		kv = append(kv, "request_id", id)
+	}
+	if user, ok := UserFromContext(ctx); ok {
+		kv = append(kv, "user", user.Name)
+	}
+	if len(kv) == 0 {
+		return l
+	}
+	return l.With(kv...)
+}
+
+// Enabled reports whether records at level are written.
+func (l *Logger) Enabled(level LogLevel) bool {
+	return l != nil && level >= l.level
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+func (l *Logger) log(level LogLevel, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	fields := append(append([]interface{}{}, l.fields...), kv...)
+	if len(fields)%2 == 1 {
+		fields = append(fields, "(missing)")
+	}
+	now := time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00")
+
+	var line []byte
+	if l.format == LogJSON {
+		line = append(line, `{"time":`...)
+		line = appendJSON(line, now)
+		line = append(line, `,"level":`...)
+		line = appendJSON(line, level.String())
+		line = append(line, `,"msg":`...)
+		line = appendJSON(line, msg)
+		for i := 0; i < len(fields); i += 2 {
+			line = append(line, ',')
+			line = appendJSON(line, fmt.Sprint(fields[i]))
+			line = append(line, ':')
+			line = appendJSON(line, logValue(fields[i+1]))
+		}
+		line = append(line, '}', '\n')
+	} else {
+		line = append(line, fmt.Sprintf("%v %-5v %v", now, strings.ToUpper(level.String()), msg)...)
+		for i := 0; i < len(fields); i += 2 {
+			line = append(line, fmt.Sprintf(" %v=%v", fields[i], quoteLogText(fmt.Sprint(logValue(fields[i+1]))))...)
+		}
+		line = append(line, '\n')
+	}
+
+	l.out.lock.Lock()
+	defer l.out.lock.Unlock()
+	l.out.w.Write(line)
+}
+
+// logValue turns errors, durations and other Stringers into strings so
+// that both formats show them the same way.
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func appendJSON(line []byte, v interface{}) []byte {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		encoded, _ = json.Marshal(fmt.Sprint(v))
+	}
+	return append(line, encoded...)
+}
+
+func quoteLogText(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+type requestIDContextKey struct{}
+
+// NewRequestID returns a random request ID.
+func NewRequestID() string {
+	id := make([]byte, REQUEST_ID_BYTES)
+	if _, err := rand.Read(id); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(id)
+}
+
+// WithRequestID attaches a request ID to ctx. The client sends it with
+// every RPC made under ctx, and servers log it with the calls it caused.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, id)
+}
+
+// RequestIDFromContext returns the request ID of ctx, or "".
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+// outgoingRequestID forwards the request ID of ctx to the server called with it.
+func outgoingRequestID(ctx context.Context) context.Context {
+	if id := RequestIDFromContext(ctx); id != "" {
+		return metadata.AppendToOutgoingContext(ctx, REQUEST_ID_METADATA_KEY, id)
+	}
+	return ctx
+}
+
+// LoggingInterceptor attaches the caller's request ID, or a new one, to the
+// context of every call and logs the call once it returns: failed calls
+// as warnings, the others at debug level.
+func LoggingInterceptor(logger *Logger) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		id := ""
+		if md, ok := metadata.FromIncomingContext(ctx); ok {
+			if values := md.Get(REQUEST_ID_METADATA_KEY); len(values) > 0 && len(values[0]) <= MAX_REQUEST_ID_LENGTH {
+				id = values[0]
+			}
+		}
+		if id == "" {
+			id = NewRequestID()
+		}
+		ctx = WithRequestID(ctx, id)
+
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		fields := []interface{}{"method", info.FullMethod, "request_id", id, "duration", time.Since(start)}
+		if err != nil {
+			logger.Warn("RPC failed", append(fields, "code", status.Code(err), "error", err)...)
+		} else {
+			logger.Debug("RPC", fields...)
+		}
+		return resp, err
+	}
+}
@@ -0,0 +1,132 @@
+package surfstore
+
+import (
+	"bytes"
+	context "context"
+	"encoding/json"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestParseLogLevelAndFormat(t *testing.T) {
+	for name, want := range map[string]LogLevel{"debug": LevelDebug, "INFO": LevelInfo, "Warn": LevelWarn, "error": LevelError} {
+		if level, err := ParseLogLevel(name); err != nil || level != want {
+			t.Errorf("ParseLogLevel(%v) = %v, %v", name, level, err)
+		}
+	}
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Errorf("unknown level accepted")
+	}
+	if format, err := ParseLogFormat("JSON"); err != nil || format != LogJSON {
+		t.Errorf("ParseLogFormat(JSON) = %v, %v", format, err)
+	}
+	if _, err := ParseLogFormat("xml"); err == nil {
+		t.Errorf("unknown format accepted")
+	}
+}
+
+func TestLoggerText(t *testing.T) {
+	var out bytes.Buffer
+	logger := NewLogger(&out, LevelInfo, LogText).With("component", "test")
+	logger.Debug("hidden")
+	logger.Info("Stored", "file", "my file.txt", "size", 3, "odd")
+	logger.Warn("Failed", "error", errors.New("no luck"), "took", 1500*time.Millisecond)
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("logged %q", out.String())
+	}
+	if !strings.Contains(lines[0], " INFO  Stored component=test file=\"my file.txt\" size=3 odd=(missing)") {
+		t.Errorf("info line = %q", lines[0])
+	}
+	if !strings.Contains(lines[1], " WARN  Failed component=test error=\"no luck\" took=1.5s") {
+		t.Errorf("warn line = %q", lines[1])
+	}
+
+	var none *Logger
+	none.With("a", 1).WithContext(WithRequestID(context.Background(), "id")).Error("discarded")
+	if none.Enabled(LevelError) {
+		t.Errorf("nil logger enabled")
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	var out bytes.Buffer
+	ctx := WithRequestID(namespaceContext("alice"), "req-1")
+	NewLogger(&out, LevelDebug, LogJSON).WithContext(ctx).Debug("Quoted \"msg\"", "count", 2, "error", errors.New("bad"))
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(out.Bytes(), &record); err != nil {
+		t.Fatalf("record %q: %v", out.String(), err)
+	}
+	want := map[string]interface{}{"level": "debug", "msg": "Quoted \"msg\"", "request_id": "req-1", "user": "alice",
+		"count": float64(2), "error": "bad"}
+	for key, value := range want {
+		if record[key] != value {
+			t.Errorf("%v = %v, want %v", key, record[key], value)
+		}
+	}
+	if _, err := time.Parse(time.RFC3339, record["time"].(string)); err != nil {
+		t.Errorf("time %v: %v", record["time"], err)
+	}
+}
+
+func TestLoggingInterceptorTakesTheRequestID(t *testing.T) {
+	var out bytes.Buffer
+	intercept := LoggingInterceptor(NewLogger(&out, LevelDebug, LogJSON))
+	var seen string
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		seen = RequestIDFromContext(ctx)
+		return nil, nil
+	}
+	info := &grpc.UnaryServerInfo{FullMethod: "/surfstore.MetaStore/GetFileInfoMap"}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(REQUEST_ID_METADATA_KEY, "req-1"))
+	intercept(ctx, nil, info, handler)
+	if seen != "req-1" || !strings.Contains(out.String(), `"request_id":"req-1"`) {
+		t.Errorf("request ID of the caller: handler saw %q, logged %q", seen, out.String())
+	}
+	long := strings.Repeat("x", MAX_REQUEST_ID_LENGTH+1)
+	intercept(metadata.NewIncomingContext(context.Background(), metadata.Pairs(REQUEST_ID_METADATA_KEY, long)), nil, info, handler)
+	if seen == long || seen == "" {
+		t.Errorf("request ID of %d bytes kept as %q", len(long), seen)
+	}
+}
+
+func TestSyncLogsRequestIDsButNoBlockData(t *testing.T) {
+	var server_log, client_log bytes.Buffer
+	addr, _, _ := serveSurfstore(t, grpc.UnaryInterceptor(LoggingInterceptor(NewLogger(&server_log, LevelDebug, LogJSON))))
+	dir := t.TempDir()
+	const payload = "block payload that must stay out of logs"
+	writeTestFile(t, filepath.Join(dir, "secret.txt"), payload)
+	client := newTestClient(t, addr, dir)
+	client.Logger = NewLogger(&client_log, LevelDebug, LogJSON)
+
+	if _, err := ClientSync(WithRequestID(context.Background(), "sync-1"), client); err != nil {
+		t.Fatal(err)
+	}
+	records := strings.Split(strings.TrimSuffix(server_log.String(), "\n"), "\n")
+	if len(records) < 3 {
+		t.Fatalf("server logged %q", server_log.String())
+	}
+	for _, line := range records {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil || record["request_id"] != "sync-1" {
+			t.Errorf("server record without the request ID of the sync: %v", line)
+		}
+	}
+	if !strings.Contains(client_log.String(), `"request_id":"sync-1"`) {
+		t.Errorf("client records lack the request ID: %q", client_log.String())
+	}
+	for _, log := range []string{server_log.String(), client_log.String()} {
+		if strings.Contains(log, payload) {
+			t.Errorf("block data logged: %q", log)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package surfstore
+
+import (
+	context "context"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Metrics collects the Prometheus metrics of one server process: every
+// RPC through UnaryInterceptor, plus the state of the stores registered
+// with it, read when the metrics are scraped.
+type Metrics struct {
+	Registry *prometheus.Registry
+	requests *prometheus.CounterVec
+	latency  *prometheus.HistogramVec
+	inFlight prometheus.Gauge
+}
+
+// NewMetrics returns metrics holding the RPC and Go runtime collectors.
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		Registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE, Name: "rpc_requests_total",
+			Help: "RPCs handled, by method and gRPC status code.",
+		}, []string{"method", "code"}),
+		latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: METRICS_NAMESPACE, Name: "rpc_duration_seconds",
+			Help:    "Time spent handling RPCs, by method.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+		}, []string{"method"}),
+		inFlight: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE, Name: "rpc_in_flight",
+			Help: "RPCs being handled.",
+		}),
+	}
+	m.Registry.MustRegister(m.requests, m.latency, m.inFlight,
+		collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+	return m
+}
+
+// UnaryInterceptor counts and times every call. Calls rejected by later
+// interceptors, such as authentication, are counted with their code.
+func (m *Metrics) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	m.inFlight.Inc()
+	defer m.inFlight.Dec()
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	m.latency.WithLabelValues(info.FullMethod).Observe(time.Since(start).Seconds())
+	m.requests.WithLabelValues(info.FullMethod, status.Code(err).String()).Inc()
+	return resp, err
+}
+
+// RegisterBlockStore exports the blocks and bytes a BlockStore holds and
+// its capacity.
+func (m *Metrics) RegisterBlockStore(bs *BlockStore) {
+	m.Registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE, Subsystem: "blockstore", Name: "blocks",
+			Help: "Blocks stored.",
+		}, func() float64 { return float64(bs.Stats().Blocks) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE, Subsystem: "blockstore", Name: "stored_bytes",
+			Help: "Bytes of block data stored, as sent by the clients.",
+		}, func() float64 { return float64(bs.Stats().Bytes) }))
+}
+
+// RegisterMetaStore exports the files, updates and block store ring of a
+// MetaStore.
+func (m *Metrics) RegisterMetaStore(ms *MetaStore) {
+	m.Registry.MustRegister(
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: METRICS_NAMESPACE, Subsystem: "metastore", Name: "files",
+			Help: "Current files in every namespace, deleted files excluded.",
+		}, func() float64 { return float64(ms.Stats().Files) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE, Subsystem: "metastore", Name: "updates_total",
+			Help: "File versions published by UpdateFile or CommitBatch.",
+		}, func() float64 { return float64(ms.Stats().Updates) }),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: METRICS_NAMESPACE, Subsystem: "metastore", Name: "rejected_updates_total",
+			Help: "File updates rejected because of a version conflict.",
+		}, func() float64 { return float64(ms.Stats().Rejected) }),
+		&ringCollector{ms: ms, desc: prometheus.NewDesc(prometheus.BuildFQName(METRICS_NAMESPACE, "ring", "member"),
+			"Block stores in the ring of the MetaStore, one series per address.", []string{"addr"}, nil)})
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.Registry, promhttp.HandlerOpts{})
+}
+
+// ringCollector reports the ring as it is when scraped, since members
+// may change while the server runs.
+type ringCollector struct {
+	ms   *MetaStore
+	desc *prometheus.Desc
+}
+
+func (c *ringCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *ringCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, addr := range c.ms.BlockStoreAddrs() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, 1, addr)
+	}
+}
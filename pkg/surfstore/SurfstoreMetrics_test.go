@@ -0,0 +1,120 @@
+package surfstore
+
+import (
+	context "context"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	dto "github.com/prometheus/client_model/go"
+	grpc "google.golang.org/grpc"
+)
+
+// metricValue returns the value of the series of a gathered metric with
+// the given labels, and whether there is one.
+func metricValue(t *testing.T, metrics *Metrics, name string, labels map[string]string) (float64, bool) {
+	families, err := metrics.Registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+	series:
+		for _, metric := range family.GetMetric() {
+			for _, pair := range metric.GetLabel() {
+				if value, ok := labels[pair.GetName()]; ok && value != pair.GetValue() {
+					continue series
+				}
+			}
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				return metric.GetCounter().GetValue(), true
+			case dto.MetricType_GAUGE:
+				return metric.GetGauge().GetValue(), true
+			case dto.MetricType_HISTOGRAM:
+				return float64(metric.GetHistogram().GetSampleCount()), true
+			}
+		}
+	}
+	return 0, false
+}
+
+func TestMetricsFollowTheStores(t *testing.T) {
+	metrics := NewMetrics()
+	addr, m, bs := serveSurfstore(t, grpc.UnaryInterceptor(metrics.UnaryInterceptor))
+	metrics.RegisterMetaStore(m)
+	metrics.RegisterBlockStore(bs)
+
+	dir := t.TempDir()
+	writeTestFile(t, filepath.Join(dir, "a.txt"), strings.Repeat("a", 1500))
+	if _, err := ClientSync(context.Background(), newTestClient(t, addr, dir)); err != nil {
+		t.Fatal(err)
+	}
+	// a second update of version 1 is a conflict
+	stale := &FileMetaData{Filename: "a.txt", Version: 1, BlockHashList: []string{GetBlockHashString([]byte("x"))}}
+	m.UpdateFile(context.Background(), stale)
+
+	put := map[string]string{"method": "/surfstore.BlockStore/PutBlock", "code": "OK"}
+	want := []struct {
+		name   string
+		labels map[string]string
+		value  float64
+	}{
+		{"surfstore_rpc_requests_total", put, 2},
+		{"surfstore_rpc_duration_seconds", put, 2},
+		{"surfstore_rpc_in_flight", nil, 0},
+		{"surfstore_blockstore_blocks", nil, 2},
+		{"surfstore_blockstore_stored_bytes", nil, 1500},
+		{"surfstore_metastore_files", nil, 1},
+		{"surfstore_metastore_updates_total", nil, 1},
+		{"surfstore_metastore_rejected_updates_total", nil, 1},
+		{"surfstore_ring_member", map[string]string{"addr": addr}, 1},
+	}
+	for _, w := range want {
+		if value, ok := metricValue(t, metrics, w.name, w.labels); !ok || value != w.value {
+			t.Errorf("%v%v = %v (found %v), want %v", w.name, w.labels, value, ok, w.value)
+		}
+	}
+
+	m.SetBlockStoreAddrs([]string{"localhost:1", "localhost:2"})
+	if _, ok := metricValue(t, metrics, "surfstore_ring_member", map[string]string{"addr": addr}); ok {
+		t.Errorf("ring still lists %v after it changed", addr)
+	}
+	if value, ok := metricValue(t, metrics, "surfstore_ring_member", map[string]string{"addr": "localhost:2"}); !ok || value != 1 {
+		t.Errorf("new ring member not reported")
+	}
+
+	server := httptest.NewServer(metrics.Handler())
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(body), "surfstore_metastore_files 1\n") || !strings.Contains(string(body), "go_goroutines") {
+		t.Errorf("exposition lacks the metrics:\n%s", body)
+	}
+}
+
+func TestMetricsCountRejectedCalls(t *testing.T) {
+	metrics := NewMetrics()
+	auth := &Authenticator{users: map[string]*User{"ta": {Name: "alice", Namespace: "alice"}}}
+	info := &grpc.UnaryServerInfo{FullMethod: "/surfstore.MetaStore/GetFileInfoMap"}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) { return nil, nil }
+	// the order of the server's interceptor chain
+	metrics.UnaryInterceptor(context.Background(), nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return auth.UnaryInterceptor(ctx, req, info, handler)
+	})
+	rejected := map[string]string{"method": info.FullMethod, "code": "Unauthenticated"}
+	if value, ok := metricValue(t, metrics, "surfstore_rpc_requests_total", rejected); !ok || value != 1 {
+		t.Errorf("rejected calls = %v, %v", value, ok)
+	}
+}
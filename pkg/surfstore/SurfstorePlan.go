@@ -0,0 +1,497 @@
+package surfstore
+
+import (
+	context "context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// ChangeStatus says why a file differs between the client and the server.
+type ChangeStatus string
+
+const (
+	// Local changes since the last sync, pushed to the server
+	StatusAdded    ChangeStatus = "added"
+	StatusModified ChangeStatus = "modified"
+	StatusDeleted  ChangeStatus = "deleted"
+	// Remote changes to a file that is unchanged locally
+	StatusStale ChangeStatus = "stale"
+	// Local and remote changes to the same file; the remote version wins
+	StatusConflict ChangeStatus = "conflict"
+	// An unmodified local file that is no longer selected
+	StatusUnselected ChangeStatus = "unselected"
+)
+
+// ChangeAction is what a sync does about a change.
+type ChangeAction string
+
+const (
+	ActionUpload   ChangeAction = "upload"
+	ActionDownload ChangeAction = "download"
+	ActionRemove   ChangeAction = "remove"
+)
+
+// FileChange is one planned operation of a sync.
+type FileChange struct {
+	Filename string       `json:"filename"`
+	Status   ChangeStatus `json:"status"`
+	Action   ChangeAction `json:"action"`
+	// Version recorded in the local index, 0 for files never synced
+	LocalVersion int32 `json:"localVersion"`
+	// Version on the server, 0 for files the server does not know
+	RemoteVersion int32 `json:"remoteVersion"`
+	Blocks        int   `json:"blocks"`
+	// Bytes to transfer; for downloads an upper bound from the block count
+	Bytes int64 `json:"bytes"`
+
+	// metadata to upload, or remote metadata to download
+	meta *FileMetaData
+}
+
+// SyncPlan is the difference between the base directory, the local index
+// and the server, computed without changing any of them.
+type SyncPlan struct {
+	BaseDir   string        `json:"baseDir"`
+	Changes   []*FileChange `json:"changes"`
+	Unchanged []string      `json:"unchanged"`
+	// Paths matched by ignore rules; directories end with a slash
+	Ignored []string `json:"ignored"`
+	// Selected part of the namespace, nil for all of it
+	Selection *Selection `json:"selection,omitempty"`
+
+	index      *LocalIndex
+	hashParams string
+	blockSize  int
+	localStats map[string]os.FileInfo
+	// taken before the scan stats and hashes any file
+	scanned time.Time
+	// directory entries the scan left alone
+	skipped    map[string]bool
+	ignores    *IgnoreMatcher
+	ignoredSet map[string]bool
+	selection  *Selection
+	// directories holding indexed files, which are scanned even when unselected
+	indexedDirs map[string]bool
+	// directories the scan visited, relative to BaseDir
+	dirs     []string
+	symlinks SymlinkPolicy
+	remote   map[string]*FileMetaData
+	ring     *ConsistentHashRing
+	// metadata of files that need no transfer, recorded in the new index
+	final  map[string]*FileMetaData
+	logger *Logger
+}
+
+// PlanSync scans the base directory and the server and works out what
+// ClientSync would do. It only reads local files and calls read-only RPCs.
+func PlanSync(ctx context.Context, client RPCClient) (*SyncPlan, error) {
+	// Read metadata from index.txt
+	local_index, err := LoadLocalIndex(client.BaseDir)
+	if err != nil {
+		return nil, localIOError("load index", client.BaseDir, err)
+	}
+
+	plan := &SyncPlan{
+		BaseDir:    client.BaseDir,
+		Changes:    []*FileChange{},
+		Unchanged:  []string{},
+		Ignored:    []string{},
+		ignoredSet: make(map[string]bool),
+		index:      local_index,
+		hashParams: indexHashParams(client),
+		blockSize:  client.BlockSize,
+		localStats: make(map[string]os.FileInfo),
+		scanned:    time.Now(),
+		skipped:    make(map[string]bool),
+		symlinks:   client.Symlinks,
+		final:      make(map[string]*FileMetaData),
+		logger:     client.Logger.WithContext(ctx),
+	}
+	if local_index.Legacy {
+		plan.logger.Info("Migrating legacy local index", "base_dir", client.BaseDir)
+	}
+
+	plan.selection, err = LoadSelection(client.BaseDir)
+	if err != nil {
+		return nil, localIOError("load selection", client.BaseDir, err)
+	}
+	if !plan.selection.Empty() {
+		plan.Selection = plan.selection
+	}
+	if plan.selection.String() != local_index.Selection.String() {
+		plan.logger.Info("Selection changed", "from", local_index.Selection, "to", plan.selection)
+	}
+	plan.indexedDirs = make(map[string]bool)
+	for filename := range local_index.Entries {
+		for dir := path.Dir(filename); dir != "."; dir = path.Dir(dir) {
+			plan.indexedDirs[dir] = true
+		}
+	}
+
+	ignores, err := NewIgnoreMatcher(client.BaseDir, client.IgnoreFile, plan.logger)
+	if err != nil {
+		return nil, localIOError("read", client.IgnoreFile, err)
+	}
+	plan.ignores = ignores
+
+	// Scan base directory, only rehashing files whose stat changed
+	trust_stat := !client.Paranoid && local_index.HashParams == plan.hashParams
+	local_files := make(map[string]*FileMetaData)
+	if err := plan.scanDir(ctx, client, "", trust_stat, local_files); err != nil {
+		return nil, err
+	}
+
+	// Check if there is any new added/changed/deleted file
+	// Otherwise, the filemeta.version will increment by 1
+	updated := make(map[string]*FileChange)
+	unchanged := make(map[string]*FileMetaData)
+	for filename, entry := range local_index.Entries {
+		if skip, err := plan.leftAlone(filename); err != nil {
+			return nil, err
+		} else if skip {
+			continue
+		}
+		if !plan.selection.Selected(filename) {
+			plan.unselect(entry, local_files[filename])
+			continue
+		}
+		local_meta, ok := local_files[filename]
+		if !ok {
+			if IsTombstone(entry.BlockHashList) {
+				unchanged[filename] = entry.FileMetaData()
+				continue
+			}
+			plan.logger.Debug("Deleted since the last sync", "file", filename)
+			updated[filename] = &FileChange{Status: StatusDeleted,
+				meta: &FileMetaData{Filename: filename, Version: entry.Version + 1, BlockHashList: []string{TOMBSTONE_HASH}}}
+		} else if !entry.Matches(local_meta) {
+			plan.logger.Debug("Changed since the last sync", "file", filename)
+			status := StatusModified
+			if IsTombstone(entry.BlockHashList) {
+				status = StatusAdded
+			}
+			local_meta.Version = entry.Version + 1
+			updated[filename] = &FileChange{Status: status, meta: local_meta}
+		} else {
+			plan.logger.Debug("Unchanged since the last sync", "file", filename)
+			unchanged[filename] = entry.FileMetaData()
+		}
+	}
+	for filename, local_meta := range local_files {
+		if _, ok := local_index.Entries[filename]; !ok {
+			plan.logger.Debug("Added since the last sync", "file", filename)
+			local_meta.Version = 1
+			updated[filename] = &FileChange{Status: StatusAdded, meta: local_meta}
+		}
+	}
+
+	// Get remote filemap
+	plan.remote = make(map[string]*FileMetaData)
+	if err := client.GetFileInfoMap(ctx, &plan.remote); err != nil {
+		return nil, err
+	}
+	if plan.ring, err = getBlockStoreRing(ctx, client); err != nil {
+		return nil, err
+	}
+
+	// Compare every remote file with the local state
+	for filename, remote_meta := range plan.remote {
+		if !IsLocalFilename(filename) {
+			plan.logger.Warn("Skipping remote file outside the base directory", "file", filename)
+			continue
+		}
+		if parent := plan.remoteSymlinkParent(filename); parent != "" {
+			plan.logger.Warn("Skipping remote file below a remote symlink", "file", filename, "symlink", parent)
+			continue
+		}
+		if parent, err := symlinkedParent(client.BaseDir, filename); err != nil {
+			return nil, localIOError("stat", filepath.Join(client.BaseDir, filepath.FromSlash(filename)), err)
+		} else if parent != "" {
+			plan.logger.Warn("Skipping remote file below a local symlink", "file", filename, "symlink", parent)
+			continue
+		}
+		if !plan.selection.Selected(filename) {
+			continue
+		}
+		skip, err := plan.leftAlone(filename)
+		if err != nil {
+			return nil, err
+		}
+		if skip {
+			// keep what the index knew about a file left alone
+			if entry, ok := local_index.Entries[filename]; ok {
+				plan.final[filename] = entry.FileMetaData()
+			}
+			continue
+		}
+		if IsSymlink(remote_meta) && !IsTombstone(remote_meta.BlockHashList) {
+			// links are only created where the user asked for them, and
+			// only when they stay inside the base directory
+			if client.Symlinks != SymlinkPreserve {
+				continue
+			}
+			if !IsLocalSymlinkTarget(filename, remote_meta.SymlinkTarget) {
+				plan.logger.Warn("Skipping remote symlink pointing outside the base directory", "file", filename,
+					"target", remote_meta.SymlinkTarget)
+				continue
+			}
+		}
+		change, local_changed := updated[filename]
+		if local_changed {
+			if change.meta.Version == remote_meta.Version+1 {
+				plan.addChange(change, ActionUpload, remote_meta)
+			} else {
+				plan.logger.Info("Local change conflicts with a newer remote version", "file", filename,
+					"local_version", change.meta.Version, "remote_version", remote_meta.Version)
+				plan.addChange(&FileChange{Status: StatusConflict, meta: remote_meta}, downloadAction(remote_meta), remote_meta)
+			}
+			continue
+		}
+
+		unchanged_meta, ok := unchanged[filename]
+		_, exists := local_files[filename]
+		if ok && unchanged_meta.Version >= remote_meta.Version {
+			plan.logger.Debug("Remote file is identical to local", "file", filename)
+			plan.final[filename] = remote_meta
+			if !IsTombstone(remote_meta.BlockHashList) {
+				plan.Unchanged = append(plan.Unchanged, filename)
+			}
+		} else if !exists && IsTombstone(remote_meta.BlockHashList) {
+			// deleted remotely before this client ever saw it
+			plan.final[filename] = remote_meta
+		} else {
+			plan.logger.Debug("Local file is missing or stale", "file", filename, "remote_version", remote_meta.Version)
+			plan.addChange(&FileChange{Status: StatusStale, meta: remote_meta}, downloadAction(remote_meta), remote_meta)
+		}
+	}
+
+	// Local changes to files the server does not know yet
+	for filename, change := range updated {
+		if _, ok := plan.remote[filename]; ok {
+			continue
+		}
+		if change.Status == StatusDeleted {
+			// never reached the server, nothing to delete
+			continue
+		}
+		plan.logger.Debug("New file unknown to the server", "file", filename)
+		plan.addChange(change, ActionUpload, nil)
+	}
+
+	sort.Slice(plan.Changes, func(i, j int) bool { return plan.Changes[i].Filename < plan.Changes[j].Filename })
+	sort.Strings(plan.Unchanged)
+	sort.Strings(plan.Ignored)
+	return plan, nil
+}
+
+// scanDir describes the files below the directory dir of the base
+// directory, leaving out ignored paths.
+func (plan *SyncPlan) scanDir(ctx context.Context, client RPCClient, dir string, trust_stat bool,
+	local_files map[string]*FileMetaData) error {
+	entries, err := ioutil.ReadDir(filepath.Join(client.BaseDir, filepath.FromSlash(dir)))
+	if err != nil {
+		return localIOError("scan", filepath.Join(client.BaseDir, dir), err)
+	}
+	plan.dirs = append(plan.dirs, filepath.FromSlash(dir))
+	for _, file := range entries {
+		if (dir == "" && IsSyncMetaFile(file.Name())) || IsTempFile(file.Name()) {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := file.Name()
+		if dir != "" {
+			name = dir + "/" + name
+		}
+		path := filepath.Join(client.BaseDir, filepath.FromSlash(name))
+		ignored, err := plan.ignores.Ignored(name, file.IsDir())
+		if err != nil {
+			return err
+		}
+		if ignored {
+			plan.logger.Debug("Ignoring", "path", name)
+			plan.ignore(name, file.IsDir())
+			continue
+		}
+		if file.IsDir() {
+			if !plan.selection.mayContain(name) && !plan.indexedDirs[name] {
+				continue
+			}
+			if err := plan.scanDir(ctx, client, name, trust_stat, local_files); err != nil {
+				return err
+			}
+			continue
+		}
+
+		entry, ok := plan.index.Entries[name]
+		if !ok && !plan.selection.Selected(name) {
+			// left alone; indexed files are described to see if they can be removed
+			continue
+		}
+		policy := client.Symlinks
+		if ok && entry.FileType == FileType_FILE_TYPE_SYMLINK {
+			// links created by a sync stay links
+			policy = SymlinkPreserve
+		}
+		info, synced := localFileInfo(path, file, policy)
+		if !synced {
+			plan.logger.Debug("Leaving alone", "path", name)
+			plan.skipped[name] = true
+			continue
+		}
+		plan.localStats[name] = info
+		local_meta, err := localFileMetaData(path, name, info)
+		if err != nil {
+			return localIOError("stat", path, err)
+		}
+		local_files[name] = local_meta
+		if IsSymlink(local_meta) {
+			continue
+		}
+		if trust_stat && ok && entry.StatMatches(info) {
+			local_meta.BlockHashList = entry.BlockHashList
+			continue
+		}
+		hash_list, err := ComputeSealedHashList(path, client.BlockSize, client.Cipher)
+		if err != nil {
+			return err
+		}
+		local_meta.BlockHashList = *hash_list
+	}
+	return nil
+}
+
+// remoteSymlinkParent returns the first parent directory of filename that
+// is a symlink on the server, or "" when there is none.
+func (plan *SyncPlan) remoteSymlinkParent(filename string) string {
+	for dir := path.Dir(filename); dir != "."; dir = path.Dir(dir) {
+		if remote_meta, ok := plan.remote[dir]; ok && IsSymlink(remote_meta) && !IsTombstone(remote_meta.BlockHashList) {
+			return dir
+		}
+	}
+	return ""
+}
+
+// unselect plans the removal of a local file that is no longer selected.
+// Modified files are kept and simply stop being synced.
+func (plan *SyncPlan) unselect(entry *IndexEntry, local_meta *FileMetaData) {
+	if local_meta == nil || IsTombstone(entry.BlockHashList) {
+		return
+	}
+	if !entry.Matches(local_meta) {
+		plan.logger.Info("Keeping unselected file changed locally", "file", entry.Filename)
+		return
+	}
+	meta := &FileMetaData{Filename: entry.Filename, Version: entry.Version, BlockHashList: []string{TOMBSTONE_HASH}}
+	plan.addChange(&FileChange{Status: StatusUnselected, meta: meta}, ActionRemove, nil)
+}
+
+// leftAlone reports whether a sync must not touch filename, because the
+// scan skipped it or it is ignored. Ignored files are recorded in the plan.
+func (plan *SyncPlan) leftAlone(filename string) (bool, error) {
+	if plan.skipped[filename] {
+		return true, nil
+	}
+	ignored, err := plan.ignores.Ignored(filename, false)
+	if err != nil {
+		return false, err
+	}
+	if ignored {
+		plan.ignore(filename, false)
+	}
+	return ignored, nil
+}
+
+// ignore records an ignored path; directories end with a slash.
+func (plan *SyncPlan) ignore(name string, isDir bool) {
+	plan.skipped[name] = true
+	if isDir {
+		name += "/"
+	}
+	if !plan.ignoredSet[name] {
+		plan.ignoredSet[name] = true
+		plan.Ignored = append(plan.Ignored, name)
+	}
+}
+
+func (plan *SyncPlan) addChange(change *FileChange, action ChangeAction, remote_meta *FileMetaData) {
+	plan.describeChange(change, action, remote_meta)
+	plan.Changes = append(plan.Changes, change)
+}
+
+// describeChange fills in the fields of a change from its metadata.
+func (plan *SyncPlan) describeChange(change *FileChange, action ChangeAction, remote_meta *FileMetaData) {
+	change.Filename = change.meta.Filename
+	change.Action = action
+	if entry, ok := plan.index.Entries[change.Filename]; ok {
+		change.LocalVersion = entry.Version
+	}
+	if remote_meta != nil {
+		change.RemoteVersion = remote_meta.Version
+	}
+	if !IsTombstone(change.meta.BlockHashList) {
+		change.Blocks = len(change.meta.BlockHashList)
+	}
+	if IsTombstone(change.meta.BlockHashList) || IsSymlink(change.meta) {
+		change.Bytes = 0
+	} else if info, ok := plan.localStats[change.Filename]; ok && action == ActionUpload {
+		change.Bytes = info.Size()
+	} else {
+		change.Bytes = int64(change.Blocks) * int64(plan.blockSize)
+	}
+}
+
+func downloadAction(remote_meta *FileMetaData) ChangeAction {
+	if IsTombstone(remote_meta.BlockHashList) {
+		return ActionRemove
+	}
+	return ActionDownload
+}
+
+// Empty reports whether the plan changes nothing.
+func (plan *SyncPlan) Empty() bool {
+	return len(plan.Changes) == 0
+}
+
+// WriteText prints the plan for humans.
+func (plan *SyncPlan) WriteText(w io.Writer) error {
+	if plan.Empty() {
+		if _, err := fmt.Fprintf(w, "%v is up to date (%d files)\n", plan.BaseDir, len(plan.Unchanged)); err != nil {
+			return err
+		}
+	} else if _, err := fmt.Fprintf(w, "%v: %d changes, %d files unchanged\n", plan.BaseDir, len(plan.Changes), len(plan.Unchanged)); err != nil {
+		return err
+	}
+	if plan.Selection != nil {
+		if _, err := fmt.Fprintf(w, "  selection: %v\n", plan.Selection); err != nil {
+			return err
+		}
+	}
+	for _, change := range plan.Changes {
+		if _, err := fmt.Fprintf(w, "  %-8v  %-8v  %v (local v%d, remote v%d)\n",
+			change.Action, change.Status, change.Filename, change.LocalVersion, change.RemoteVersion); err != nil {
+			return err
+		}
+	}
+	for _, name := range plan.Ignored {
+		if _, err := fmt.Fprintf(w, "  %-8v  %-8v  %v\n", "ignore", "", name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteJSON prints the plan as a single JSON object.
+func (plan *SyncPlan) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(plan)
+}
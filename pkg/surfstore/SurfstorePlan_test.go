@@ -0,0 +1,113 @@
+package surfstore
+
+import (
+	"bytes"
+	context "context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	grpc "google.golang.org/grpc"
+)
+
+// snapshotDir describes every file under dir by its content and stat.
+func snapshotDir(t *testing.T, dir string) map[string]string {
+	files := make(map[string]string)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		files[path] = fmt.Sprintf("%v %v %q", info.Mode(), info.ModTime().UnixNano(), content)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestPlanSyncChangesNothing(t *testing.T) {
+	counter := &callCounter{}
+	addr, _, _ := serveSurfstore(t, grpc.UnaryInterceptor(counter.intercept))
+	dir_a, dir_b := t.TempDir(), t.TempDir()
+	client_a, client_b := newTestClient(t, addr, dir_a), newTestClient(t, addr, dir_b)
+	for _, name := range []string{"keep.txt", "mod.txt", "del.txt", "stale.txt", "conflict.txt"} {
+		writeTestFile(t, filepath.Join(dir_a, name), name)
+	}
+	for _, client := range []RPCClient{client_a, client_b} {
+		if _, err := ClientSync(context.Background(), client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeTestFile(t, filepath.Join(dir_a, "stale.txt"), "changed by a")
+	writeTestFile(t, filepath.Join(dir_a, "conflict.txt"), "changed by a")
+	if _, err := ClientSync(context.Background(), client_a); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(dir_b, "new.txt"), "new")
+	writeTestFile(t, filepath.Join(dir_b, "mod.txt"), "changed by b")
+	writeTestFile(t, filepath.Join(dir_b, "conflict.txt"), "changed by b")
+	if err := os.Remove(filepath.Join(dir_b, "del.txt")); err != nil {
+		t.Fatal(err)
+	}
+
+	before := snapshotDir(t, dir_b)
+	writes := []string{"/surfstore.BlockStore/PutBlock", "/surfstore.MetaStore/UpdateFile",
+		"/surfstore.MetaStore/UpdateFileIf", "/surfstore.MetaStore/CommitBatch", "/surfstore.MetaStore/GetNamespaceSalt"}
+	write_calls := make(map[string]int)
+	for _, method := range writes {
+		write_calls[method] = counter.count(method)
+	}
+	plan, err := PlanSync(context.Background(), client_b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var text, encoded bytes.Buffer
+	if err := plan.WriteText(&text); err != nil {
+		t.Fatal(err)
+	}
+	if err := plan.WriteJSON(&encoded); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, method := range writes {
+		if calls := counter.count(method) - write_calls[method]; calls != 0 {
+			t.Errorf("plan made %d %v calls", calls, method)
+		}
+	}
+	if after := snapshotDir(t, dir_b); !reflect.DeepEqual(after, before) {
+		t.Errorf("plan changed the base directory:\n%v\n%v", before, after)
+	}
+
+	want := map[string]string{
+		"new.txt":      "added upload",
+		"mod.txt":      "modified upload",
+		"del.txt":      "deleted upload",
+		"stale.txt":    "stale download",
+		"conflict.txt": "conflict download",
+	}
+	got := make(map[string]string)
+	for _, change := range plan.Changes {
+		got[change.Filename] = string(change.Status) + " " + string(change.Action)
+	}
+	if !reflect.DeepEqual(got, want) || !reflect.DeepEqual(plan.Unchanged, []string{"keep.txt"}) {
+		t.Errorf("plan changes %v, unchanged %v", got, plan.Unchanged)
+	}
+	for name := range want {
+		if !bytes.Contains(text.Bytes(), []byte(name)) {
+			t.Errorf("text plan lacks %v:\n%s", name, text.String())
+		}
+	}
+	var decoded SyncPlan
+	if err := json.Unmarshal(encoded.Bytes(), &decoded); err != nil || len(decoded.Changes) != len(want) {
+		t.Errorf("JSON plan %s: %v", encoded.String(), err)
+	}
+}
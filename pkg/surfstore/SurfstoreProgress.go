@@ -0,0 +1,159 @@
+package surfstore
+
+import (
+	"fmt"
+	"io"
+	"path"
+	"time"
+)
+
+// FileResult is what happened to one file in a sync.
+type FileResult string
+
+const (
+	ResultUploaded   FileResult = "uploaded"
+	ResultDownloaded FileResult = "downloaded"
+	ResultRemoved    FileResult = "removed"
+	// The sync stopped while transferring the file
+	ResultFailed FileResult = "failed"
+)
+
+// FileReport describes one file a sync changed or tried to change.
+type FileReport struct {
+	Filename string       `json:"filename"`
+	Status   ChangeStatus `json:"status"`
+	Action   ChangeAction `json:"action"`
+	Result   FileResult   `json:"result"`
+	// Version of the file after the sync, or the one being transferred
+	Version int32 `json:"version"`
+	// Size of the uploaded or downloaded file
+	Bytes int64  `json:"bytes"`
+	Error string `json:"error,omitempty"`
+}
+
+// ProgressReporter follows a sync as it happens. Its methods are called
+// from the goroutine running the sync, in order.
+type ProgressReporter interface {
+	// Planned is called once with the changes the sync is about to make
+	Planned(changes []*FileChange)
+	// Started is called when a file starts transferring, Transferred as
+	// its bytes go through and Finished when it is done or failed
+	Started(change *FileChange)
+	Transferred(n int64)
+	Finished(report *FileReport)
+}
+
+func (surfClient *RPCClient) reportTransferred(n int64) {
+	if surfClient.Progress != nil {
+		surfClient.Progress.Transferred(n)
+	}
+}
+
+// TerminalProgress draws a status line with the files and bytes done,
+// the live throughput and the estimated time left, and prints a line for
+// every finished file above it.
+type TerminalProgress struct {
+	w io.Writer
+
+	files, filesDone int
+	bytes, bytesDone int64
+	planned          map[*FileChange]bool
+	current          *FileChange
+	currentBytes     int64
+	// recent samples of bytesDone for the throughput
+	samples  []progressSample
+	lastDraw time.Time
+}
+
+type progressSample struct {
+	at    time.Time
+	bytes int64
+}
+
+// NewTerminalProgress returns a reporter drawing on w, which should be a terminal.
+func NewTerminalProgress(w io.Writer) *TerminalProgress {
+	return &TerminalProgress{w: w}
+}
+
+// Planned starts a new sync; a reporter may follow several in turn.
+func (p *TerminalProgress) Planned(changes []*FileChange) {
+	*p = TerminalProgress{w: p.w, files: len(changes), planned: make(map[*FileChange]bool)}
+	for _, change := range changes {
+		p.planned[change] = true
+		p.bytes += change.Bytes
+	}
+	p.samples = []progressSample{{at: time.Now()}}
+	if p.files > 0 {
+		p.draw(true)
+	}
+}
+
+func (p *TerminalProgress) Started(change *FileChange) {
+	if !p.planned[change] {
+		// the download replacing a rejected upload
+		p.bytes += change.Bytes
+	}
+	p.current = change
+	p.currentBytes = 0
+	p.draw(true)
+}
+
+func (p *TerminalProgress) Transferred(n int64) {
+	p.bytesDone += n
+	p.currentBytes += n
+	p.draw(false)
+}
+
+func (p *TerminalProgress) Finished(report *FileReport) {
+	p.filesDone++
+	if p.current != nil && p.current.Filename == report.Filename {
+		// planned sizes of downloads are estimates
+		p.bytes += p.currentBytes - p.current.Bytes
+		p.current = nil
+	}
+	line := fmt.Sprintf("%-10v %v", report.Result, report.Filename)
+	if report.Status == StatusConflict || report.Status == StatusDeleted {
+		line += fmt.Sprintf(" (%v)", report.Status)
+	}
+	if report.Error != "" {
+		line += ": " + report.Error
+	}
+	fmt.Fprintf(p.w, "\r\033[K%v\n", line)
+	if p.filesDone == p.files {
+		return
+	}
+	p.draw(true)
+}
+
+// Clear erases the status line, for when the sync ends early.
+func (p *TerminalProgress) Clear() {
+	fmt.Fprintf(p.w, "\r\033[K")
+}
+
+// draw redraws the status line, at most every PROGRESS_REDRAW_INTERVAL
+// unless forced.
+func (p *TerminalProgress) draw(force bool) {
+	now := time.Now()
+	if !force && now.Sub(p.lastDraw) < PROGRESS_REDRAW_INTERVAL {
+		return
+	}
+	p.lastDraw = now
+	p.samples = append(p.samples, progressSample{at: now, bytes: p.bytesDone})
+	for len(p.samples) > 2 && now.Sub(p.samples[1].at) > PROGRESS_RATE_WINDOW {
+		p.samples = p.samples[1:]
+	}
+
+	line := fmt.Sprintf("[%d/%d files] %v/%v", p.filesDone, p.files, FormatBytes(float64(p.bytesDone)), FormatBytes(float64(p.bytes)))
+	if elapsed := now.Sub(p.samples[0].at).Seconds(); elapsed > 0 {
+		rate := float64(p.bytesDone-p.samples[0].bytes) / elapsed
+		line += " " + FormatRate(rate)
+		if rate > 0 && p.bytes > p.bytesDone {
+			eta := time.Duration(float64(p.bytes-p.bytesDone) / rate * float64(time.Second))
+			line += fmt.Sprintf(" ETA %v", eta.Round(time.Second))
+		}
+	}
+	if p.current != nil {
+		line += fmt.Sprintf(" %v %v", p.current.Action, path.Base(p.current.Filename))
+	}
+	fmt.Fprintf(p.w, "\r\033[K%v", line)
+}
@@ -0,0 +1,145 @@
+package surfstore
+
+import (
+	"bytes"
+	context "context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// recordingProgress records the calls of a sync to its reporter.
+type recordingProgress struct {
+	calls       []string
+	planned     int
+	transferred int64
+	reports     []*FileReport
+}
+
+func (p *recordingProgress) Planned(changes []*FileChange) {
+	p.calls = append(p.calls, "planned")
+	p.planned = len(changes)
+}
+
+func (p *recordingProgress) Started(change *FileChange) {
+	p.calls = append(p.calls, "started "+change.Filename)
+}
+
+func (p *recordingProgress) Transferred(n int64) {
+	p.transferred += n
+}
+
+func (p *recordingProgress) Finished(report *FileReport) {
+	p.calls = append(p.calls, "finished "+report.Filename)
+	p.reports = append(p.reports, report)
+}
+
+func TestSyncReportsEveryFile(t *testing.T) {
+	addr, _, _ := serveSurfstore(t)
+	dir_a, dir_b := t.TempDir(), t.TempDir()
+	client_a, client_b := newTestClient(t, addr, dir_a), newTestClient(t, addr, dir_b)
+	progress := &recordingProgress{}
+	client_a.Progress = progress
+
+	writeTestFile(t, filepath.Join(dir_a, "a.txt"), strings.Repeat("a", 2000))
+	writeTestFile(t, filepath.Join(dir_a, "b.txt"), "b")
+	result, err := ClientSync(context.Background(), client_a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.Uploaded, []string{"a.txt", "b.txt"}) || result.BytesUploaded != 2001 || len(result.Files) != 2 {
+		t.Errorf("first sync result = %+v", result)
+	}
+	for _, report := range result.Files {
+		if report.Result != ResultUploaded || report.Status != StatusAdded || report.Version != 1 {
+			t.Errorf("report of the first sync = %+v", report)
+		}
+	}
+	want_calls := []string{"planned", "started a.txt", "started b.txt", "finished a.txt", "finished b.txt"}
+	if progress.planned != 2 || !reflect.DeepEqual(progress.calls, want_calls) || progress.transferred != 2001 {
+		t.Errorf("progress of the first sync: %d planned, %d bytes, %v", progress.planned, progress.transferred, progress.calls)
+	}
+	if !reflect.DeepEqual(progress.reports, result.Files) {
+		t.Errorf("reporter and result disagree")
+	}
+	if _, err := ClientSync(context.Background(), client_b); err != nil {
+		t.Fatal(err)
+	}
+
+	// a removes b.txt and changes a.txt before b changes it too
+	if err := os.Remove(filepath.Join(dir_a, "b.txt")); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(dir_a, "a.txt"), "new a")
+	if _, err := ClientSync(context.Background(), client_a); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, filepath.Join(dir_b, "a.txt"), "b's a")
+	result, err = ClientSync(context.Background(), client_b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(result.Conflicts, []string{"a.txt"}) || !reflect.DeepEqual(result.Removed, []string{"b.txt"}) ||
+		!reflect.DeepEqual(result.Downloaded, []string{"a.txt"}) || len(result.Uploaded) != 0 {
+		t.Errorf("second sync result = %+v", result)
+	}
+	outcomes := make(map[string]string)
+	for _, report := range result.Files {
+		outcomes[report.Filename] = string(report.Status) + " " + string(report.Result)
+	}
+	if outcomes["a.txt"] != "conflict downloaded" || outcomes["b.txt"] != "stale removed" {
+		t.Errorf("reports of the second sync = %v", outcomes)
+	}
+
+	var decoded map[string]interface{}
+	content, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(content, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"baseDir", "requestId", "uploaded", "downloaded", "removed", "conflicts", "files", "bytesDownloaded"} {
+		if _, ok := decoded[key]; !ok {
+			t.Errorf("JSON report lacks %v: %s", key, content)
+		}
+	}
+	if _, ok := decoded["error"]; ok {
+		t.Errorf("JSON report of a successful sync has an error")
+	}
+}
+
+func TestTerminalProgress(t *testing.T) {
+	var out bytes.Buffer
+	p := NewTerminalProgress(&out)
+	a := &FileChange{Filename: "dir/a.txt", Action: ActionUpload, Status: StatusAdded, Bytes: 2048}
+	b := &FileChange{Filename: "b.txt", Action: ActionDownload, Status: StatusConflict, Bytes: 1024}
+	p.Planned([]*FileChange{a, b})
+	p.Started(a)
+	p.Transferred(2048)
+	p.Finished(&FileReport{Filename: a.Filename, Status: a.Status, Result: ResultUploaded})
+	p.Started(b)
+	p.Transferred(100)
+	p.Finished(&FileReport{Filename: b.Filename, Status: b.Status, Result: ResultFailed, Error: "gone"})
+
+	text := out.String()
+	for _, want := range []string{
+		"[0/2 files] 0 B/3.0 KiB",
+		"upload a.txt",
+		"uploaded   dir/a.txt\n",
+		"[1/2 files] 2.0 KiB/3.0 KiB",
+		"download b.txt",
+		"failed     b.txt (conflict): gone\n",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("progress output lacks %q:\n%q", want, text)
+		}
+	}
+	// nothing is drawn after the last file
+	if !strings.HasSuffix(text, "gone\n") {
+		t.Errorf("status line drawn after the last file: %q", text)
+	}
+}
@@ -2,10 +2,14 @@ package surfstore
 
 import (
 	context "context"
-	"log"
+	"sync"
 	"time"
 
 	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	"google.golang.org/protobuf/types/known/emptypb"
 )
 
@@ -13,92 +17,250 @@ type RPCClient struct {
 	MetaStoreAddr string
 	BaseDir       string
 	BlockSize     int
+	// Token is sent as a bearer token on every RPC when non-empty
+	Token string
+	// TransportCredentials secures every connection; nil dials in plaintext
+	TransportCredentials credentials.TransportCredentials
+	// Cipher enables client-side encryption of blocks and, optionally, filenames
+	Cipher *BlockCipher
+	// Compression is tried on every uploaded block and skipped when it does
+	// not help. It is ignored with a Cipher: blocks are sealed before
+	// PutBlock and ciphertext does not compress
+	Compression Codec
+	// Paranoid rehashes every file instead of trusting the stat cached in the index
+	Paranoid bool
+	// RPCTimeout bounds every single RPC; 0 leaves only the caller's deadline
+	RPCTimeout time.Duration
+	// Symlinks says how symlinks in the base directory are synced
+	Symlinks SymlinkPolicy
+	// IgnoreFile holds ignore rules applied before every .surfignore; empty for none
+	IgnoreFile string
+	// UploadThrottle and DownloadThrottle limit and count block traffic; nil for neither
+	UploadThrottle   *Throttle
+	DownloadThrottle *Throttle
+	// Progress follows every sync when non-nil
+	Progress ProgressReporter
+	// Logger records what syncs and commands do; nil discards
+	Logger *Logger
+	pool   *connPool
 }
 
-func (surfClient *RPCClient) GetBlock(blockHash string, blockStoreAddr string, block *Block) error {
+// connPool keeps one connection per server so that TLS handshakes are not
+// repeated for every block.
+type connPool struct {
+	lock  sync.Mutex
+	conns map[string]*grpc.ClientConn
+}
+
+func (surfClient *RPCClient) dial(addr string) (*grpc.ClientConn, error) {
+	if surfClient.pool == nil {
+		surfClient.pool = &connPool{conns: make(map[string]*grpc.ClientConn)}
+	}
+	surfClient.pool.lock.Lock()
+	defer surfClient.pool.lock.Unlock()
+	if conn, ok := surfClient.pool.conns[addr]; ok {
+		return conn, nil
+	}
+
+	opts := []grpc.DialOption{transportDialOption(surfClient.TransportCredentials)}
+	if surfClient.Token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenCredentials(surfClient.Token)))
+	}
+	conn, err := grpc.Dial(addr, opts...)
+	if err != nil {
+		return nil, err
+	}
+	surfClient.pool.conns[addr] = conn
+	return conn, nil
+}
+
+// Close closes every connection the client has opened.
+func (surfClient *RPCClient) Close() error {
+	if surfClient.pool == nil {
+		return nil
+	}
+	surfClient.pool.lock.Lock()
+	defer surfClient.pool.lock.Unlock()
+	var firstErr error
+	for addr, conn := range surfClient.pool.conns {
+		if err := conn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		delete(surfClient.pool.conns, addr)
+	}
+	return firstErr
+}
+
+// rpcContext derives the context of a single RPC from the caller's, and
+// forwards its request ID.
+func (surfClient *RPCClient) rpcContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx = outgoingRequestID(ctx)
+	if surfClient.RPCTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, surfClient.RPCTimeout)
+}
+
+func (surfClient *RPCClient) GetBlock(ctx context.Context, blockHash string, blockStoreAddr string, block *Block) error {
 	// connect to the server
-	conn, err := grpc.Dial(blockStoreAddr, grpc.WithInsecure())
+	conn, err := surfClient.dial(blockStoreAddr)
 	if err != nil {
-		return err
+		return networkError("dial", err)
 	}
 	c := NewBlockStoreClient(conn)
 
 	// perform the call
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	rpc_ctx, cancel := surfClient.rpcContext(ctx)
 	defer cancel()
-	b, err := c.GetBlock(ctx, &BlockHash{Hash: blockHash})
+	b, err := c.GetBlock(rpc_ctx, &BlockHash{Hash: blockHash, AcceptCodecs: SupportedCodecs})
 
 	if err != nil {
-		conn.Close()
+		return networkError("GetBlock", err)
+	}
+	// the size is only known once the block arrived, so the wait holds
+	// back the next download instead of this one
+	if err := surfClient.DownloadThrottle.Wait(ctx, len(b.BlockData)); err != nil {
 		return err
 	}
-	block.BlockData = b.BlockData
-	block.BlockSize = b.BlockSize
-
-	// close the connection
-	return conn.Close()
+	data, err := DecodeBlock(b)
+	if err != nil {
+		return integrityError("GetBlock", blockHash, err)
+	}
+	block.BlockData = data
+	block.BlockSize = int32(len(data))
+	return nil
 }
 
-func (surfClient *RPCClient) PutBlock(block *Block, blockStoreAddr string, succ *bool) error {
-
-	log.Printf("Putting block, size %v, real len %v", block.BlockSize, len(block.BlockData))
-	conn, err := grpc.Dial(blockStoreAddr, grpc.WithInsecure())
+func (surfClient *RPCClient) PutBlock(ctx context.Context, block *Block, blockStoreAddr string, succ *bool) error {
+	conn, err := surfClient.dial(blockStoreAddr)
 	if err != nil {
-		log.Fatal(err)
+		return networkError("dial", err)
 	}
 	c := NewBlockStoreClient(conn)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
-	defer cancel()
 
+	if block.Codec == Codec_CODEC_NONE && surfClient.Cipher == nil {
+		block = EncodeBlock(surfClient.Compression, block.BlockData[:block.BlockSize])
+	}
+	// throttling does not count against the RPC deadline
+	if err := surfClient.UploadThrottle.Wait(ctx, len(block.BlockData)); err != nil {
+		return err
+	}
+	ctx, cancel := surfClient.rpcContext(ctx)
+	defer cancel()
 	success, err := c.PutBlock(ctx, block)
+	if status.Code(err) == codes.ResourceExhausted {
+		return quotaError("PutBlock", "", err)
+	}
 	if err != nil {
-		conn.Close()
-		panic(err)
+		return networkError("PutBlock", err)
 	}
-	log.Printf("Success: %v\n", success.GetFlag())
 	*succ = success.GetFlag()
-	return conn.Close()
+	return nil
 }
 
-func (surfClient *RPCClient) HasBlocks(blockHashesIn []string, blockStoreAddr string, blockHashesOut *[]string) error {
-	conn, err := grpc.Dial(blockStoreAddr, grpc.WithInsecure())
+func (surfClient *RPCClient) HasBlocks(ctx context.Context, blockHashesIn []string, blockStoreAddr string, blockHashesOut *[]string) error {
+	conn, err := surfClient.dial(blockStoreAddr)
 	if err != nil {
-		log.Fatal(err)
+		return networkError("dial", err)
 	}
 	c := NewBlockStoreClient(conn)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	ctx, cancel := surfClient.rpcContext(ctx)
 	defer cancel()
 
 	in_hashes := &BlockHashes{Hashes: blockHashesIn}
 	out_hashes, err := c.HasBlocks(ctx, in_hashes)
 	if err != nil {
-		return err
+		return networkError("HasBlocks", err)
 	}
 	*blockHashesOut = out_hashes.Hashes
 	return nil
 }
 
-func (surfClient *RPCClient) GetFileInfoMap(serverFileInfoMap *map[string]*FileMetaData) error {
-	conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithInsecure())
+// GetBlockStoreUsage asks a block store for its usage and capacity.
+func (surfClient *RPCClient) GetBlockStoreUsage(ctx context.Context, blockStoreAddr string, usage *BlockStoreUsage) error {
+	conn, err := surfClient.dial(blockStoreAddr)
+	if err != nil {
+		return networkError("dial", err)
+	}
+	c := NewBlockStoreClient(conn)
+	ctx, cancel := surfClient.rpcContext(ctx)
+	defer cancel()
+
+	block_usage, err := c.GetBlockStoreUsage(ctx, &emptypb.Empty{})
+	if err != nil {
+		return networkError("GetBlockStoreUsage", err)
+	}
+	proto.Reset(usage)
+	proto.Merge(usage, block_usage)
+	return nil
+}
+
+func (surfClient *RPCClient) GetFileInfoMap(ctx context.Context, serverFileInfoMap *map[string]*FileMetaData) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
 	if err != nil {
-		log.Fatal(err)
+		return networkError("dial", err)
 	}
 	c := NewMetaStoreClient(conn)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	ctx, cancel := surfClient.rpcContext(ctx)
 	defer cancel()
 
 	file_info_map, err := c.GetFileInfoMap(ctx, &emptypb.Empty{})
 	// PrintMetaMap(file_info_map.FileInfoMap)
+	if err != nil {
+		return networkError("GetFileInfoMap", err)
+	}
+	if surfClient.Cipher == nil {
+		*serverFileInfoMap = file_info_map.FileInfoMap
+		return nil
+	}
+
+	// Translate encrypted filenames back to local names
+	plain_map := make(map[string]*FileMetaData)
+	for name, meta := range file_info_map.FileInfoMap {
+		if err := surfClient.openMetaData(meta); err != nil {
+			surfClient.Logger.WithContext(ctx).Warn("Skipping remote file that cannot be decrypted", "file", name, "error", err)
+			continue
+		}
+		plain_map[meta.Filename] = meta
+	}
+	*serverFileInfoMap = plain_map
+	return nil
+}
+
+// sealMetaData returns metadata in the form stored on the MetaStore, with
+// the filename and symlink target encrypted when the client encrypts them.
+func (surfClient *RPCClient) sealMetaData(meta *FileMetaData) *FileMetaData {
+	if surfClient.Cipher == nil {
+		return meta
+	}
+	sealed := proto.Clone(meta).(*FileMetaData)
+	sealed.Filename = surfClient.Cipher.EncryptFilename(meta.Filename)
+	if meta.SymlinkTarget != "" {
+		sealed.SymlinkTarget = surfClient.Cipher.EncryptSymlinkTarget(meta.SymlinkTarget)
+	}
+	return sealed
+}
+
+// openMetaData reverses sealMetaData in place.
+func (surfClient *RPCClient) openMetaData(meta *FileMetaData) error {
+	filename, err := surfClient.Cipher.DecryptFilename(meta.Filename)
 	if err != nil {
 		return err
 	}
-	*serverFileInfoMap = file_info_map.FileInfoMap
+	meta.Filename = filename
+	if meta.SymlinkTarget != "" {
+		target, err := surfClient.Cipher.DecryptSymlinkTarget(meta.SymlinkTarget)
+		if err != nil {
+			return err
+		}
+		meta.SymlinkTarget = target
+	}
 	return nil
 }
 
-func (surfClient *RPCClient) GetUpdatedMetadata(filename string) (*FileMetaData, error) {
+func (surfClient *RPCClient) GetUpdatedMetadata(ctx context.Context, filename string) (*FileMetaData, error) {
 	new_file_map := make(map[string]*FileMetaData)
-	err := surfClient.GetFileInfoMap(&new_file_map)
+	err := surfClient.GetFileInfoMap(ctx, &new_file_map)
 	if err != nil {
 		return nil, err
 	} else {
@@ -106,47 +268,272 @@ func (surfClient *RPCClient) GetUpdatedMetadata(filename string) (*FileMetaData,
 	}
 }
 
-func (surfClient *RPCClient) UpdateFile(fileMetaData *FileMetaData, latestVersion *int32) error {
-	conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithInsecure())
+func (surfClient *RPCClient) UpdateFile(ctx context.Context, fileMetaData *FileMetaData, latestVersion *int32) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
 	if err != nil {
-		log.Fatal(err)
+		return networkError("dial", err)
 	}
 	c := NewMetaStoreClient(conn)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	ctx, cancel := surfClient.rpcContext(ctx)
 	defer cancel()
 
-	log.Printf("Version before update: %v", fileMetaData.Version)
-	before_update := fileMetaData.BlockHashList
-	version, err := c.UpdateFile(ctx, fileMetaData)
+	version, err := c.UpdateFile(ctx, surfClient.sealMetaData(fileMetaData))
+	if status.Code(err) == codes.ResourceExhausted {
+		return quotaError("UpdateFile", fileMetaData.Filename, err)
+	}
 	if err != nil {
-		return err
+		return networkError("UpdateFile", err)
 	}
-	log.Printf("Version after update: %v", fileMetaData.Version)
 	*latestVersion = version.Version
-	if *latestVersion == -1 {
-		log.Printf("Hashlist before update: %v", before_update)
-		log.Printf("Hashlist after update: %v", fileMetaData.BlockHashList)
+	surfClient.Logger.WithContext(ctx).Debug("Update file", "file", fileMetaData.Filename,
+		"version", fileMetaData.Version, "accepted", version.Version != -1)
+	return nil
+}
+
+// CommitBatch publishes several files at once. The server applies all of
+// them or, when some conflict with a newer remote version, none; conflicts
+// then holds the current remote metadata of those files.
+func (surfClient *RPCClient) CommitBatch(ctx context.Context, files []*FileMetaData, conflicts *[]*FileMetaData) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return networkError("dial", err)
+	}
+	c := NewMetaStoreClient(conn)
+	ctx, cancel := surfClient.rpcContext(ctx)
+	defer cancel()
+
+	sealed := make([]*FileMetaData, len(files))
+	for i, meta := range files {
+		sealed[i] = surfClient.sealMetaData(meta)
+	}
+	batch_result, err := c.CommitBatch(ctx, &FileBatch{Files: sealed})
+	if status.Code(err) == codes.ResourceExhausted {
+		return quotaError("CommitBatch", "", err)
+	}
+	if err != nil {
+		return networkError("CommitBatch", err)
+	}
+	if surfClient.Cipher != nil {
+		for _, meta := range batch_result.Conflicts {
+			if err := surfClient.openMetaData(meta); err != nil {
+				return integrityError("CommitBatch", meta.Filename, err)
+			}
+		}
 	}
+	*conflicts = batch_result.Conflicts
+	surfClient.Logger.WithContext(ctx).Debug("Commit batch", "files", len(files),
+		"committed", batch_result.Committed, "conflicts", len(batch_result.Conflicts))
 	return nil
 }
 
-func (surfClient *RPCClient) GetBlockStoreAddr(blockStoreAddr *string) error {
-	conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithInsecure())
+// UpdateFileIf publishes a file when the remote file is at the expected
+// version or hash list; otherwise result gives the reason. Either way
+// result holds the remote metadata afterwards. MetaStores that predate
+// conditional updates only take an expected version, through UpdateFile.
+func (surfClient *RPCClient) UpdateFileIf(ctx context.Context, update *ConditionalUpdate, result *UpdateResult) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
 	if err != nil {
-		log.Fatal(err)
+		return networkError("dial", err)
 	}
 	c := NewMetaStoreClient(conn)
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	rpc_ctx, cancel := surfClient.rpcContext(ctx)
 	defer cancel()
 
-	block_addr, err := c.GetBlockStoreAddr(ctx, &emptypb.Empty{})
+	filename := update.GetFile().GetFilename()
+	sealed := &ConditionalUpdate{File: surfClient.sealMetaData(update.GetFile()), Expected: update.GetExpected()}
+	update_result, err := c.UpdateFileIf(rpc_ctx, sealed)
+	if _, ok := update.GetExpected().(*ConditionalUpdate_ExpectedVersion); ok && status.Code(err) == codes.Unimplemented {
+		return surfClient.updateFileUnconditionally(ctx, update, result)
+	}
+	if status.Code(err) == codes.ResourceExhausted {
+		return quotaError("UpdateFileIf", filename, err)
+	}
+	if err != nil {
+		return networkError("UpdateFileIf", err)
+	}
+	if update_result.Current != nil && surfClient.Cipher != nil {
+		if err := surfClient.openMetaData(update_result.Current); err != nil {
+			return integrityError("UpdateFileIf", filename, err)
+		}
+	}
+	proto.Reset(result)
+	proto.Merge(result, update_result)
+	surfClient.Logger.WithContext(ctx).Debug("Update file", "file", filename, "version", result.Version,
+		"reason", result.Reason)
+	return nil
+}
+
+// updateFileUnconditionally stands in for UpdateFileIf with an expected
+// version, by sending the next version to UpdateFile and looking up the
+// current metadata when it is rejected. Unlike UpdateFileIf, UpdateFile
+// accepts any version of a file the server does not have.
+func (surfClient *RPCClient) updateFileUnconditionally(ctx context.Context, update *ConditionalUpdate, result *UpdateResult) error {
+	meta := proto.Clone(update.GetFile()).(*FileMetaData)
+	meta.Version = update.GetExpectedVersion() + 1
+	var latestVersion int32
+	if err := surfClient.UpdateFile(ctx, meta, &latestVersion); err != nil {
+		return err
+	}
+	proto.Reset(result)
+	if latestVersion != -1 {
+		result.Reason = UpdateReason_UPDATE_APPLIED
+		result.Version = meta.Version
+		result.Current = meta
+		return nil
+	}
+	current_meta, err := surfClient.GetUpdatedMetadata(ctx, meta.Filename)
 	if err != nil {
 		return err
 	}
+	result.Reason = UpdateReason_UPDATE_VERSION_MISMATCH
+	if update.GetExpectedVersion() == 0 {
+		result.Reason = UpdateReason_UPDATE_ALREADY_EXISTS
+	}
+	result.Version = -1
+	result.Current = current_meta
+	return nil
+}
+
+// GetNamespaceSalt gets the salt the encryption keys of the namespace are
+// derived with. Without create, a namespace that has no salt yet gets an
+// empty one.
+func (surfClient *RPCClient) GetNamespaceSalt(ctx context.Context, create bool, salt *[]byte) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return networkError("dial", err)
+	}
+	c := NewMetaStoreClient(conn)
+	ctx, cancel := surfClient.rpcContext(ctx)
+	defer cancel()
+
+	namespace_salt, err := c.GetNamespaceSalt(ctx, &NamespaceSaltRequest{LookupOnly: !create})
+	if err != nil {
+		return networkError("GetNamespaceSalt", err)
+	}
+	*salt = namespace_salt.Salt
+	return nil
+}
+
+func (surfClient *RPCClient) GetBlockStoreAddr(ctx context.Context, blockStoreAddr *string) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return networkError("dial", err)
+	}
+	c := NewMetaStoreClient(conn)
+	ctx, cancel := surfClient.rpcContext(ctx)
+	defer cancel()
+
+	block_addr, err := c.GetBlockStoreAddr(ctx, &emptypb.Empty{})
+	if err != nil {
+		return networkError("GetBlockStoreAddr", err)
+	}
 	*blockStoreAddr = block_addr.Addr
 	return nil
 }
 
+// GetBlockStoreAddrs gets the ring of block stores, or the single block
+// store of a MetaStore that predates rings.
+func (surfClient *RPCClient) GetBlockStoreAddrs(ctx context.Context, blockStoreAddrs *[]string) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return networkError("dial", err)
+	}
+	c := NewMetaStoreClient(conn)
+	rpc_ctx, cancel := surfClient.rpcContext(ctx)
+	defer cancel()
+
+	block_addrs, err := c.GetBlockStoreAddrs(rpc_ctx, &emptypb.Empty{})
+	if status.Code(err) == codes.Unimplemented {
+		var block_addr string
+		if err := surfClient.GetBlockStoreAddr(ctx, &block_addr); err != nil {
+			return err
+		}
+		*blockStoreAddrs = []string{block_addr}
+		return nil
+	}
+	if err != nil {
+		return networkError("GetBlockStoreAddrs", err)
+	}
+	*blockStoreAddrs = block_addrs.Addrs
+	return nil
+}
+
+// GetNamespaceUsage gets the usage of the caller's namespace, or of every
+// namespace for admins.
+func (surfClient *RPCClient) GetNamespaceUsage(ctx context.Context, usage *[]*NamespaceUsage) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return networkError("dial", err)
+	}
+	c := NewMetaStoreClient(conn)
+	ctx, cancel := surfClient.rpcContext(ctx)
+	defer cancel()
+
+	usage_list, err := c.GetNamespaceUsage(ctx, &emptypb.Empty{})
+	if err != nil {
+		return networkError("GetNamespaceUsage", err)
+	}
+	*usage = usage_list.Namespaces
+	return nil
+}
+
+// GetBlockReferences lists the files referencing a block. Names from the
+// caller's namespace are decrypted; those of other namespaces, which only
+// admins see, are left as stored.
+func (surfClient *RPCClient) GetBlockReferences(ctx context.Context, blockHash string, refs *BlockReferences) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return networkError("dial", err)
+	}
+	c := NewMetaStoreClient(conn)
+	ctx, cancel := surfClient.rpcContext(ctx)
+	defer cancel()
+
+	block_refs, err := c.GetBlockReferences(ctx, &BlockHash{Hash: blockHash})
+	if err != nil {
+		return networkError("GetBlockReferences", err)
+	}
+	if surfClient.Cipher != nil {
+		for _, file_ref := range block_refs.Files {
+			if filename, err := surfClient.Cipher.DecryptFilename(file_ref.Filename); err == nil {
+				file_ref.Filename = filename
+			}
+		}
+	}
+	proto.Reset(refs)
+	proto.Merge(refs, block_refs)
+	return nil
+}
+
+func (surfClient *RPCClient) GetFileHistory(ctx context.Context, filename string, history *[]*FileMetaData) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return networkError("dial", err)
+	}
+	c := NewMetaStoreClient(conn)
+	ctx, cancel := surfClient.rpcContext(ctx)
+	defer cancel()
+
+	remote_name := filename
+	if surfClient.Cipher != nil {
+		remote_name = surfClient.Cipher.EncryptFilename(filename)
+	}
+	file_history, err := c.GetFileHistory(ctx, &FileName{Filename: remote_name})
+	if err != nil {
+		return networkError("GetFileHistory", err)
+	}
+	for _, meta := range file_history.Versions {
+		if surfClient.Cipher != nil {
+			if err := surfClient.openMetaData(meta); err != nil {
+				return integrityError("GetFileHistory", filename, err)
+			}
+		}
+		meta.Filename = filename
+	}
+	*history = file_history.Versions
+	return nil
+}
+
 // This line guarantees all method for RPCClient are implemented
 var _ ClientInterface = new(RPCClient)
 
@@ -157,5 +544,8 @@ func NewSurfstoreRPCClient(hostPort, baseDir string, blockSize int) RPCClient {
 		MetaStoreAddr: hostPort,
 		BaseDir:       baseDir,
 		BlockSize:     blockSize,
+		RPCTimeout:    DEFAULT_RPC_TIMEOUT,
+		Symlinks:      SymlinkFollow,
+		pool:          &connPool{conns: make(map[string]*grpc.ClientConn)},
 	}
 }
@@ -0,0 +1,146 @@
+package surfstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Selection limits a client to part of the namespace: the paths under one
+// of the include prefixes, or all paths when there are none, except those
+// under an exclude prefix. Prefixes are relative paths separated by slashes.
+type Selection struct {
+	Include []string `json:"include,omitempty"`
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+// ParseSelection builds a selection from command-line prefixes. A prefix
+// starting with "!" is excluded, and "." includes everything.
+func ParseSelection(prefixes []string) (*Selection, error) {
+	selection := &Selection{}
+	include_all := false
+	for _, prefix := range prefixes {
+		exclude := strings.HasPrefix(prefix, "!")
+		prefix = path.Clean(strings.Trim(strings.TrimPrefix(prefix, "!"), "/"))
+		if prefix == "." && !exclude {
+			include_all = true
+			continue
+		}
+		if !IsLocalFilename(prefix) {
+			return nil, fmt.Errorf("Bad selection prefix %v", prefix)
+		}
+		if exclude {
+			selection.Exclude = append(selection.Exclude, prefix)
+		} else {
+			selection.Include = append(selection.Include, prefix)
+		}
+	}
+	if include_all {
+		selection.Include = nil
+	}
+	sort.Strings(selection.Include)
+	sort.Strings(selection.Exclude)
+	return selection, nil
+}
+
+// Empty reports whether the selection covers the whole namespace.
+func (s *Selection) Empty() bool {
+	return s == nil || (len(s.Include) == 0 && len(s.Exclude) == 0)
+}
+
+// Selected reports whether the file name is part of the selection.
+func (s *Selection) Selected(name string) bool {
+	if s == nil {
+		return true
+	}
+	for _, prefix := range s.Exclude {
+		if underPrefix(name, prefix) {
+			return false
+		}
+	}
+	if len(s.Include) == 0 {
+		return true
+	}
+	for _, prefix := range s.Include {
+		if underPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// mayContain reports whether the directory dir can hold selected files.
+func (s *Selection) mayContain(dir string) bool {
+	if s == nil {
+		return true
+	}
+	for _, prefix := range s.Exclude {
+		if underPrefix(dir, prefix) {
+			return false
+		}
+	}
+	if len(s.Include) == 0 {
+		return true
+	}
+	for _, prefix := range s.Include {
+		if underPrefix(dir, prefix) || strings.HasPrefix(prefix, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func underPrefix(name string, prefix string) bool {
+	return name == prefix || strings.HasPrefix(name, prefix+"/")
+}
+
+// String lists the prefixes in the form ParseSelection accepts.
+func (s *Selection) String() string {
+	if s.Empty() {
+		return "."
+	}
+	prefixes := append([]string{}, s.Include...)
+	if len(prefixes) == 0 {
+		prefixes = append(prefixes, ".")
+	}
+	for _, prefix := range s.Exclude {
+		prefixes = append(prefixes, "!"+prefix)
+	}
+	return strings.Join(prefixes, " ")
+}
+
+// LoadSelection reads the selection of baseDir; without a selection file
+// everything is selected.
+func LoadSelection(baseDir string) (*Selection, error) {
+	content, err := ioutil.ReadFile(filepath.Join(baseDir, SELECTION_FILENAME))
+	if os.IsNotExist(err) {
+		return &Selection{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	selection := &Selection{}
+	if err := json.Unmarshal(content, selection); err != nil {
+		return nil, fmt.Errorf("%v: %w", SELECTION_FILENAME, err)
+	}
+	return selection, nil
+}
+
+// WriteSelection stores the selection of baseDir. The next sync downloads
+// newly selected files and removes unmodified files that are no longer
+// selected.
+func WriteSelection(baseDir string, selection *Selection) error {
+	path := filepath.Join(baseDir, SELECTION_FILENAME)
+	if selection.Empty() {
+		return RemoveIfExist(path)
+	}
+	content, err := json.MarshalIndent(selection, "", "  ")
+	if err != nil {
+		return err
+	}
+	return WriteFileAtomic(path, append(content, '\n'), 0644)
+}
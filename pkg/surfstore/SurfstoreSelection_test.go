@@ -0,0 +1,168 @@
+package surfstore
+
+import (
+	context "context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseSelection(t *testing.T) {
+	cases := []struct {
+		prefixes []string
+		include  []string
+		exclude  []string
+		text     string
+	}{
+		{nil, nil, nil, "."},
+		{[]string{"src/app/", "docs", "!src/app/vendor"}, []string{"docs", "src/app"}, []string{"src/app/vendor"}, "docs src/app !src/app/vendor"},
+		{[]string{"docs", "."}, nil, nil, "."},
+		{[]string{".", "!tmp"}, nil, []string{"tmp"}, ". !tmp"},
+		{[]string{"/docs//guide/"}, []string{"docs/guide"}, nil, "docs/guide"},
+	}
+	for _, c := range cases {
+		selection, err := ParseSelection(c.prefixes)
+		if err != nil {
+			t.Errorf("ParseSelection(%q) = %v", c.prefixes, err)
+			continue
+		}
+		if !reflect.DeepEqual(selection.Include, c.include) || !reflect.DeepEqual(selection.Exclude, c.exclude) {
+			t.Errorf("ParseSelection(%q) = %+v", c.prefixes, selection)
+		}
+		if selection.String() != c.text {
+			t.Errorf("ParseSelection(%q) prints as %q, want %q", c.prefixes, selection.String(), c.text)
+		}
+	}
+	for _, prefix := range []string{"../up", "!..", "docs/../../up"} {
+		if _, err := ParseSelection([]string{prefix}); err == nil {
+			t.Errorf("prefix %q accepted", prefix)
+		}
+	}
+}
+
+func TestSelectionSelected(t *testing.T) {
+	selection, err := ParseSelection([]string{"docs", "src/app", "!src/app/vendor"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	selected := map[string]bool{
+		"docs":                true,
+		"docs/a.txt":          true,
+		"docs2/a.txt":         false,
+		"src/app/main.go":     true,
+		"src/app/vendor/x.go": false,
+		"src/app/vendored.go": true,
+		"src/lib/x.go":        false,
+		"README.md":           false,
+	}
+	for name, want := range selected {
+		if got := selection.Selected(name); got != want {
+			t.Errorf("Selected(%v) = %v, want %v", name, got, want)
+		}
+	}
+	contains := map[string]bool{
+		"src":            true,
+		"src/app":        true,
+		"src/app/sub":    true,
+		"src/app/vendor": false,
+		"src/lib":        false,
+		"doc":            false,
+	}
+	for dir, want := range contains {
+		if got := selection.mayContain(dir); got != want {
+			t.Errorf("mayContain(%v) = %v, want %v", dir, got, want)
+		}
+	}
+	var none *Selection
+	if !none.Selected("any/file") || !none.Empty() {
+		t.Errorf("nil selection does not cover everything")
+	}
+}
+
+func TestWriteSelection(t *testing.T) {
+	dir := t.TempDir()
+	if selection, err := LoadSelection(dir); err != nil || !selection.Empty() {
+		t.Fatalf("selection without a file = %v, %v", selection, err)
+	}
+	selection, err := ParseSelection([]string{"docs", "!docs/old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteSelection(dir, selection); err != nil {
+		t.Fatal(err)
+	}
+	if loaded, err := LoadSelection(dir); err != nil || !reflect.DeepEqual(loaded, selection) {
+		t.Errorf("loaded selection %+v, %v", loaded, err)
+	}
+	if err := WriteSelection(dir, &Selection{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, SELECTION_FILENAME)); !os.IsNotExist(err) {
+		t.Errorf("empty selection left its file: %v", err)
+	}
+	writeTestFile(t, filepath.Join(dir, SELECTION_FILENAME), "not json")
+	if _, err := LoadSelection(dir); err == nil {
+		t.Errorf("bad selection file accepted")
+	}
+}
+
+func TestSyncFollowsTheSelection(t *testing.T) {
+	addr, m, _ := serveSurfstore(t)
+	dir_a, dir_b := t.TempDir(), t.TempDir()
+	writeTestFile(t, filepath.Join(dir_a, "docs", "a.txt"), "docs")
+	writeTestFile(t, filepath.Join(dir_a, "other", "b.txt"), "other")
+	if _, err := ClientSync(context.Background(), newTestClient(t, addr, dir_a)); err != nil {
+		t.Fatal(err)
+	}
+
+	client_b := newTestClient(t, addr, dir_b)
+	selectAndSync := func(prefixes ...string) {
+		selection, err := ParseSelection(prefixes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := WriteSelection(dir_b, selection); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := ClientSync(context.Background(), client_b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	exists := func(name string) bool {
+		_, err := os.Stat(filepath.Join(dir_b, filepath.FromSlash(name)))
+		return err == nil
+	}
+
+	// a local file outside the selection is not uploaded
+	writeTestFile(t, filepath.Join(dir_b, "other", "local.txt"), "local")
+	selectAndSync("docs")
+	if !exists("docs/a.txt") || exists("other/b.txt") {
+		t.Errorf("selective sync downloaded docs/a.txt: %v, other/b.txt: %v", exists("docs/a.txt"), exists("other/b.txt"))
+	}
+	remote := remoteFiles(t, m)
+	if _, ok := remote["other/local.txt"]; ok {
+		t.Errorf("unselected local file uploaded")
+	}
+	if meta := remote["other/b.txt"]; meta == nil || meta.Version != 1 || IsTombstone(meta.BlockHashList) {
+		t.Errorf("unselected remote file changed: %v", meta)
+	}
+
+	selectAndSync(".")
+	if !exists("other/b.txt") {
+		t.Errorf("newly selected file not downloaded")
+	}
+	if _, ok := remoteFiles(t, m)["other/local.txt"]; !ok {
+		t.Errorf("newly selected local file not uploaded")
+	}
+
+	// unmodified files are removed once unselected, modified ones kept
+	writeTestFile(t, filepath.Join(dir_b, "other", "local.txt"), "changed")
+	selectAndSync("docs")
+	if exists("other/b.txt") || !exists("other/local.txt") {
+		t.Errorf("after unselecting other: b.txt %v, changed local.txt %v", exists("other/b.txt"), exists("other/local.txt"))
+	}
+	if meta := remoteFiles(t, m)["other/b.txt"]; meta == nil || IsTombstone(meta.BlockHashList) {
+		t.Errorf("unselecting removed the remote file: %v", meta)
+	}
+}
@@ -0,0 +1,77 @@
+package surfstore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// NewServerTLSCredentials loads a server certificate and key. When
+// clientCAFile is set, clients must present a certificate signed by one of
+// the CAs in it (mutual TLS).
+func NewServerTLSCredentials(certFile, keyFile, clientCAFile string) (credentials.TransportCredentials, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return credentials.NewTLS(config), nil
+}
+
+// NewClientTLSCredentials verifies servers against the CAs in caFile, or
+// the system roots when caFile is empty, and presents certFile/keyFile as
+// a client certificate when they are set.
+func NewClientTLSCredentials(caFile, certFile, keyFile string) (credentials.TransportCredentials, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return credentials.NewTLS(config), nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("No certificates found in %v", caFile)
+	}
+	return pool, nil
+}
+
+// transportDialOption secures a connection with creds, or leaves it in
+// plaintext when creds is nil.
+func transportDialOption(creds credentials.TransportCredentials) grpc.DialOption {
+	if creds == nil {
+		return grpc.WithInsecure()
+	}
+	return grpc.WithTransportCredentials(creds)
+}
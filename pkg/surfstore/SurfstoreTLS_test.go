@@ -0,0 +1,186 @@
+package surfstore
+
+import (
+	context "context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+)
+
+// testCA signs certificates for tests and writes them as PEM files.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	// PEM file of the CA certificate
+	file string
+	dir  string
+}
+
+func newTestCA(t *testing.T, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca := &testCA{cert: cert, key: key, dir: t.TempDir()}
+	ca.file = writePEM(t, ca.dir, name+".pem", "CERTIFICATE", der)
+	return ca
+}
+
+// issue signs a leaf certificate for localhost and returns its certificate
+// and key files.
+func (ca *testCA) issue(t *testing.T, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key_der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return writePEM(t, ca.dir, name+".pem", "CERTIFICATE", der), writePEM(t, ca.dir, name+".key", "EC PRIVATE KEY", key_der)
+}
+
+func writePEM(t *testing.T, dir string, name string, blockType string, der []byte) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// callBlockStore makes one call to the BlockStore at addr, nil creds
+// dialing in plaintext.
+func callBlockStore(t *testing.T, addr string, creds credentials.TransportCredentials) error {
+	conn, err := grpc.Dial(addr, transportDialOption(creds))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = NewBlockStoreClient(conn).HasBlocks(ctx, &BlockHashes{})
+	return err
+}
+
+func TestTLS(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	cert, key := ca.issue(t, "server")
+	server_creds, err := NewServerTLSCredentials(cert, key, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveBlockStore(t, NewBlockStore(), grpc.Creds(server_creds))
+
+	client_creds, err := NewClientTLSCredentials(ca.file, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := callBlockStore(t, addr, client_creds); err != nil {
+		t.Errorf("call over TLS failed: %v", err)
+	}
+	other_creds, err := NewClientTLSCredentials(newTestCA(t, "other").file, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := callBlockStore(t, addr, other_creds); err == nil {
+		t.Errorf("client trusted a server certificate of another CA")
+	}
+	if err := callBlockStore(t, addr, nil); err == nil {
+		t.Errorf("plaintext call to a TLS server succeeded")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	cert, key := ca.issue(t, "server")
+	server_creds, err := NewServerTLSCredentials(cert, key, ca.file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := serveBlockStore(t, NewBlockStore(), grpc.Creds(server_creds))
+
+	client_cert, client_key := ca.issue(t, "client")
+	client_creds, err := NewClientTLSCredentials(ca.file, client_cert, client_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := callBlockStore(t, addr, client_creds); err != nil {
+		t.Errorf("call with a client certificate failed: %v", err)
+	}
+
+	other_cert, other_key := newTestCA(t, "other").issue(t, "client")
+	wrong_ca_creds, err := NewClientTLSCredentials(ca.file, other_cert, other_key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := callBlockStore(t, addr, wrong_ca_creds); err == nil {
+		t.Errorf("server accepted a client certificate of another CA")
+	}
+	no_cert_creds, err := NewClientTLSCredentials(ca.file, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := callBlockStore(t, addr, no_cert_creds); err == nil {
+		t.Errorf("server accepted a client without certificate")
+	}
+}
+
+func TestTLSCredentialsCheckFiles(t *testing.T) {
+	ca := newTestCA(t, "ca")
+	cert, key := ca.issue(t, "server")
+	if _, err := NewServerTLSCredentials(cert, filepath.Join(ca.dir, "missing.key"), ""); err == nil {
+		t.Errorf("server credentials loaded without a key")
+	}
+	if _, err := NewServerTLSCredentials(cert, key, key); err == nil {
+		t.Errorf("client CA file without certificates accepted")
+	}
+	if _, err := NewClientTLSCredentials(filepath.Join(ca.dir, "missing.pem"), "", ""); err == nil {
+		t.Errorf("client credentials loaded without a CA file")
+	}
+	if _, err := NewClientTLSCredentials(ca.file, cert, ""); err == nil {
+		t.Errorf("client certificate loaded without its key")
+	}
+}
@@ -0,0 +1,208 @@
+package surfstore
+
+import (
+	context "context"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Throttle limits the bytes per second of one transfer direction with a
+// token bucket holding one second of traffic, and counts the bytes that
+// went through it. A nil Throttle neither limits nor counts.
+type Throttle struct {
+	limiter *rate.Limiter
+	total   int64
+}
+
+// NewThrottle returns a throttle; a limit of 0 means unlimited.
+func NewThrottle(bytesPerSecond int64) *Throttle {
+	t := &Throttle{limiter: rate.NewLimiter(rate.Inf, 0)}
+	t.SetLimit(bytesPerSecond)
+	return t
+}
+
+// SetLimit changes the limit of a throttle in use; 0 means unlimited.
+func (t *Throttle) SetLimit(bytesPerSecond int64) {
+	if bytesPerSecond <= 0 {
+		t.limiter.SetLimit(rate.Inf)
+		return
+	}
+	t.limiter.SetBurst(int(bytesPerSecond))
+	t.limiter.SetLimit(rate.Limit(bytesPerSecond))
+}
+
+// Wait blocks until n more bytes may be transferred, and counts them.
+func (t *Throttle) Wait(ctx context.Context, n int) error {
+	if t == nil {
+		return nil
+	}
+	atomic.AddInt64(&t.total, int64(n))
+	if t.limiter.Limit() == rate.Inf {
+		return nil
+	}
+	// a block may be larger than the bucket
+	for n > 0 {
+		chunk := n
+		if burst := t.limiter.Burst(); chunk > burst {
+			chunk = burst
+		}
+		if err := t.limiter.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// Total returns the bytes transferred so far.
+func (t *Throttle) Total() int64 {
+	if t == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&t.total)
+}
+
+// ParseRate parses a rate in bytes per second with an optional binary
+// k, M or G suffix, such as 512k; "off" and 0 mean unlimited.
+func ParseRate(s string) (int64, error) {
+	rate, err := parseByteCount(s)
+	if err != nil {
+		return 0, fmt.Errorf("Bad rate %v", s)
+	}
+	return rate, nil
+}
+
+// FormatRate formats bytes per second for humans.
+func FormatRate(bytesPerSecond float64) string {
+	return FormatBytes(bytesPerSecond) + "/s"
+}
+
+// FormatBytes formats a byte count with a binary unit.
+func FormatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %v", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %v", n, units[i])
+}
+
+// ScheduleWindow is a time of day during which a daemon may sync, with
+// optional rate limits overriding the default ones. A window whose end is
+// before its start runs past midnight; equal ends cover the whole day.
+type ScheduleWindow struct {
+	// Minutes after midnight
+	Start, End int
+	// Limits in bytes per second; nil keeps the default, 0 is unlimited
+	UploadLimit, DownloadLimit *int64
+}
+
+// Schedule is a list of windows; an empty schedule allows syncing at any time.
+type Schedule []ScheduleWindow
+
+// ParseSchedule parses comma-separated windows of the form
+// HH:MM-HH:MM[@upload[:download]], such as "22:00-07:00,07:00-22:00@256k:1M".
+func ParseSchedule(s string) (Schedule, error) {
+	var schedule Schedule
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		window := ScheduleWindow{}
+		times := item
+		if at := strings.IndexByte(item, '@'); at >= 0 {
+			times = item[:at]
+			limits := strings.SplitN(item[at+1:], ":", 2)
+			var err error
+			if window.UploadLimit, err = parseWindowRate(limits[0]); err != nil {
+				return nil, err
+			}
+			if len(limits) == 2 {
+				if window.DownloadLimit, err = parseWindowRate(limits[1]); err != nil {
+					return nil, err
+				}
+			}
+		}
+		ends := strings.Split(times, "-")
+		if len(ends) != 2 {
+			return nil, fmt.Errorf("Bad schedule window %v", item)
+		}
+		var err error
+		if window.Start, err = parseTimeOfDay(ends[0]); err != nil {
+			return nil, err
+		}
+		if window.End, err = parseTimeOfDay(ends[1]); err != nil {
+			return nil, err
+		}
+		schedule = append(schedule, window)
+	}
+	return schedule, nil
+}
+
+func parseWindowRate(s string) (*int64, error) {
+	if s == "" {
+		return nil, nil
+	}
+	limit, err := ParseRate(s)
+	if err != nil {
+		return nil, err
+	}
+	return &limit, nil
+}
+
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("Bad time of day %v", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// Contains reports whether the window covers the time of day of t.
+func (w ScheduleWindow) Contains(t time.Time) bool {
+	minute := t.Hour()*60 + t.Minute()
+	if w.Start == w.End {
+		return true
+	} else if w.Start < w.End {
+		return w.Start <= minute && minute < w.End
+	}
+	return minute >= w.Start || minute < w.End
+}
+
+// At returns the first window covering t; an empty schedule covers every
+// time with a window that keeps the default limits.
+func (s Schedule) At(t time.Time) (ScheduleWindow, bool) {
+	if len(s) == 0 {
+		return ScheduleWindow{}, true
+	}
+	for _, window := range s {
+		if window.Contains(t) {
+			return window, true
+		}
+	}
+	return ScheduleWindow{}, false
+}
+
+// Next returns how long after t the next window opens.
+func (s Schedule) Next(t time.Time) time.Duration {
+	var next time.Duration
+	for i, window := range s {
+		start := time.Date(t.Year(), t.Month(), t.Day(), window.Start/60, window.Start%60, 0, 0, t.Location())
+		if !start.After(t) {
+			start = start.AddDate(0, 0, 1)
+		}
+		if wait := start.Sub(t); i == 0 || wait < next {
+			next = wait
+		}
+	}
+	return next
+}
@@ -0,0 +1,179 @@
+package surfstore
+
+import (
+	context "context"
+	"testing"
+	"time"
+)
+
+// at returns a time of day on 2024-03-01.
+func at(hour int, minute int) time.Time {
+	return time.Date(2024, 3, 1, hour, minute, 0, 0, time.UTC)
+}
+
+func limitString(limit *int64) string {
+	if limit == nil {
+		return "default"
+	}
+	return FormatRate(float64(*limit))
+}
+
+func TestParseSchedule(t *testing.T) {
+	cases := []struct {
+		spec             string
+		start, end       int
+		upload, download string
+	}{
+		{"22:00-07:00", 22 * 60, 7 * 60, "default", "default"},
+		{" 07:30-19:00@256k:1M", 7*60 + 30, 19 * 60, "256.0 KiB/s", "1.0 MiB/s"},
+		{"00:00-00:00@64k", 0, 0, "64.0 KiB/s", "default"},
+		{"01:00-02:00@:1M", 60, 120, "default", "1.0 MiB/s"},
+		{"01:00-02:00@off:off", 60, 120, "0 B/s", "0 B/s"},
+		{"01:00-02:00@", 60, 120, "default", "default"},
+	}
+	for _, c := range cases {
+		schedule, err := ParseSchedule(c.spec)
+		if err != nil || len(schedule) != 1 {
+			t.Errorf("ParseSchedule(%q) = %v, %v", c.spec, schedule, err)
+			continue
+		}
+		w := schedule[0]
+		if w.Start != c.start || w.End != c.end || limitString(w.UploadLimit) != c.upload || limitString(w.DownloadLimit) != c.download {
+			t.Errorf("ParseSchedule(%q) = %d-%d@%v:%v", c.spec, w.Start, w.End, limitString(w.UploadLimit), limitString(w.DownloadLimit))
+		}
+	}
+	schedule, err := ParseSchedule("22:00-07:00@off, ,07:00-22:00@64k,")
+	if err != nil || len(schedule) != 2 {
+		t.Errorf("two windows parsed as %v, %v", schedule, err)
+	}
+	if schedule, err := ParseSchedule(""); err != nil || len(schedule) != 0 {
+		t.Errorf("empty schedule parsed as %v, %v", schedule, err)
+	}
+}
+
+func TestParseScheduleErrors(t *testing.T) {
+	for _, spec := range []string{
+		"22:00",
+		"22:00-07:00-08:00",
+		"25:00-07:00",
+		"22:00-7",
+		"22:00-07:00@fast",
+		"22:00-07:00@1k:-1k",
+		"22:00-07:00,nonsense",
+	} {
+		if schedule, err := ParseSchedule(spec); err == nil {
+			t.Errorf("ParseSchedule(%q) = %v, want an error", spec, schedule)
+		}
+	}
+}
+
+func TestScheduleWindowContains(t *testing.T) {
+	day := ScheduleWindow{Start: 7 * 60, End: 19 * 60}
+	night := ScheduleWindow{Start: 22 * 60, End: 7 * 60}
+	whole := ScheduleWindow{Start: 12 * 60, End: 12 * 60}
+	cases := []struct {
+		window ScheduleWindow
+		t      time.Time
+		want   bool
+	}{
+		{day, at(7, 0), true},
+		{day, at(18, 59), true},
+		{day, at(19, 0), false},
+		{day, at(6, 59), false},
+		{night, at(22, 0), true},
+		{night, at(23, 59), true},
+		{night, at(0, 0), true},
+		{night, at(6, 59), true},
+		{night, at(7, 0), false},
+		{night, at(12, 0), false},
+		{whole, at(0, 0), true},
+		{whole, at(11, 59), true},
+		{whole, at(23, 59), true},
+	}
+	for _, c := range cases {
+		if got := c.window.Contains(c.t); got != c.want {
+			t.Errorf("%d-%d contains %v = %v, want %v", c.window.Start, c.window.End, c.t.Format("15:04"), got, c.want)
+		}
+	}
+}
+
+func TestScheduleAtAndNext(t *testing.T) {
+	schedule, err := ParseSchedule("09:00-10:00@1k,22:00-02:00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w, ok := schedule.At(at(9, 30)); !ok || w.Start != 9*60 {
+		t.Errorf("At(09:30) = %v, %v", w, ok)
+	}
+	if w, ok := schedule.At(at(1, 0)); !ok || w.Start != 22*60 {
+		t.Errorf("At(01:00) = %v, %v", w, ok)
+	}
+	if _, ok := schedule.At(at(12, 0)); ok {
+		t.Errorf("At(12:00) found a window")
+	}
+	if _, ok := Schedule(nil).At(at(12, 0)); !ok {
+		t.Errorf("empty schedule does not cover every time")
+	}
+
+	cases := []struct {
+		t    time.Time
+		want time.Duration
+	}{
+		{at(8, 0), time.Hour},
+		{at(12, 0), 10 * time.Hour},
+		// both windows started today, so the next one opens tomorrow
+		{at(23, 0), 10 * time.Hour},
+		{at(22, 0), 11 * time.Hour},
+		{at(3, 30), 5*time.Hour + 30*time.Minute},
+		{at(8, 59).Add(30 * time.Second), 30 * time.Second},
+	}
+	for _, c := range cases {
+		if got := schedule.Next(c.t); got != c.want {
+			t.Errorf("Next(%v) = %v, want %v", c.t.Format("15:04:05"), got, c.want)
+		}
+	}
+}
+
+func TestThrottleWait(t *testing.T) {
+	ctx := context.Background()
+	var none *Throttle
+	if err := none.Wait(ctx, 1<<20); err != nil || none.Total() != 0 {
+		t.Errorf("nil throttle: %v, total %d", err, none.Total())
+	}
+
+	unlimited := NewThrottle(0)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		if err := unlimited.Wait(ctx, 1<<30); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond || unlimited.Total() != 10<<30 {
+		t.Errorf("unlimited throttle took %v, total %d", elapsed, unlimited.Total())
+	}
+
+	// the bucket starts full with one second of traffic, and a block larger
+	// than the bucket waits for the rest
+	limited := NewThrottle(10000)
+	start = time.Now()
+	if err := limited.Wait(ctx, 15000); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("15000 bytes at 10000 B/s took %v", elapsed)
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := limited.Wait(cancelled, 10000); err == nil {
+		t.Errorf("Wait did not stop on a cancelled context")
+	}
+
+	limited.SetLimit(0)
+	start = time.Now()
+	if err := limited.Wait(ctx, 1<<20); err != nil || time.Since(start) > 100*time.Millisecond {
+		t.Errorf("throttle still limits after SetLimit(0): %v", err)
+	}
+	if limited.Total() != 15000+10000+1<<20 {
+		t.Errorf("total = %d", limited.Total())
+	}
+}
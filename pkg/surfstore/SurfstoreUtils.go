@@ -2,256 +2,583 @@ package surfstore
 
 import (
 	"bufio"
+	context "context"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"os"
 	"path/filepath"
-	"reflect"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
+// SyncResult lists what a sync changed.
+type SyncResult struct {
+	BaseDir string `json:"baseDir"`
+	// Sent with every RPC of the sync and logged by the servers
+	RequestID string    `json:"requestId"`
+	Started   time.Time `json:"started"`
+	// Duration in seconds
+	Duration   float64  `json:"duration"`
+	Uploaded   []string `json:"uploaded"`
+	Downloaded []string `json:"downloaded"`
+	Removed    []string `json:"removed"`
+	// Local changes rejected because another client updated the file
+	// first; the remote version replaced them
+	Conflicts []string `json:"conflicts"`
+	// Every file the sync changed or stopped at, in order
+	Files           []*FileReport `json:"files"`
+	BytesUploaded   int64         `json:"bytesUploaded"`
+	BytesDownloaded int64         `json:"bytesDownloaded"`
+	// Why the sync stopped early
+	Error string `json:"error,omitempty"`
+}
+
 // Implement the logic for a client syncing with the server here.
-func ClientSync(client RPCClient) {
-	// Scan base directory
-	local_files := make(map[string]*[]string)
-	entries, err := ioutil.ReadDir(client.BaseDir)
+//
+// Cancelling ctx stops the sync between blocks. Every file that was fully
+// uploaded or downloaded is still recorded in the index and every other
+// file keeps its old entry, so the next sync carries on from there. Steps
+// are also journaled, so the same holds after a crash. The result is
+// returned on failure too, listing the files done before.
+//
+// The sync runs under the request ID of ctx, or a new one if it has none.
+func ClientSync(ctx context.Context, client RPCClient) (*SyncResult, error) {
+	if RequestIDFromContext(ctx) == "" {
+		ctx = WithRequestID(ctx, NewRequestID())
+	}
+	result := &SyncResult{BaseDir: client.BaseDir, RequestID: RequestIDFromContext(ctx), Started: time.Now(),
+		Uploaded: []string{}, Downloaded: []string{}, Removed: []string{}, Conflicts: []string{},
+		Files: []*FileReport{}}
+	logger := client.Logger.WithContext(ctx).With("base_dir", client.BaseDir)
+	logger.Debug("Sync started")
+	err := clientSync(ctx, client, result)
+	result.Duration = time.Since(result.Started).Seconds()
 	if err != nil {
-		panic(err)
+		result.Error = err.Error()
+		logger.Info("Sync failed", "error", err, "files_done", len(result.Files))
+	} else {
+		logger.Info("Sync finished", "uploaded", len(result.Uploaded), "downloaded", len(result.Downloaded),
+			"removed", len(result.Removed), "conflicts", len(result.Conflicts), "duration", time.Since(result.Started))
 	}
+	return result, err
+}
 
-	for _, file := range entries {
-		if file.Name() == "index.txt" {
-			continue
-		}
-		hash_list := ComputeHashList(filepath.Join(client.BaseDir, file.Name()), client.BlockSize)
-		local_files[file.Name()] = hash_list
+func clientSync(ctx context.Context, client RPCClient, result *SyncResult) error {
+	partials, err := recoverSyncJournal(client.BaseDir, client.Logger.WithContext(ctx))
+	if err != nil {
+		return localIOError("recover", client.BaseDir, err)
 	}
-
-	// Read metadata from index.txt
-	local_metadata, err := LoadMetaFromMetaFile(client.BaseDir)
+	plan, err := PlanSync(ctx, client)
 	if err != nil {
-		panic(err)
+		return err
 	}
-
-	// Check if there is any new added/changed/deleted file
-	// Otherwise, the filemeta.version will increment by 1
-	log.Println("Consulting local index file")
-	updated := make(map[string]*FileMetaData)
-	unchanged := make(map[string]*FileMetaData)
-	deleted_mark := []string{"0"}
-	for _, v := range local_metadata {
-		local_hashlist, ok := local_files[v.Filename]
-		if !ok {
-			log.Printf("File %v is deleted since last time", v.Filename)
-			updated[v.Filename] = &FileMetaData{Filename: v.Filename, Version: v.Version + 1, BlockHashList: deleted_mark}
-		} else if !reflect.DeepEqual(*local_hashlist, v.BlockHashList) {
-			log.Printf("File %v is changed since last time", v.Filename)
-			updated[v.Filename] = &FileMetaData{Filename: v.Filename, Version: v.Version + 1, BlockHashList: *local_hashlist}
-		} else {
-			log.Printf("File %v doesn't change since last time", v.Filename)
-			unchanged[v.Filename] = v
+	keep := make(map[string]bool)
+	for _, partial := range partials {
+		keep[filepath.Join(client.BaseDir, partial.TempFile)] = true
+	}
+	for _, dir := range plan.dirs {
+		if err := RemoveTempFiles(filepath.Join(client.BaseDir, dir), keep, plan.logger); err != nil {
+			return localIOError("clean", filepath.Join(client.BaseDir, dir), err)
 		}
 	}
-	for k, v := range local_files {
-		if _, ok := local_metadata[k]; !ok {
-			log.Printf("File %v is added since last time", k)
-			updated[k] = &FileMetaData{Filename: k, Version: 1, BlockHashList: *v}
+
+	new_index := NewLocalIndex(plan.hashParams)
+	new_index.Selection = plan.selection
+	for filename, metadata := range plan.final {
+		new_index.Entries[filename] = plan.indexEntry(metadata, plan.localStats[filename])
+	}
+	for _, change := range plan.Changes {
+		if entry, ok := plan.index.Entries[change.Filename]; ok {
+			// forget the stat so the file is rehashed next time
+			new_index.Entries[change.Filename] = NewIndexEntry(entry.FileMetaData())
 		}
 	}
 
-	// Get remote filemap
-	remote_file_map := make(map[string]*FileMetaData)
-	final_filemeta := make(map[string]*FileMetaData)
-	err = client.GetFileInfoMap(&remote_file_map)
+	journal, err := createSyncJournal(client.BaseDir, plan.hashParams)
 	if err != nil {
-		panic(err)
+		return localIOError("journal", client.BaseDir, err)
 	}
+	err = syncChanges(ctx, client, plan, result, new_index, journal, partials)
 
-	// Get block store addr
-	var blockStoreAddr string
-	err = client.GetBlockStoreAddr(&blockStoreAddr)
+	// Write index back, also after a failure
+	if index_err := WriteLocalIndex(new_index, client.BaseDir); index_err != nil && err == nil {
+		err = localIOError("write index", client.BaseDir, index_err)
+	}
 	if err != nil {
-		panic(err)
+		// keep the journal for partial downloads
+		journal.close()
+		return err
 	}
+	if err := journal.remove(); err != nil {
+		return localIOError("journal", client.BaseDir, err)
+	}
+	return nil
+}
 
-	// Iterate over all remote files
-	// to check if they can be updated
-	var willupdate_metadata []FileMetaData
-	for filename, metadata := range remote_file_map {
-		update_file, ok := updated[filename]
-		use_local := false
-		if ok {
-			if update_file.Version == metadata.Version+1 {
-				// Upload all blocks
-				log.Printf("Changing remote file %v, uploading...", update_file.Filename)
-				err = UploadFileBlocks(client, update_file, blockStoreAddr)
-				if err != nil {
-					panic(err)
-				}
+// syncChanges carries out a plan, recording each completed file in index
+// and journal, and reporting it in result and to the client's reporter.
+func syncChanges(ctx context.Context, client RPCClient, plan *SyncPlan, result *SyncResult, index *LocalIndex,
+	journal *syncJournal, partials map[string]*partialDownload) error {
+	for _, change := range plan.Changes {
+		if err := journal.plan(change); err != nil {
+			return err
+		}
+	}
+	if client.Progress != nil {
+		client.Progress.Planned(plan.Changes)
+	}
 
-				// try to update fileinto
-				var latestVersion int32
-				err = client.UpdateFile(update_file, &latestVersion)
-				if err != nil {
-					panic(err)
-				}
-				if latestVersion == -1 {
-					log.Printf("Updating for %v is rejected, add to download list", update_file.Filename)
-					update_file, err = client.GetUpdatedMetadata(filename)
-					if err != nil {
-						panic(err)
-					}
-					// Then it is rejected
-					// We add it to update list
-					willupdate_metadata = append(willupdate_metadata, FileMetaData{Filename: metadata.Filename,
-						Version:       update_file.Version,
-						BlockHashList: update_file.BlockHashList})
-					use_local = true
-				} else {
-					log.Printf("Successfully sync local changes to cloud")
-					use_local = true
-				}
-			} else {
-				log.Printf("Local file %v changed but stale, overwrite it", update_file.Filename)
-				willupdate_metadata = append(willupdate_metadata, FileMetaData{Filename: metadata.Filename,
-					Version:       metadata.Version,
-					BlockHashList: metadata.BlockHashList})
+	// Upload the blocks of every local change, then publish the new
+	// versions together; remote changes and rejected pushes are collected
+	// into the download list
+	var willupdate, uploads []*FileChange
+	for _, change := range plan.Changes {
+		if change.Action != ActionUpload {
+			if change.Status == StatusConflict {
+				result.Conflicts = append(result.Conflicts, change.Filename)
 			}
-		} else {
-			unchanged_file, ok := unchanged[filename]
-			if !ok || unchanged_file.Version < metadata.Version {
-				log.Printf("Remote file %v not found or stale, overwrite it", filename)
-				willupdate_metadata = append(willupdate_metadata, FileMetaData{Filename: metadata.Filename,
-					Version:       metadata.Version,
-					BlockHashList: metadata.BlockHashList})
-			} else {
-				log.Printf("Remote file %v is identical to local, use_local: %v", filename, use_local)
+			willupdate = append(willupdate, change)
+			continue
+		}
+
+		// Upload all blocks
+		plan.logger.Debug("Uploading", "file", change.Filename, "version", change.meta.Version)
+		if client.Progress != nil {
+			client.Progress.Started(change)
+		}
+		err := UploadFileBlocks(ctx, client, change.meta, plan.ring)
+		if err != nil {
+			return result.fail(client, change, err)
+		}
+		uploads = append(uploads, change)
+	}
+
+	committed, conflicts, err := commitUploads(ctx, client, plan, uploads)
+	done := make(map[string]bool)
+	for _, change := range committed {
+		if err := journal.commit(change.meta); err != nil {
+			return err
+		}
+		done[change.Filename] = true
+		result.Uploaded = append(result.Uploaded, change.Filename)
+		index.Entries[change.Filename] = plan.indexEntry(change.meta, plan.localStats[change.Filename])
+		result.finish(client, change, ResultUploaded, change.Bytes)
+	}
+	if err != nil {
+		for _, change := range uploads {
+			if !done[change.Filename] {
+				result.fail(client, change, err)
 			}
 		}
-		if !use_local {
-			final_filemeta[filename] = metadata
+		return err
+	}
+	for _, updated_file := range conflicts {
+		if err := journal.planDownload(updated_file); err != nil {
+			return err
+		}
+		result.Conflicts = append(result.Conflicts, updated_file.Filename)
+		download := &FileChange{Status: StatusConflict, meta: updated_file}
+		plan.describeChange(download, downloadAction(updated_file), updated_file)
+		willupdate = append(willupdate, download)
+	}
+
+	for _, change := range willupdate {
+		metadata := change.meta
+		if client.Progress != nil {
+			client.Progress.Started(change)
+		}
+		err := updateLocalFile(ctx, client, metadata, plan.ring, journal, partials[metadata.Filename])
+		if err != nil {
+			return result.fail(client, change, err)
+		}
+		// Downloaded files have a new stat; files no longer selected leave the index
+		entry := plan.indexEntry(metadata, nil)
+		if plan.selection.Selected(metadata.Filename) {
+			index.Entries[metadata.Filename] = entry
+		} else {
+			delete(index.Entries, metadata.Filename)
+		}
+		if IsTombstone(metadata.BlockHashList) {
+			result.Removed = append(result.Removed, metadata.Filename)
+			result.finish(client, change, ResultRemoved, 0)
 		} else {
-			final_filemeta[filename] = update_file
+			result.Downloaded = append(result.Downloaded, metadata.Filename)
+			result.finish(client, change, ResultDownloaded, entry.Size)
 		}
 	}
+	return nil
+}
 
-	// Check if there are any new files that can be uploaded
-	for filename, metadata := range updated {
-		_, ok := remote_file_map[filename]
-		if !ok {
-			log.Printf("local file %v is newly created, uploading...", filename)
-			err = UploadFileBlocks(client, metadata, blockStoreAddr)
-			if err != nil {
-				panic(err)
+// commitUploads publishes the uploaded versions with one CommitBatch, so
+// other clients see all of them or none. Files another client updated
+// first are left out and the rest committed again; their remote versions
+// are returned for download. MetaStores without CommitBatch get one
+// conditional update per file; the files committed before a failure are
+// then returned with the error.
+func commitUploads(ctx context.Context, client RPCClient, plan *SyncPlan, uploads []*FileChange) ([]*FileChange, []*FileMetaData, error) {
+	var conflicts []*FileMetaData
+	pending := uploads
+	for len(pending) > 0 {
+		files := make([]*FileMetaData, len(pending))
+		for i, change := range pending {
+			files[i] = change.meta
+		}
+		var rejected []*FileMetaData
+		err := client.CommitBatch(ctx, files, &rejected)
+		if status.Code(err) == codes.Unimplemented {
+			return commitEach(ctx, client, plan, pending, conflicts)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(rejected) == 0 {
+			return pending, conflicts, nil
+		}
+		rejected_names := make(map[string]bool)
+		for _, meta := range rejected {
+			plan.logger.Info("Upload rejected by a newer remote version", "file", meta.Filename)
+			rejected_names[meta.Filename] = true
+		}
+		conflicts = append(conflicts, rejected...)
+		var remaining []*FileChange
+		for _, change := range pending {
+			if !rejected_names[change.Filename] {
+				remaining = append(remaining, change)
 			}
+		}
+		pending = remaining
+	}
+	return nil, conflicts, nil
+}
 
-			var latestVersion int32
-			err = client.UpdateFile(metadata, &latestVersion)
-			if latestVersion == -1 {
-				log.Printf("Updating remote index for file %v is rejected, overwrite it", filename)
-				updated_file, err := client.GetUpdatedMetadata(filename)
-				if err != nil {
-					panic(err)
-				}
-				willupdate_metadata = append(willupdate_metadata, FileMetaData{Filename: metadata.Filename,
-					Version:       updated_file.Version,
-					BlockHashList: updated_file.BlockHashList})
-				final_filemeta[filename] = updated_file
-			} else {
-				final_filemeta[filename] = metadata
-			}
+// commitEach publishes the uploaded versions one conditional update at a
+// time.
+func commitEach(ctx context.Context, client RPCClient, plan *SyncPlan, uploads []*FileChange,
+	conflicts []*FileMetaData) ([]*FileChange, []*FileMetaData, error) {
+	var committed []*FileChange
+	for _, change := range uploads {
+		var result UpdateResult
+		if err := client.UpdateFileIf(ctx, expectPrevious(change.meta), &result); err != nil {
+			return committed, nil, err
+		}
+		if result.Reason == UpdateReason_UPDATE_APPLIED {
+			committed = append(committed, change)
+			continue
+		}
+		plan.logger.Info("Upload rejected by a newer remote version", "file", change.Filename, "reason", result.Reason)
+		if result.Current == nil {
+			return committed, nil, conflictError("UpdateFileIf", change.Filename, errors.New("File vanished from the server"))
 		}
+		conflicts = append(conflicts, result.Current)
 	}
+	return committed, conflicts, nil
+}
 
-	UpdateLocalFiles(client, willupdate_metadata, blockStoreAddr)
-	// Write index back
-	err = WriteMetaFile(final_filemeta, client.BaseDir)
-	if err != nil {
-		panic(err)
+// expectPrevious makes an update of a file conditional on the version
+// before meta, so that it only applies on top of what meta was based on.
+func expectPrevious(meta *FileMetaData) *ConditionalUpdate {
+	return &ConditionalUpdate{File: meta, Expected: &ConditionalUpdate_ExpectedVersion{ExpectedVersion: meta.Version - 1}}
+}
+
+// finish records a file the sync completed.
+func (result *SyncResult) finish(client RPCClient, change *FileChange, outcome FileResult, bytes int64) {
+	report := &FileReport{Filename: change.Filename, Status: change.Status, Action: change.Action,
+		Result: outcome, Version: change.meta.Version, Bytes: bytes}
+	result.Files = append(result.Files, report)
+	client.Logger.With("request_id", result.RequestID).Info("File "+string(outcome), "file", change.Filename,
+		"status", change.Status, "version", report.Version, "bytes", bytes)
+	switch outcome {
+	case ResultUploaded:
+		result.BytesUploaded += bytes
+	case ResultDownloaded:
+		result.BytesDownloaded += bytes
+	}
+	if client.Progress != nil {
+		client.Progress.Finished(report)
 	}
 }
 
-func UploadFileBlocks(client RPCClient, file *FileMetaData, blockStoreAddr string) error {
-	// skip if file is marked deleted
-	if len(file.BlockHashList) == 1 {
-		if file.BlockHashList[0] == "0" {
-			return nil
+// fail records the file the sync stopped at and returns err.
+func (result *SyncResult) fail(client RPCClient, change *FileChange, err error) error {
+	report := &FileReport{Filename: change.Filename, Status: change.Status, Action: change.Action,
+		Result: ResultFailed, Version: change.meta.Version, Error: err.Error()}
+	result.Files = append(result.Files, report)
+	if client.Progress != nil {
+		client.Progress.Finished(report)
+	}
+	return err
+}
+
+// indexEntry records metadata in the index together with the stat of the
+// local file; info is looked up when nil. A stat from the scan is as old
+// as the scan, the hash list it goes with may be older than a new lookup.
+func (plan *SyncPlan) indexEntry(metadata *FileMetaData, info os.FileInfo) *IndexEntry {
+	entry := NewIndexEntry(metadata)
+	hashed_at := plan.scanned
+	if info == nil {
+		hashed_at = time.Now()
+		path := filepath.Join(plan.BaseDir, filepath.FromSlash(metadata.Filename))
+		lstat, err := os.Lstat(path)
+		if err != nil {
+			return entry
+		}
+		policy := plan.symlinks
+		if IsSymlink(metadata) {
+			policy = SymlinkPreserve
+		}
+		var ok bool
+		if info, ok = localFileInfo(path, lstat, policy); !ok {
+			return entry
 		}
 	}
-	var blockHashesOut []string
-	err := client.HasBlocks(file.BlockHashList, blockStoreAddr, &blockHashesOut)
-	if err != nil {
-		panic(err)
+	if !IsSymlink(metadata) {
+		entry.Mode = uint32(info.Mode().Perm())
 	}
+	entry.SetStat(info, hashed_at)
+	return entry
+}
 
+// indexHashParams describes the settings that cached hash lists depend on.
+func indexHashParams(client RPCClient) string {
+	params := fmt.Sprintf("blockSize=%d", client.BlockSize)
+	if client.Cipher != nil {
+		params += ",key=" + client.Cipher.KeyID()
+	}
+	return params
+}
+
+func UploadFileBlocks(ctx context.Context, client RPCClient, file *FileMetaData, ring *ConsistentHashRing) error {
+	// skip if file is marked deleted or has no blocks of its own
+	if IsTombstone(file.BlockHashList) || IsSymlink(file) {
+		return nil
+	}
+	// ask every block store about the blocks it is responsible for
+	server_hashes := make(map[string][]string)
+	for blk_hash, addr := range ring.OutputMap(&file.BlockHashList) {
+		server_hashes[addr] = append(server_hashes[addr], blk_hash)
+	}
 	block_set := make(map[string]bool)
-	for _, blk_hash := range blockHashesOut {
-		block_set[blk_hash] = true
+	for addr, hashes := range server_hashes {
+		var blockHashesOut []string
+		err := client.HasBlocks(ctx, hashes, addr, &blockHashesOut)
+		if err != nil {
+			return err
+		}
+		for _, blk_hash := range blockHashesOut {
+			block_set[blk_hash] = true
+		}
 	}
 
 	// Upload any block that is not exist
-	f, err := os.OpenFile(filepath.Join(client.BaseDir, file.Filename), os.O_RDONLY, 0644)
+	path := filepath.Join(client.BaseDir, filepath.FromSlash(file.Filename))
+	block_sizes, err := uploadBlocksFrom(ctx, client, path, ring)
 	if err != nil {
-		panic(err)
+		return err
 	}
+	if len(block_sizes) != len(file.BlockHashList) {
+		return localIOError("read", path, errors.New("File changed during the upload"))
+	}
+	file.BlockSizeList = block_sizes
+	return nil
+}
+
+// uploadBlocksFrom splits the file at path into blocks, puts each of them
+// on the block store responsible for it and returns their sizes, which the
+// MetaStore counts against the quota.
+func uploadBlocksFrom(ctx context.Context, client RPCClient, path string, ring *ConsistentHashRing) ([]int32, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY, 0644)
+	if err != nil {
+		return nil, localIOError("open", path, err)
+	}
+	defer f.Close()
 	reader := bufio.NewReader(f)
 	buf := make([]byte, client.BlockSize)
 	var blk Block
+	var block_sizes []int32
 	for {
 		n, err := io.ReadFull(reader, buf)
 		var flg bool
 		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
-			panic(err)
+			return nil, localIOError("read", path, err)
+		}
+		// the hash list has no block for the empty read at the end
+		if n == 0 {
+			break
 		}
-		blk.BlockData = buf
-		blk.BlockSize = int32(n)
-		put_err := client.PutBlock(&blk, blockStoreAddr, &flg)
-		if !flg || put_err != nil {
-			return errors.New("Unable to upload blocks")
+		// encrypt before the block leaves the client
+		blk.BlockData = SealBlock(client.Cipher, buf[:n])
+		blk.BlockSize = int32(len(blk.BlockData))
+		put_err := client.PutBlock(ctx, &blk, ring.GetResponsibleServer(GetBlockHashString(blk.BlockData)), &flg)
+		if put_err != nil {
+			return nil, put_err
 		}
+		if !flg {
+			return nil, networkError("PutBlock", errors.New("Unable to upload blocks"))
+		}
+		block_sizes = append(block_sizes, blk.BlockSize)
+		client.reportTransferred(int64(n))
 		if err != nil {
 			break
 		}
 	}
 
-	return nil
+	return block_sizes, nil
 }
 
-func UpdateLocalFiles(client RPCClient, update_files []FileMetaData, blockStoreAddr string) {
-	log.Printf("Start updating all local files")
+func UpdateLocalFiles(ctx context.Context, client RPCClient, update_files []FileMetaData, ring *ConsistentHashRing) error {
 	for i := 0; i < len(update_files); i++ {
-		err := RemoveIfExist(filepath.Join(client.BaseDir, update_files[i].Filename))
-		if err != nil {
-			panic(err)
+		if err := updateLocalFile(ctx, client, &update_files[i], ring, nil, nil); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		if len(update_files[i].BlockHashList) == 1 && update_files[i].BlockHashList[0] == "0" {
-			continue
-		}
+// updateLocalFile replaces or removes one local file. Blocks are checked
+// against the hash list and staged in a temp file that is renamed over the
+// old file, so the old file survives any failure and keeps its permissions.
+// The temp file of an interrupted download of the same version is reused,
+// and progress is journaled so a later sync can reuse this one.
+func updateLocalFile(ctx context.Context, client RPCClient, metadata *FileMetaData, ring *ConsistentHashRing,
+	journal *syncJournal, partial *partialDownload) error {
+	path := filepath.Join(client.BaseDir, filepath.FromSlash(metadata.Filename))
+	// the plan skips such files; the tree may have changed since
+	if parent, err := symlinkedParent(client.BaseDir, metadata.Filename); err != nil {
+		return localIOError("stat", path, err)
+	} else if parent != "" {
+		return localIOError("write", path, fmt.Errorf("Parent directory %v is a symlink", parent))
+	}
+	if IsTombstone(metadata.BlockHashList) {
 		// remove the file if exists
+		if err := RemoveIfExist(path); err != nil {
+			return localIOError("remove", path, err)
+		}
+		removeEmptyDirs(client.BaseDir, filepath.Dir(path))
+		return journal.done(metadata)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return localIOError("mkdir", filepath.Dir(path), err)
+	}
+	if IsSymlink(metadata) {
+		if client.Symlinks != SymlinkPreserve || !IsLocalSymlinkTarget(metadata.Filename, metadata.SymlinkTarget) {
+			return localIOError("symlink", path, fmt.Errorf("Refusing to create a symlink to %v", metadata.SymlinkTarget))
+		}
+		if err := replaceWithSymlink(path, metadata.SymlinkTarget); err != nil {
+			return localIOError("symlink", path, err)
+		}
+		return journal.done(metadata)
+	}
 
-		f, err := os.OpenFile(filepath.Join(client.BaseDir, update_files[i].Filename), os.O_CREATE|os.O_WRONLY, 0644)
+	tmp, blocks, offset, err := openDownloadFile(client.BaseDir, metadata, partial, client.Cipher)
+	if err != nil {
+		return localIOError("create", path, err)
+	}
+	// the journal names temp files relative to the base directory
+	tmp_name, err := filepath.Rel(client.BaseDir, tmp.Name())
+	if err != nil {
+		tmp.Close()
+		return localIOError("create", path, err)
+	}
+	if blocks > 0 {
+		client.Logger.WithContext(ctx).Info("Resuming download", "file", metadata.Filename, "block", blocks)
+		client.reportTransferred(offset)
+		if err := journal.progress(metadata, tmp_name, blocks, offset); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+	// on failure the temp file stays behind for the next sync
+	writer := bufio.NewWriter(tmp)
+	for i := blocks; i < len(metadata.BlockHashList); i++ {
+		data, err := fetchBlock(ctx, client, metadata.BlockHashList[i], ring)
 		if err != nil {
-			panic(err)
+			tmp.Close()
+			return err
 		}
-		writer := bufio.NewWriter(f)
-
-		for _, hash := range update_files[i].BlockHashList {
-			blk := &Block{}
-			err = client.GetBlock(hash, blockStoreAddr, blk)
-			if err != nil {
-				panic(err)
+		if _, err := writer.Write(data); err != nil {
+			tmp.Close()
+			return localIOError("write", tmp.Name(), err)
+		}
+		offset += int64(len(data))
+		client.reportTransferred(int64(len(data)))
+		if (i+1)%JOURNAL_PROGRESS_INTERVAL == 0 && journal != nil {
+			if err := writer.Flush(); err != nil {
+				tmp.Close()
+				return localIOError("write", tmp.Name(), err)
+			}
+			if err := tmp.Sync(); err != nil {
+				tmp.Close()
+				return localIOError("sync", tmp.Name(), err)
 			}
-			log.Printf("Writing block data: %v", string(blk.BlockData[:blk.BlockSize]))
-			_, err := writer.Write(blk.BlockData[:blk.BlockSize])
-			if err != nil {
-				panic(err)
+			if err := journal.progress(metadata, tmp_name, i+1, offset); err != nil {
+				tmp.Close()
+				return err
 			}
 		}
-		err = writer.Flush()
-		if err != nil {
-			panic(err)
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return localIOError("write", tmp.Name(), err)
+	}
+	perm := FilePerm(path, 0644)
+	if metadata.Mode != 0 {
+		perm = os.FileMode(metadata.Mode) & os.ModePerm
+	}
+	if err := restoreFileMetaData(tmp.Name(), metadata); err != nil {
+		tmp.Close()
+		return localIOError("chtimes", tmp.Name(), err)
+	}
+	if err := renameTempFile(tmp, path, perm); err != nil {
+		os.Remove(tmp.Name())
+		return localIOError("replace", path, err)
+	}
+	return journal.done(metadata)
+}
+
+// openDownloadFile reopens the temp file of a partial download of the same
+// version, cut back to its journaled blocks once they hash to the hash
+// list, or creates a new temp file. It returns the file, the number of
+// blocks already in it and their size.
+func openDownloadFile(baseDir string, metadata *FileMetaData, partial *partialDownload,
+	cipher *BlockCipher) (*os.File, int, int64, error) {
+	if partial != nil && partial.Version == metadata.Version && SameHashList(partial.BlockHashList, metadata.BlockHashList) {
+		tmp, err := os.OpenFile(filepath.Join(baseDir, partial.TempFile), os.O_RDWR, 0)
+		if err == nil {
+			info, err := tmp.Stat()
+			if err == nil && info.Size() >= partial.Offset && verifyPartialDownload(tmp, partial, cipher) &&
+				tmp.Truncate(partial.Offset) == nil {
+				if _, err := tmp.Seek(partial.Offset, io.SeekStart); err == nil {
+					return tmp, partial.Blocks, partial.Offset, nil
+				}
+			}
+			tmp.Close()
+		}
+	}
+	dir, base := filepath.Split(filepath.Join(baseDir, filepath.FromSlash(metadata.Filename)))
+	tmp, err := ioutil.TempFile(dir, TEMP_FILE_PREFIX+base+".")
+	return tmp, 0, 0, err
+}
+
+// verifyPartialDownload rehashes the blocks a partial download claims to
+// hold. Every block but the last of a file has the same size, so the
+// journaled blocks, which never include the last, split the prefix evenly.
+func verifyPartialDownload(tmp *os.File, partial *partialDownload, cipher *BlockCipher) bool {
+	if partial.Blocks <= 0 || partial.Blocks >= len(partial.BlockHashList) || partial.Offset%int64(partial.Blocks) != 0 {
+		return false
+	}
+	buf := make([]byte, partial.Offset/int64(partial.Blocks))
+	reader := bufio.NewReader(io.NewSectionReader(tmp, 0, partial.Offset))
+	for i := 0; i < partial.Blocks; i++ {
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return false
+		}
+		if GetBlockHashString(SealBlock(cipher, buf)) != partial.BlockHashList[i] {
+			return false
 		}
 	}
+	return true
 }
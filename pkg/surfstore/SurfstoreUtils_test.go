@@ -0,0 +1,247 @@
+package surfstore
+
+import (
+	context "context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+)
+
+// serveSurfstore serves a MetaStore and its only BlockStore on one local
+// port, like a server of both roles, until the test ends.
+func serveSurfstore(t *testing.T, opts ...grpc.ServerOption) (string, *MetaStore, *BlockStore) {
+	listen, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listen.Addr().String()
+	m := NewMetaStore([]string{addr})
+	bs := NewBlockStore()
+	server := grpc.NewServer(opts...)
+	RegisterMetaStoreServer(server, m)
+	RegisterBlockStoreServer(server, bs)
+	go server.Serve(listen)
+	t.Cleanup(server.Stop)
+	return addr, m, bs
+}
+
+// newTestClient returns a client syncing baseDir in blocks of 1 KiB.
+func newTestClient(t *testing.T, addr string, baseDir string) RPCClient {
+	client := NewSurfstoreRPCClient(addr, baseDir, 1024)
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// interceptMethod runs hook after every call of one method.
+func interceptMethod(method string, hook func()) grpc.ServerOption {
+	return grpc.UnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+		handler grpc.UnaryHandler) (interface{}, error) {
+		resp, err := handler(ctx, req)
+		if info.FullMethod == method {
+			hook()
+		}
+		return resp, err
+	})
+}
+
+// callCounter counts the calls of every method served with its interceptor.
+type callCounter struct {
+	lock  sync.Mutex
+	calls map[string]int
+}
+
+func (c *callCounter) intercept(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo,
+	handler grpc.UnaryHandler) (interface{}, error) {
+	c.lock.Lock()
+	if c.calls == nil {
+		c.calls = make(map[string]int)
+	}
+	c.calls[info.FullMethod]++
+	c.lock.Unlock()
+	return handler(ctx, req)
+}
+
+func (c *callCounter) count(method string) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.calls[method]
+}
+
+func remoteFiles(t *testing.T, m *MetaStore) map[string]*FileMetaData {
+	files, err := m.GetFileInfoMap(context.Background(), &emptypb.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files.FileInfoMap
+}
+
+func TestRPCTimeoutBoundsEachCall(t *testing.T) {
+	addr, _, _ := serveSurfstore(t, grpc.UnaryInterceptor(func(ctx context.Context, req interface{},
+		info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		time.Sleep(200 * time.Millisecond)
+		return handler(ctx, req)
+	}))
+	client := newTestClient(t, addr, t.TempDir())
+	var addrs []string
+
+	client.RPCTimeout = 50 * time.Millisecond
+	err := client.GetBlockStoreAddrs(context.Background(), &addrs)
+	if !errors.Is(err, ErrNetwork) || status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("slow call with a short RPC timeout = %v", err)
+	}
+	client.RPCTimeout = 0
+	if err := client.GetBlockStoreAddrs(context.Background(), &addrs); err != nil || len(addrs) != 1 {
+		t.Errorf("slow call without RPC timeout = %v, %v", addrs, err)
+	}
+	// the deadline of the caller still applies
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := client.GetBlockStoreAddrs(ctx, &addrs); status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("slow call past the caller's deadline = %v", err)
+	}
+}
+
+func TestClientSyncStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// cancel once the first block is stored, as Ctrl-C would
+	var puts int32
+	addr, m, _ := serveSurfstore(t, interceptMethod("/surfstore.BlockStore/PutBlock", func() {
+		if atomic.AddInt32(&puts, 1) == 1 {
+			cancel()
+		}
+	}))
+	dir := t.TempDir()
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		writeTestFile(t, filepath.Join(dir, name), name+" content")
+	}
+	client := newTestClient(t, addr, dir)
+
+	if _, err := ClientSync(ctx, client); err == nil {
+		t.Fatal("cancelled sync succeeded")
+	}
+	// the index only records what the MetaStore has
+	index, err := LoadLocalIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	remote := remoteFiles(t, m)
+	if len(remote) == 3 {
+		t.Errorf("sync went on after the cancellation")
+	}
+	for filename, entry := range index.Entries {
+		if meta, ok := remote[filename]; !ok || meta.Version != entry.Version || !SameHashList(meta.BlockHashList, entry.BlockHashList) {
+			t.Errorf("index entry %v does not match the MetaStore: %v", filename, meta)
+		}
+	}
+
+	if _, err := ClientSync(context.Background(), client); err != nil {
+		t.Fatal(err)
+	}
+	remote = remoteFiles(t, m)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		if meta, ok := remote[name]; !ok || meta.Version != 1 {
+			t.Errorf("%v after the second sync: %v", name, meta)
+		}
+		if content, err := ioutil.ReadFile(filepath.Join(dir, name)); err != nil || string(content) != name+" content" {
+			t.Errorf("%v changed locally: %q, %v", name, content, err)
+		}
+	}
+}
+
+func TestFailedDownloadKeepsTheLocalFile(t *testing.T) {
+	// fails every GetBlock but the first while set
+	var failing int32
+	addr, _, _ := serveSurfstore(t, grpc.UnaryInterceptor(func(ctx context.Context, req interface{},
+		info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if info.FullMethod == "/surfstore.BlockStore/GetBlock" && atomic.LoadInt32(&failing) > 0 &&
+			atomic.AddInt32(&failing, 1) > 2 {
+			return nil, status.Error(codes.Unavailable, "block store gone")
+		}
+		return handler(ctx, req)
+	}))
+	dir_a, dir_b := t.TempDir(), t.TempDir()
+	client_a, client_b := newTestClient(t, addr, dir_a), newTestClient(t, addr, dir_b)
+	path_a, path_b := filepath.Join(dir_a, "f.txt"), filepath.Join(dir_b, "f.txt")
+	old_content, new_content := strings.Repeat("o", 3000), strings.Repeat("n", 3000)
+
+	writeTestFile(t, path_a, old_content)
+	for _, client := range []RPCClient{client_a, client_b} {
+		if _, err := ClientSync(context.Background(), client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the mode travels with the version
+	writeTestFile(t, path_a, new_content)
+	if err := os.Chmod(path_a, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ClientSync(context.Background(), client_a); err != nil {
+		t.Fatal(err)
+	}
+
+	atomic.StoreInt32(&failing, 1)
+	if _, err := ClientSync(context.Background(), client_b); !errors.Is(err, ErrNetwork) {
+		t.Fatalf("sync with a failing block store = %v", err)
+	}
+	if content, _ := ioutil.ReadFile(path_b); string(content) != old_content {
+		t.Errorf("failed download changed the local file to %q", content)
+	}
+
+	atomic.StoreInt32(&failing, 0)
+	if _, err := ClientSync(context.Background(), client_b); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := ioutil.ReadFile(path_b); string(content) != new_content {
+		t.Errorf("downloaded file holds %q", content)
+	}
+	if info, err := os.Stat(path_b); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("permissions after the download: %v, %v", info.Mode(), err)
+	}
+	entries, err := ioutil.ReadDir(dir_b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if IsTempFile(entry.Name()) {
+			t.Errorf("temp file %v left behind", entry.Name())
+		}
+	}
+}
+
+func TestUploadPutsOneBlockPerHash(t *testing.T) {
+	counter := &callCounter{}
+	addr, m, bs := serveSurfstore(t, grpc.UnaryInterceptor(counter.intercept))
+	dir := t.TempDir()
+	// exactly two blocks, so the last read is empty
+	writeTestFile(t, filepath.Join(dir, "two.txt"), strings.Repeat("a", 1024)+strings.Repeat("b", 1024))
+	writeTestFile(t, filepath.Join(dir, "empty.txt"), "")
+	if _, err := ClientSync(context.Background(), newTestClient(t, addr, dir)); err != nil {
+		t.Fatal(err)
+	}
+	if puts := counter.count("/surfstore.BlockStore/PutBlock"); puts != 2 {
+		t.Errorf("%d PutBlock calls for two blocks", puts)
+	}
+	if blocks := bs.Stats().Blocks; blocks != 2 {
+		t.Errorf("block store holds %d blocks", blocks)
+	}
+	remote := remoteFiles(t, m)
+	if two := remote["two.txt"]; two == nil || len(two.BlockHashList) != 2 || len(two.BlockSizeList) != 2 {
+		t.Errorf("two.txt = %v", two)
+	}
+	if empty := remote["empty.txt"]; empty == nil || len(empty.BlockHashList) != 0 || IsTombstone(empty.BlockHashList) {
+		t.Errorf("empty.txt = %v", empty)
+	}
+}
@@ -5,9 +5,15 @@ import signal
 import time
 import shutil
 import random
+import sys
 
 server_process = None
 
+# Run with --tls to exercise mutual TLS using certificates from `make certs`
+TLS = "--tls" in sys.argv
+SERVER_TLS_FLAGS = "-tlsCert certs/server.pem -tlsKey certs/server.key -tlsClientCA certs/ca.pem " if TLS else ""
+CLIENT_TLS_FLAGS = "-tlsCA certs/ca.pem -tlsCert certs/client.pem -tlsKey certs/client.key " if TLS else ""
+
 def test_error(msg):
     # Kill server process
     global server_process
@@ -17,7 +23,7 @@ def test_error(msg):
 
 def sync_folder(local_dir, wait=True):
     global server_process
-    cmd_client = "exec go run cmd/SurfstoreClientExec/main.go -d localhost:8081 {} 4".format(local_dir)
+    cmd_client = "exec go run cmd/SurfstoreClientExec/main.go -d {}localhost:8081 {} 4".format(CLIENT_TLS_FLAGS, local_dir)
     client_process = subprocess.Popen(cmd_client, stdout=subprocess.PIPE, shell=True)
     if wait:
         try:
@@ -28,8 +34,11 @@ def sync_folder(local_dir, wait=True):
 
 
 if __name__ == '__main__':
+    if TLS:
+        subprocess.run("make certs", shell=True, check=True, stdout=subprocess.DEVNULL, stderr=subprocess.DEVNULL)
+
     # Run rpc server
-    cmd = "exec go run cmd/SurfstoreServerExec/main.go -s both -p 8081 -l localhost:8081"
+    cmd = "exec go run cmd/SurfstoreServerExec/main.go -s both -p 8081 -l {}localhost:8081".format(SERVER_TLS_FLAGS)
     server_process = subprocess.Popen(cmd, stdout=subprocess.PIPE, shell=True, preexec_fn=os.setsid)
 
     # Wait for server to start